@@ -0,0 +1,459 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheEntryOverhead approximates the memory used by an entry besides its
+	// records.
+	cacheEntryOverhead = 128
+	// maxNegativeTTL caps how long a negative answer is cached.
+	// See [RFC2308 5]
+	// [RFC2308 5]: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+	maxNegativeTTL = 3 * 60 * 60
+
+	// staleAnswerTTL is the TTL of the records served from expired entries.
+	// See [RFC8767 4]
+	// [RFC8767 4]: https://datatracker.ietf.org/doc/html/rfc8767#section-4
+	staleAnswerTTL = 30
+	// prefetchMinHits is the number of hits an entry needs before it is
+	// refreshed ahead of its expiry.
+	prefetchMinHits = 3
+	// prefetchMinTTL is the smallest TTL worth prefetching, in seconds.
+	prefetchMinTTL = 10
+	// prefetchRatio is the fraction of the original TTL left when an entry
+	// becomes eligible for prefetching.
+	prefetchRatio = 0.1
+)
+
+type cacheKey struct {
+	name   string
+	rrType uint16
+	class  uint16
+	// dnssecOK is the DO bit of the request, whose answer only holds DNSSEC
+	// records when it is set.
+	// See [RFC3225 3]
+	// [RFC3225 3]: https://datatracker.ietf.org/doc/html/rfc3225#section-3
+	dnssecOK bool
+}
+
+func newCacheKey(q DNSQuestion, dnssecOK bool) cacheKey {
+	return cacheKey{
+		name:     strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+		rrType:   q.Type,
+		class:    q.Class,
+		dnssecOK: dnssecOK,
+	}
+}
+
+// cacheEntry is a response stored in the cache. Its records are kept with
+// the TTLs they were received with.
+type cacheEntry struct {
+	key         cacheKey
+	rcode       uint16
+	answers     []DNSAnswer
+	authorities []DNSAnswer
+	additionals []DNSAnswer
+	storedAt    time.Time
+	expiresAt   time.Time
+	size        int
+	hits        int
+	prefetching bool
+	// authenticated is the AD flag of the response.
+	authenticated bool
+}
+
+// message returns a copy of the entry records with elapsed seconds removed
+// from their TTLs.
+func (entry *cacheEntry) message(elapsed uint32) *DNSMessage {
+	msg := &DNSMessage{}
+	msg.Header.Flags.RCODE = entry.rcode
+	msg.Header.Flags.AD = entry.authenticated
+	msg.AddAnswers(decrementTTLs(entry.answers, elapsed)...)
+	msg.AddAuthorities(decrementTTLs(entry.authorities, elapsed)...)
+	msg.AddAdditionals(decrementTTLs(entry.additionals, elapsed)...)
+	return msg
+}
+
+// Cache stores upstream responses keyed by question. Entries expire with the
+// smallest TTL of their records and the least recently used entries are
+// evicted once the cache grows past its maximum size in bytes.
+//
+// Expired entries are kept for staleWindow so that they can be served when
+// upstreams fail, as described by [RFC8767].
+//
+// [RFC8767]: https://datatracker.ietf.org/doc/html/rfc8767
+type Cache struct {
+	mu          sync.Mutex
+	maxSize     int
+	size        int
+	staleWindow time.Duration
+	entries     map[cacheKey]*list.Element
+	lru         *list.List
+	now         func() time.Time
+}
+
+func NewCache(maxSize int, staleWindow time.Duration) *Cache {
+	return &Cache{
+		maxSize:     maxSize,
+		staleWindow: staleWindow,
+		entries:     map[cacheKey]*list.Element{},
+		lru:         list.New(),
+		now:         time.Now,
+	}
+}
+
+// Get returns a copy of the response cached for q asked with the DO bit set
+// to dnssecOK, with TTLs decremented by the time spent in the cache. Expired
+// entries are reported as misses and evicted once they are too old to be
+// served stale.
+func (c *Cache) Get(q DNSQuestion, dnssecOK bool) (*DNSMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, entry, ok := c.lookup(q, dnssecOK)
+	if !ok {
+		return nil, false
+	}
+	now := c.now()
+	if !now.Before(entry.expiresAt) {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+
+	return entry.message(uint32(now.Sub(entry.storedAt) / time.Second)), true
+}
+
+// GetStale returns a copy of the expired response cached for q asked with
+// the DO bit set to dnssecOK, with the TTL of every record set to
+// staleAnswerTTL.
+func (c *Cache) GetStale(q DNSQuestion, dnssecOK bool) (*DNSMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, entry, ok := c.lookup(q, dnssecOK)
+	if !ok || c.now().Before(entry.expiresAt) {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+
+	msg := entry.message(0)
+	for _, section := range [][]DNSAnswer{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			section[i].TTL = staleAnswerTTL
+		}
+	}
+	return msg, true
+}
+
+// claimPrefetch reports whether the entry cached for q asked with the DO bit
+// set to dnssecOK is popular and close enough to its expiry to be refreshed
+// ahead of time. Only the first caller gets true until the entry is replaced.
+func (c *Cache) claimPrefetch(q DNSQuestion, dnssecOK bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, entry, ok := c.lookup(q, dnssecOK)
+	if !ok || entry.prefetching || entry.hits < prefetchMinHits {
+		return false
+	}
+	ttl := entry.expiresAt.Sub(entry.storedAt)
+	if ttl < prefetchMinTTL*time.Second {
+		return false
+	}
+	remaining := entry.expiresAt.Sub(c.now())
+	if remaining <= 0 || remaining > time.Duration(float64(ttl)*prefetchRatio) {
+		return false
+	}
+	entry.prefetching = true
+	return true
+}
+
+// lookup returns the entry stored for q asked with the DO bit set to
+// dnssecOK, evicting it when it has been expired for longer than the stale
+// window.
+func (c *Cache) lookup(q DNSQuestion, dnssecOK bool) (*list.Element, *cacheEntry, bool) {
+	elem, ok := c.entries[newCacheKey(q, dnssecOK)]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expiresAt.Add(c.staleWindow)) {
+		c.remove(elem)
+		return nil, nil, false
+	}
+	return elem, entry, true
+}
+
+// Set stores the records of resp as the answer to q asked with the DO bit set
+// to dnssecOK. Responses without TTL or larger than the cache are ignored.
+//
+// Negative responses, NXDOMAIN or NOERROR without answer, are stored with
+// the SOA record of their authority section only and expire after the
+// negative TTL defined by [RFC2308 5]. They are ignored when there is no SOA.
+//
+// [RFC2308 5]: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func (c *Cache) Set(q DNSQuestion, dnssecOK bool, resp *DNSMessage) {
+	answers, authorities, additionals := resp.Answers, resp.Authorities, resp.Additionals
+	if isNegative(resp) {
+		soa, ok := negativeSOA(resp)
+		if !ok {
+			return
+		}
+		// The NSEC records and signatures proving the denial are kept for
+		// the clients validating it
+		authorities, additionals = append([]DNSAnswer{soa}, denialProof(resp.Authorities)...), nil
+	}
+	ttl, ok := minTTL(answers, authorities, additionals)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	entry := &cacheEntry{
+		key:           newCacheKey(q, dnssecOK),
+		rcode:         resp.Header.Flags.RCODE,
+		authenticated: resp.Header.Flags.AD,
+		answers:       answers,
+		authorities:   authorities,
+		additionals:   additionals,
+		storedAt:      now,
+		expiresAt:     now.Add(time.Duration(ttl) * time.Second),
+	}
+	entry.size = entrySize(entry)
+	if entry.size > c.maxSize {
+		return
+	}
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// entrySize approximates the memory used by an entry with the size of its
+// records in wire format.
+func entrySize(entry *cacheEntry) int {
+	size := cacheEntryOverhead + len(entry.key.name)
+	for _, section := range [][]DNSAnswer{entry.answers, entry.authorities, entry.additionals} {
+		for _, rr := range section {
+			buf, err := rr.MarshalBinary()
+			if err != nil {
+				size += len(rr.Name) + len(rr.Data)
+				continue
+			}
+			size += len(buf)
+		}
+	}
+	return size
+}
+
+// minTTL returns the smallest TTL among records. It returns false when there
+// is no record.
+func minTTL(sections ...[]DNSAnswer) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range sections {
+		for _, rr := range section {
+			if !found || rr.TTL < ttl {
+				ttl = rr.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// decrementTTLs returns a copy of records with elapsed seconds removed from
+// their TTL.
+func decrementTTLs(records []DNSAnswer, elapsed uint32) []DNSAnswer {
+	result := make([]DNSAnswer, len(records))
+	for i, rr := range records {
+		if rr.TTL > elapsed {
+			rr.TTL -= elapsed
+		} else {
+			rr.TTL = 0
+		}
+		result[i] = rr
+	}
+	return result
+}
+
+// CachingResolver answers requests from a Cache and only forwards cache
+// misses to its upstream.
+type CachingResolver struct {
+	upstream Upstream
+	cache    *Cache
+}
+
+func NewCachingResolver(upstream Upstream, cache *Cache) *CachingResolver {
+	return &CachingResolver{
+		upstream: upstream,
+		cache:    cache,
+	}
+}
+
+func (r *CachingResolver) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	// Answers not checked by the upstream are not cached
+	if len(msg.Questions) != 1 || msg.Header.Flags.CD {
+		return r.upstream.SendRequest(msg)
+	}
+	q := msg.Questions[0]
+	dnssecOK := msg.EDNS != nil && msg.EDNS.DO
+
+	if cached, ok := r.cache.Get(q, dnssecOK); ok {
+		log.Printf("cache hit for %s %d", q.Name, q.Type)
+		if r.cache.claimPrefetch(q, dnssecOK) {
+			go r.prefetch(q, dnssecOK)
+		}
+		return cachedResponse(msg, cached), nil
+	}
+
+	resp, err := r.upstream.SendRequest(msg)
+	if err != nil || resp.RCODE() == ServerFailureResponseCode {
+		if stale, ok := r.cache.GetStale(q, dnssecOK); ok {
+			log.Printf("upstream failed for %s %d, serving stale answer: %v", q.Name, q.Type, err)
+			return cachedResponse(msg, stale), nil
+		}
+		return resp, err
+	}
+	if isCacheable(resp) {
+		r.cache.Set(q, dnssecOK, resp)
+	}
+	return resp, nil
+}
+
+// prefetch refreshes the cached answer to q asked with the DO bit set to
+// dnssecOK in the background.
+func (r *CachingResolver) prefetch(q DNSQuestion, dnssecOK bool) {
+	log.Printf("prefetching %s %d", q.Name, q.Type)
+	req := &DNSMessage{}
+	req.Header.Flags.RD = true
+	req.AddQuestions(q)
+	if dnssecOK {
+		req.SetEDNS(&EDNS{UDPSize: maxUDPSize, DO: true})
+	}
+	resp, err := r.upstream.SendRequest(req)
+	if err != nil {
+		log.Printf("failed to prefetch %s %d: %v", q.Name, q.Type, err)
+		return
+	}
+	if isCacheable(resp) {
+		r.cache.Set(q, dnssecOK, resp)
+	}
+}
+
+// cachedResponse builds the response to msg from a cached one.
+func cachedResponse(msg *DNSMessage, cached *DNSMessage) *DNSMessage {
+	resp := CreateResponse(msg)
+	resp.Header.Flags.RA = true
+	resp.Header.Flags.RCODE = cached.Header.Flags.RCODE
+	resp.Header.Flags.AD = cached.Header.Flags.AD
+	resp.AddAnswers(cached.Answers...)
+	resp.AddAuthorities(cached.Authorities...)
+	resp.AddAdditionals(cached.Additionals...)
+	return resp
+}
+
+// denialProof returns the DNSSEC records of authorities proving a denial of
+// existence.
+func denialProof(authorities []DNSAnswer) []DNSAnswer {
+	var proof []DNSAnswer
+	for _, rr := range authorities {
+		switch rr.Type {
+		case NSECRecordType, NSEC3RecordType, RRSIGRecordType:
+			proof = append(proof, rr)
+		}
+	}
+	return proof
+}
+
+// isCacheable reports whether a response holds a complete answer, either
+// positive or negative.
+func isCacheable(resp *DNSMessage) bool {
+	if resp.Header.Flags.TC {
+		return false
+	}
+	if isNegative(resp) {
+		_, ok := negativeSOA(resp)
+		return ok
+	}
+	return resp.RCODE() == NoErrorResponseCode && len(resp.Answers) > 0
+}
+
+// isNegative reports whether resp states that the name (NXDOMAIN) or the
+// requested type (NODATA) does not exist.
+// See [RFC2308 2]
+//
+// [RFC2308 2]: https://datatracker.ietf.org/doc/html/rfc2308#section-2
+func isNegative(resp *DNSMessage) bool {
+	switch resp.RCODE() {
+	case NameErrorResponseCode:
+		return true
+	case NoErrorResponseCode:
+		return len(resp.Answers) == 0 || !answersQuestion(resp)
+	}
+	return false
+}
+
+// answersQuestion reports whether the answer section holds records of the
+// requested type, and not only the CNAME chain leading to it.
+func answersQuestion(resp *DNSMessage) bool {
+	if len(resp.Questions) == 0 {
+		return true
+	}
+	q := resp.Questions[0]
+	for _, rr := range resp.Answers {
+		if rr.Type == q.Type || q.Type == ANYRecordType {
+			return true
+		}
+	}
+	return false
+}
+
+// negativeSOA returns the SOA record of the authority section of a negative
+// response with its TTL set to the negative caching TTL, the minimum of the
+// SOA TTL and of its MINIMUM field.
+func negativeSOA(resp *DNSMessage) (DNSAnswer, bool) {
+	for _, rr := range resp.Authorities {
+		soa, ok := rr.RData.(*SOARecord)
+		if rr.Type != SOARecordType || !ok {
+			continue
+		}
+		if soa.Minimum < rr.TTL {
+			rr.TTL = soa.Minimum
+		}
+		if rr.TTL > maxNegativeTTL {
+			rr.TTL = maxNegativeTTL
+		}
+		return rr, true
+	}
+	return DNSAnswer{}, false
+}
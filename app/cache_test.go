@@ -0,0 +1,418 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamFunc adapts a function to the Upstream interface.
+type upstreamFunc func(msg *DNSMessage) (*DNSMessage, error)
+
+func (f upstreamFunc) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	return f(msg)
+}
+
+// countingUpstream answers every request with an A record holding ip and
+// counts the requests it received.
+type countingUpstream struct {
+	mu    sync.Mutex
+	calls int
+	ttl   uint32
+	ip    net.IP
+}
+
+func (u *countingUpstream) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	u.mu.Lock()
+	u.calls++
+	u.mu.Unlock()
+	resp := answerA(msg, u.ip)
+	resp.Answers[0].TTL = u.ttl
+	return resp, nil
+}
+
+func (u *countingUpstream) Calls() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls
+}
+
+// fakeClock is a controllable time source for the cache.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestCache(maxSize int) (*Cache, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cache := NewCache(maxSize, 0)
+	cache.now = clock.Now
+	return cache, clock
+}
+
+func TestCache_DecrementsTTLAndExpires(t *testing.T) {
+	cache, clock := newTestCache(1 << 20)
+	q := DNSQuestion{Name: "www.example.com", Type: ARecordType, Class: INRecordClass}
+	resp := answerA(newQuery(q.Name, q.Type), net.IP{192, 0, 2, 1})
+	resp.Answers[0].TTL = 60
+
+	cache.Set(q, false, resp)
+
+	clock.Advance(20 * time.Second)
+	cached, ok := cache.Get(DNSQuestion{Name: "WWW.Example.com.", Type: ARecordType, Class: INRecordClass}, false)
+	if !ok {
+		t.Fatalf("expected a cache hit")
+	}
+	if cached.Answers[0].TTL != 40 {
+		t.Errorf("expected TTL 40 but got %d", cached.Answers[0].TTL)
+	}
+	if resp.Answers[0].TTL != 60 {
+		t.Errorf("expected cached records to be copied but original TTL is now %d", resp.Answers[0].TTL)
+	}
+
+	clock.Advance(40 * time.Second)
+	if _, ok := cache.Get(q, false); ok {
+		t.Errorf("expected the entry to be expired")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected expired entry to be evicted but cache holds %d entries", cache.Len())
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	questions := []DNSQuestion{
+		{Name: "a.example.com", Type: ARecordType, Class: INRecordClass},
+		{Name: "b.example.com", Type: ARecordType, Class: INRecordClass},
+		{Name: "c.example.com", Type: ARecordType, Class: INRecordClass},
+	}
+	responses := make([]*DNSMessage, len(questions))
+	for i, q := range questions {
+		responses[i] = answerA(newQuery(q.Name, q.Type), net.IP{192, 0, 2, byte(i)})
+	}
+	size := entrySize(&cacheEntry{key: newCacheKey(questions[0], false), answers: responses[0].Answers})
+	cache, _ := newTestCache(2 * size)
+
+	cache.Set(questions[0], false, responses[0])
+	cache.Set(questions[1], false, responses[1])
+	// Use a so that b is the least recently used entry
+	if _, ok := cache.Get(questions[0], false); !ok {
+		t.Fatalf("expected a cache hit for %s", questions[0].Name)
+	}
+	cache.Set(questions[2], false, responses[2])
+
+	for i, expected := range []bool{true, false, true} {
+		if _, ok := cache.Get(questions[i], false); ok != expected {
+			t.Errorf("expected cache hit for %s to be %v", questions[i].Name, expected)
+		}
+	}
+}
+
+func TestCachingResolver_SendRequest(t *testing.T) {
+	upstream := &countingUpstream{ttl: 60, ip: net.IP{192, 0, 2, 1}}
+	cache, clock := newTestCache(1 << 20)
+	resolver := NewCachingResolver(upstream, cache)
+
+	for i := 0; i < 3; i++ {
+		req := newQuery("www.example.com", ARecordType)
+		req.Header.ID = uint16(i)
+		resp, err := resolver.SendRequest(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if resp.Header.ID != uint16(i) {
+			t.Errorf("expected response ID %d but got %d", i, resp.Header.ID)
+		}
+		if len(resp.Answers) != 1 {
+			t.Errorf("expected 1 answer but got %d", len(resp.Answers))
+		}
+		clock.Advance(time.Second)
+	}
+	if upstream.Calls() != 1 {
+		t.Errorf("expected a single upstream request but got %d", upstream.Calls())
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if upstream.Calls() != 2 {
+		t.Errorf("expected expired entry to be refreshed from upstream but got %d calls", upstream.Calls())
+	}
+}
+
+func TestCachingResolver_DNSSECOK(t *testing.T) {
+	// The upstream only adds a TXT record to the answers of requests with DO
+	upstream := &countingUpstream{ttl: 60, ip: net.IP{192, 0, 2, 1}}
+	marking := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+		resp, err := upstream.SendRequest(msg)
+		if err == nil && msg.EDNS != nil && msg.EDNS.DO {
+			resp.AddAnswers(DNSAnswer{
+				Name: msg.Questions[0].Name, Type: TXTRecordType, Class: INRecordClass, TTL: 60,
+				RData: &TXTRecord{Texts: []string{"signed"}},
+			})
+		}
+		return resp, err
+	})
+	cache, _ := newTestCache(1 << 20)
+	resolver := NewCachingResolver(marking, cache)
+
+	query := func(t *testing.T, dnssecOK bool) *DNSMessage {
+		req := newQuery("www.example.com", ARecordType)
+		req.SetEDNS(&EDNS{UDPSize: 1232, DO: dnssecOK})
+		resp, err := resolver.SendRequest(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+	tcs := []struct {
+		name            string
+		dnssecOK        bool
+		expectedAnswers int
+		expectedCalls   int
+	}{
+		{name: "request without DO", expectedAnswers: 1, expectedCalls: 1},
+		{name: "request with DO", dnssecOK: true, expectedAnswers: 2, expectedCalls: 2},
+		{name: "cached answer without DO", expectedAnswers: 1, expectedCalls: 2},
+		{name: "cached answer with DO", dnssecOK: true, expectedAnswers: 2, expectedCalls: 2},
+	}
+
+	// Each case depends on the entries cached by the previous ones
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp := query(t, tc.dnssecOK)
+			if len(resp.Answers) != tc.expectedAnswers {
+				t.Errorf("expected %d answers but got %d", tc.expectedAnswers, len(resp.Answers))
+			}
+			if upstream.Calls() != tc.expectedCalls {
+				t.Errorf("expected %d upstream requests but got %d", tc.expectedCalls, upstream.Calls())
+			}
+		})
+	}
+}
+
+func TestCachingResolver_NegativeCaching(t *testing.T) {
+	soa := DNSAnswer{
+		Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 300,
+		RData: &SOARecord{MName: "ns.example.com", RName: "hostmaster.example.com", Minimum: 60},
+	}
+	tcs := []struct {
+		name          string
+		rcode         uint16
+		authorities   []DNSAnswer
+		expectedCalls int
+	}{
+		{
+			name:          "NXDOMAIN is cached for the SOA minimum",
+			rcode:         NameErrorResponseCode,
+			authorities:   []DNSAnswer{soa},
+			expectedCalls: 1,
+		},
+		{
+			name:          "NODATA is cached for the SOA minimum",
+			rcode:         NoErrorResponseCode,
+			authorities:   []DNSAnswer{soa},
+			expectedCalls: 1,
+		},
+		{
+			name:          "negative answer without SOA is not cached",
+			rcode:         NameErrorResponseCode,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			upstream := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+				calls++
+				resp := CreateResponse(msg)
+				resp.Header.Flags.RCODE = tc.rcode
+				resp.AddAuthorities(tc.authorities...)
+				return resp, nil
+			})
+			cache, clock := newTestCache(1 << 20)
+			resolver := NewCachingResolver(upstream, cache)
+
+			if _, err := resolver.SendRequest(newQuery("missing.example.com", ARecordType)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			clock.Advance(10 * time.Second)
+			resp, err := resolver.SendRequest(newQuery("missing.example.com", ARecordType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls != tc.expectedCalls {
+				t.Fatalf("expected %d upstream requests but got %d", tc.expectedCalls, calls)
+			}
+			if resp.RCODE() != tc.rcode {
+				t.Errorf("expected RCODE %d but got %d", tc.rcode, resp.RCODE())
+			}
+			if len(tc.authorities) == 0 {
+				return
+			}
+			if len(resp.Authorities) != 1 || resp.Authorities[0].Type != SOARecordType {
+				t.Fatalf("expected the SOA record in the authority section but got %+v", resp.Authorities)
+			}
+			if resp.Authorities[0].TTL != 50 {
+				t.Errorf("expected SOA TTL 50 but got %d", resp.Authorities[0].TTL)
+			}
+
+			clock.Advance(50 * time.Second)
+			if _, err := resolver.SendRequest(newQuery("missing.example.com", ARecordType)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls != 2 {
+				t.Errorf("expected negative entry to expire after the SOA minimum")
+			}
+		})
+	}
+}
+
+func TestCachingResolver_ServeStale(t *testing.T) {
+	failing := false
+	upstream := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+		if failing {
+			return nil, errors.New("upstream timed out")
+		}
+		resp := answerA(msg, net.IP{192, 0, 2, 1})
+		resp.Answers[0].TTL = 60
+		return resp, nil
+	})
+	cache, clock := newTestCache(1 << 20)
+	cache.staleWindow = time.Hour
+	resolver := NewCachingResolver(upstream, cache)
+
+	if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	failing = true
+
+	clock.Advance(2 * time.Minute)
+	resp, err := resolver.SendRequest(newQuery("www.example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("expected a stale answer but got error: %v", err)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].TTL != staleAnswerTTL {
+		t.Errorf("expected a single answer with TTL %d but got %+v", staleAnswerTTL, resp.Answers)
+	}
+
+	clock.Advance(time.Hour)
+	if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err == nil {
+		t.Errorf("expected an error once the entry is older than the stale window")
+	}
+}
+
+func TestCachingResolver_Prefetch(t *testing.T) {
+	upstream := &countingUpstream{ttl: 100, ip: net.IP{192, 0, 2, 1}}
+	cache, clock := newTestCache(1 << 20)
+	resolver := NewCachingResolver(upstream, cache)
+
+	for i := 0; i < prefetchMinHits+1; i++ {
+		if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if upstream.Calls() != 1 {
+		t.Fatalf("expected no prefetch before the entry is close to expiry but got %d calls", upstream.Calls())
+	}
+
+	clock.Advance(95 * time.Second)
+	if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for upstream.Calls() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if upstream.Calls() != 2 {
+		t.Fatalf("expected a background prefetch but got %d calls", upstream.Calls())
+	}
+
+	clock.Advance(10 * time.Second)
+	resp, err := resolver.SendRequest(newQuery("www.example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if upstream.Calls() != 2 || resp.Answers[0].TTL != 90 {
+		t.Errorf("expected the prefetched entry to be served but got TTL %d after %d calls", resp.Answers[0].TTL, upstream.Calls())
+	}
+}
+
+func TestCachingResolver_DNSSEC(t *testing.T) {
+	upstream, anchor := newValidationFixture(t)
+	cache, _ := newTestCache(1 << 20)
+	resolver := NewCachingResolver(newTestValidator(t, upstream, anchor), cache)
+
+	tcs := []struct {
+		name          string
+		question      string
+		expectedRCODE uint16
+		expectedTypes []uint16
+	}{
+		{name: "secure answer", question: "www.example", expectedRCODE: NoErrorResponseCode},
+		{
+			name:          "secure denial keeps its proof",
+			question:      "missing.example",
+			expectedRCODE: NameErrorResponseCode,
+			expectedTypes: []uint16{SOARecordType, NSECRecordType, RRSIGRecordType},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := resolver.SendRequest(newQuery(tc.question, ARecordType)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			requests := upstream.Requests()
+			resp, err := resolver.SendRequest(newQuery(tc.question, ARecordType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if upstream.Requests() != requests {
+				t.Errorf("expected the answer to be served from the cache")
+			}
+			if resp.RCODE() != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.RCODE())
+			}
+			if !resp.Header.Flags.AD {
+				t.Errorf("expected the cached answer to keep the AD flag")
+			}
+			var types []uint16
+			for _, rr := range resp.Authorities {
+				types = append(types, rr.Type)
+			}
+			for _, rrType := range tc.expectedTypes {
+				if !hasType(types, rrType) {
+					t.Errorf("expected a record of type %d in the authority section", rrType)
+				}
+			}
+
+			req := newQuery(tc.question, ARecordType)
+			req.Header.Flags.CD = true
+			if _, err := resolver.SendRequest(req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if upstream.Requests() == requests {
+				t.Errorf("expected a request with CD to bypass the cache")
+			}
+		})
+	}
+}
@@ -7,6 +7,8 @@ const (
 	StandardQueryOpCode = 0
 	InverseQueryOpCode  = 1
 	ServerStatusOpCode  = 2
+	NotifyOpCode        = 4 // See [RFC1996]
+	UpdateOpCode        = 5 // See [RFC2136]
 
 	// Response Codes (RCODE)
 	// See [RFC1035 4.1.1]
@@ -17,4 +19,72 @@ const (
 	NameErrorResponseCode      = 3
 	NotImplementedResponseCode = 4
 	RefusedResponseCode        = 5
+	YXDomainResponseCode       = 6  // See [RFC2136]
+	YXRRSetResponseCode        = 7  // See [RFC2136]
+	NXRRSetResponseCode        = 8  // See [RFC2136]
+	NotAuthResponseCode        = 9  // See [RFC2136]
+	NotZoneResponseCode        = 10 // See [RFC2136]
+
+	// Extended response codes, only available with EDNS(0)
+	// See [RFC6891 9]
+	// [RFC6891 9]: https://datatracker.ietf.org/doc/html/rfc6891#section-9
+	BadVersionResponseCode = 16
+
+	// TSIG errors, only found in the error field of TSIG records, where 16
+	// means BADSIG rather than BADVERS
+	// See [RFC8945 3]
+	// [RFC8945 3]: https://datatracker.ietf.org/doc/html/rfc8945#section-3
+	BadSignatureResponseCode = 16
+	BadKeyResponseCode       = 17
+	BadTimeResponseCode      = 18
+)
+
+const (
+	// TYPE values
+	// See [RFC1035 3.2.2]
+	// [RFC1035 3.2.2]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.2.2
+	ARecordType     = 1
+	NSRecordType    = 2
+	CNAMERecordType = 5
+	SOARecordType   = 6
+	PTRRecordType   = 12
+	MXRecordType    = 15
+	TXTRecordType   = 16
+	AAAARecordType  = 28  // See [RFC3596]
+	SRVRecordType   = 33  // See [RFC2782]
+	DNAMERecordType = 39  // See [RFC6672]
+	OPTRecordType   = 41  // See [RFC6891]
+	CAARecordType   = 257 // See [RFC8659]
+
+	// DNSSEC TYPE values
+	// See [RFC4034 7] and [RFC5155 11]
+	// [RFC4034 7]: https://datatracker.ietf.org/doc/html/rfc4034#section-7
+	// [RFC5155 11]: https://datatracker.ietf.org/doc/html/rfc5155#section-11
+	DSRecordType         = 43
+	RRSIGRecordType      = 46
+	NSECRecordType       = 47
+	DNSKEYRecordType     = 48
+	NSEC3RecordType      = 50
+	NSEC3PARAMRecordType = 51
+
+	// QTYPE values
+	// See [RFC1035 3.2.3]
+	// [RFC1035 3.2.3]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.2.3
+	TSIGRecordType = 250 // See [RFC8945]
+	IXFRRecordType = 251 // See [RFC1995]
+	AXFRRecordType = 252
+	ANYRecordType  = 255
+
+	// CLASS values
+	// See [RFC1035 3.2.4]
+	// [RFC1035 3.2.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.2.4
+	INRecordClass = 1
+	CHRecordClass = 3
+	HSRecordClass = 4
+
+	// QCLASS values
+	// See [RFC1035 3.2.5]
+	// [RFC1035 3.2.5]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.2.5
+	NONERecordClass = 254 // See [RFC2136]
+	ANYRecordClass  = 255
 )
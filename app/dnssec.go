@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DNSSEC signing algorithms
+	// See [RFC8624 3.1]
+	// [RFC8624 3.1]: https://datatracker.ietf.org/doc/html/rfc8624#section-3.1
+	RSASHA256Algorithm       = 8
+	ECDSAP256SHA256Algorithm = 13
+	ECDSAP384SHA384Algorithm = 14
+	ED25519Algorithm         = 15
+
+	// DS digest types
+	// See [RFC8624 3.3]
+	// [RFC8624 3.3]: https://datatracker.ietf.org/doc/html/rfc8624#section-3.3
+	SHA1DigestType   = 1
+	SHA256DigestType = 2
+	SHA384DigestType = 4
+
+	// NSEC3SHA1Algorithm is the only hash algorithm of NSEC3 records.
+	// See [RFC5155 11]
+	// [RFC5155 11]: https://datatracker.ietf.org/doc/html/rfc5155#section-11
+	NSEC3SHA1Algorithm = 1
+	// nsec3OptOut is the NSEC3 flag set when the insecure delegations of the
+	// span are not listed.
+	nsec3OptOut = 0x01
+
+	// zoneKeyFlag is set in the flags of the DNSKEY records signing zones.
+	// See [RFC4034 2.1.1]
+	// [RFC4034 2.1.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-2.1.1
+	zoneKeyFlag = 0x0100
+	// dnssecProtocol is the only valid protocol of DNSKEY records.
+	dnssecProtocol = 3
+)
+
+var (
+	// ErrBogus is returned when records fail DNSSEC validation.
+	ErrBogus = errors.New("DNSSEC validation failed")
+	// ErrUnsupportedAlgorithm is returned for signatures and digests made with
+	// an algorithm that is not implemented.
+	ErrUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+)
+
+// verifyRRSet checks that one of sigs is a valid signature of rrset by one of
+// keys, the keys of zone, at time now. It returns the signature that matched.
+// See [RFC4035 5.3]
+// [RFC4035 5.3]: https://datatracker.ietf.org/doc/html/rfc4035#section-5.3
+func verifyRRSet(rrset []DNSAnswer, sigs []*RRSIGRecord, keys []*DNSKEYRecord, zone string, now time.Time) (*RRSIGRecord, error) {
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%s %s is not signed: %w", fqdn(rrset[0].Name), recordTypeName(rrset[0].Type), ErrBogus)
+	}
+	lastErr := ErrUnsupportedAlgorithm
+	for _, sig := range sigs {
+		err := verifyRRSIG(rrset, sig, keys, zone, now)
+		if err == nil {
+			return sig, nil
+		}
+		if !errors.Is(err, ErrUnsupportedAlgorithm) {
+			lastErr = err
+		}
+	}
+	if errors.Is(lastErr, ErrUnsupportedAlgorithm) {
+		return nil, fmt.Errorf("%s %s: %w", fqdn(rrset[0].Name), recordTypeName(rrset[0].Type), lastErr)
+	}
+	return nil, fmt.Errorf("%s %s: %v: %w", fqdn(rrset[0].Name), recordTypeName(rrset[0].Type), lastErr, ErrBogus)
+}
+
+// verifyRRSIG checks sig against rrset, whose records share their owner, type
+// and class, trying the keys with the tag and algorithm of the signature.
+func verifyRRSIG(rrset []DNSAnswer, sig *RRSIGRecord, keys []*DNSKEYRecord, zone string, now time.Time) error {
+	owner := canonicalName(rrset[0].Name)
+	switch {
+	case canonicalName(sig.SignerName) != zone || !inZone(owner, zone):
+		return fmt.Errorf("signer %s is not the zone %s", fqdn(sig.SignerName), fqdn(zone))
+	case sig.TypeCovered != rrset[0].Type:
+		return fmt.Errorf("signature covers type %s", recordTypeName(sig.TypeCovered))
+	case int(sig.Labels) > labelCount(owner):
+		return fmt.Errorf("signature has %d labels", sig.Labels)
+	}
+	// Inception and expiration use serial number arithmetic
+	// See [RFC4034 3.1.5]
+	// [RFC4034 3.1.5]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.5
+	t := uint32(now.Unix())
+	if int32(t-sig.Inception) < 0 || int32(sig.Expiration-t) < 0 {
+		return fmt.Errorf("signature valid from %s to %s", formatSignatureTime(sig.Inception), formatSignatureTime(sig.Expiration))
+	}
+
+	data, err := signedData(rrset, sig)
+	if err != nil {
+		return err
+	}
+	err = fmt.Errorf("no key with tag %d", sig.KeyTag)
+	for _, key := range keys {
+		if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag ||
+			key.Flags&zoneKeyFlag == 0 || key.Protocol != dnssecProtocol {
+			continue
+		}
+		if err = verifySignature(key, sig.Signature, data); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// signedData returns the data sig signs: its RDATA without the signature
+// followed by rrset in canonical form, sorted and with the original TTL.
+// See [RFC4034 3.1.8.1]
+// [RFC4034 3.1.8.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.8.1
+func signedData(rrset []DNSAnswer, sig *RRSIGRecord) ([]byte, error) {
+	var buff bytes.Buffer
+	header := *sig
+	header.SignerName = canonicalName(sig.SignerName)
+	header.Signature = nil
+	header.marshal(&buff, nil)
+
+	// Wildcard expansions are signed with the owner name of the wildcard
+	// See [RFC4035 5.3.2]
+	// [RFC4035 5.3.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-5.3.2
+	owner := canonicalName(rrset[0].Name)
+	if labels := strings.Split(owner, "."); int(sig.Labels) < labelCount(owner) {
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.Labels):]...), ".")
+		if sig.Labels == 0 {
+			owner = "*"
+		}
+	}
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdata, err := canonicalRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	for i, rdata := range rdatas {
+		// Duplicate records are not part of the RRset
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		writeDomain(&buff, owner, nil)
+		binary.Write(&buff, binary.BigEndian, rrset[0].Type)
+		binary.Write(&buff, binary.BigEndian, rrset[0].Class)
+		binary.Write(&buff, binary.BigEndian, sig.OriginalTTL)
+		binary.Write(&buff, binary.BigEndian, uint16(len(rdata)))
+		buff.Write(rdata)
+	}
+	return buff.Bytes(), nil
+}
+
+// canonicalRData returns the RDATA of rr in canonical form: uncompressed and
+// with the names embedded by the older record types lowercased.
+// See [RFC4034 6.2]
+// [RFC4034 6.2]: https://datatracker.ietf.org/doc/html/rfc4034#section-6.2
+func canonicalRData(rr DNSAnswer) ([]byte, error) {
+	rdata := rr.RData
+	switch rd := rr.RData.(type) {
+	case nil:
+		return rr.Data, nil
+	case *NSRecord:
+		rdata = &NSRecord{Host: canonicalName(rd.Host)}
+	case *CNAMERecord:
+		rdata = &CNAMERecord{Target: canonicalName(rd.Target)}
+	case *PTRRecord:
+		rdata = &PTRRecord{Target: canonicalName(rd.Target)}
+	case *DNAMERecord:
+		rdata = &DNAMERecord{Target: canonicalName(rd.Target)}
+	case *MXRecord:
+		mx := *rd
+		mx.Exchange = canonicalName(rd.Exchange)
+		rdata = &mx
+	case *SRVRecord:
+		srv := *rd
+		srv.Target = canonicalName(rd.Target)
+		rdata = &srv
+	case *SOARecord:
+		soa := *rd
+		soa.MName, soa.RName = canonicalName(rd.MName), canonicalName(rd.RName)
+		rdata = &soa
+	case *RRSIGRecord:
+		rrsig := *rd
+		rrsig.SignerName = canonicalName(rd.SignerName)
+		rdata = &rrsig
+	}
+	var buff bytes.Buffer
+	if err := rdata.marshal(&buff, nil); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// verifySignature checks signature against data with the public key of key.
+func verifySignature(key *DNSKEYRecord, signature []byte, data []byte) error {
+	switch key.Algorithm {
+	case RSASHA256Algorithm:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("bad RSA signature")
+		}
+		return nil
+	case ECDSAP256SHA256Algorithm, ECDSAP384SHA384Algorithm:
+		curve, h := elliptic.P256(), sha256.New()
+		if key.Algorithm == ECDSAP384SHA384Algorithm {
+			curve, h = elliptic.P384(), sha512.New384()
+		}
+		// Public keys and signatures are the concatenations of x and y, and
+		// of r and s
+		// See [RFC6605 4]
+		// [RFC6605 4]: https://datatracker.ietf.org/doc/html/rfc6605#section-4
+		size := curve.Params().BitSize / 8
+		if len(key.PublicKey) != 2*size || len(signature) != 2*size {
+			return errors.New("bad ECDSA key or signature length")
+		}
+		x, y := new(big.Int).SetBytes(key.PublicKey[:size]), new(big.Int).SetBytes(key.PublicKey[size:])
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("bad ECDSA public key")
+		}
+		h.Write(data)
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, h.Sum(nil), r, s) {
+			return errors.New("bad ECDSA signature")
+		}
+		return nil
+	case ED25519Algorithm:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("bad Ed25519 key length")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, signature) {
+			return errors.New("bad Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %d: %w", key.Algorithm, ErrUnsupportedAlgorithm)
+}
+
+// rsaPublicKey decodes an RSA public key: the length of the exponent on one
+// byte, or on three bytes starting with zero, then the exponent and the
+// modulus.
+// See [RFC3110 2]
+// [RFC3110 2]: https://datatracker.ietf.org/doc/html/rfc3110#section-2
+func rsaPublicKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 1 {
+		return nil, errors.New("empty RSA key")
+	}
+	length, b := int(b[0]), b[1:]
+	if length == 0 {
+		if len(b) < 2 {
+			return nil, errors.New("truncated RSA key")
+		}
+		length, b = int(binary.BigEndian.Uint16(b)), b[2:]
+	}
+	if length == 0 || length > 4 || len(b) <= length {
+		return nil, errors.New("bad RSA key exponent")
+	}
+	exponent := new(big.Int).SetBytes(b[:length])
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[length:]), E: int(exponent.Int64())}, nil
+}
+
+// dsDigest returns the digest of the DNSKEY record of owner stored in DS
+// records.
+// See [RFC4034 5.1.4]
+// [RFC4034 5.1.4]: https://datatracker.ietf.org/doc/html/rfc4034#section-5.1.4
+func dsDigest(owner string, key *DNSKEYRecord, digestType uint8) ([]byte, error) {
+	var h hash.Hash
+	switch digestType {
+	case SHA1DigestType:
+		h = sha1.New()
+	case SHA256DigestType:
+		h = sha256.New()
+	case SHA384DigestType:
+		h = sha512.New384()
+	default:
+		return nil, fmt.Errorf("digest type %d: %w", digestType, ErrUnsupportedAlgorithm)
+	}
+	var buff bytes.Buffer
+	writeDomain(&buff, canonicalName(owner), nil)
+	key.marshal(&buff, nil)
+	h.Write(buff.Bytes())
+	return h.Sum(nil), nil
+}
+
+// matchesDS reports whether key is the DNSKEY record of owner ds refers to.
+func matchesDS(owner string, key *DNSKEYRecord, ds *DSRecord) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	digest, err := dsDigest(owner, key, ds.DigestType)
+	return err == nil && bytes.Equal(digest, ds.Digest)
+}
+
+// nsec3Hash returns the hash of name used as owner name of NSEC3 records.
+// See [RFC5155 5]
+// [RFC5155 5]: https://datatracker.ietf.org/doc/html/rfc5155#section-5
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	var buff bytes.Buffer
+	writeDomain(&buff, canonicalName(name), nil)
+	h := sha1.New()
+	h.Write(buff.Bytes())
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+// labelCount returns the number of labels of the canonical name, not counting
+// the leading label of wildcards as the Labels field of RRSIG records.
+// See [RFC4034 3.1.3]
+// [RFC4034 3.1.3]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.3
+func labelCount(name string) int {
+	if name == "" {
+		return 0
+	}
+	count := strings.Count(name, ".") + 1
+	if name == "*" || strings.HasPrefix(name, "*.") {
+		count--
+	}
+	return count
+}
+
+// compareNames orders canonical names as in NSEC chains: by their labels
+// compared right to left, a name sorting before its subdomains.
+// See [RFC4034 6.1]
+// [RFC4034 6.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-6.1
+func compareNames(a, b string) int {
+	var labelsA, labelsB []string
+	if a != "" {
+		labelsA = strings.Split(a, ".")
+	}
+	if b != "" {
+		labelsB = strings.Split(b, ".")
+	}
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(labelsA[i], labelsB[j]); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+// covers reports whether name sorts strictly between owner and next with
+// compare, next wrapping around to the start of the chain when it sorts
+// before owner.
+func covers(owner, next, name string, compare func(a, b string) int) bool {
+	if compare(owner, next) < 0 {
+		return compare(owner, name) < 0 && compare(name, next) < 0
+	}
+	// Last record of the chain
+	return compare(owner, name) < 0 || compare(name, next) < 0
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner signs records with a freshly generated key, which signs both
+// the keys and the records of its zone.
+type testSigner struct {
+	zone string
+	key  *DNSKEYRecord
+	sign func(data []byte) ([]byte, error)
+}
+
+func newTestSigner(t *testing.T, zone string, algorithm uint8) *testSigner {
+	t.Helper()
+	s := &testSigner{zone: canonicalName(zone)}
+	var public []byte
+	switch algorithm {
+	case RSASHA256Algorithm:
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate RSA key: %v", err)
+		}
+		exponent := big.NewInt(int64(private.E)).Bytes()
+		public = append([]byte{byte(len(exponent))}, exponent...)
+		public = append(public, private.N.Bytes()...)
+		s.sign = func(data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+			return rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		}
+	case ECDSAP256SHA256Algorithm, ECDSAP384SHA384Algorithm:
+		curve, hash := elliptic.P256(), func(data []byte) []byte { h := sha256.Sum256(data); return h[:] }
+		if algorithm == ECDSAP384SHA384Algorithm {
+			curve, hash = elliptic.P384(), func(data []byte) []byte { h := sha512.Sum384(data); return h[:] }
+		}
+		private, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate ECDSA key: %v", err)
+		}
+		size := curve.Params().BitSize / 8
+		public = append(private.X.FillBytes(make([]byte, size)), private.Y.FillBytes(make([]byte, size))...)
+		s.sign = func(data []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, private, hash(data))
+			if err != nil {
+				return nil, err
+			}
+			return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+		}
+	case ED25519Algorithm:
+		pub, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate Ed25519 key: %v", err)
+		}
+		public = pub
+		s.sign = func(data []byte) ([]byte, error) {
+			return ed25519.Sign(private, data), nil
+		}
+	default:
+		t.Fatalf("unsupported algorithm %d", algorithm)
+	}
+	s.key = &DNSKEYRecord{Flags: 257, Protocol: dnssecProtocol, Algorithm: algorithm, PublicKey: public}
+	return s
+}
+
+func (s *testSigner) dnskey() DNSAnswer {
+	return DNSAnswer{Name: s.zone, Type: DNSKEYRecordType, Class: INRecordClass, TTL: 3600, RData: s.key}
+}
+
+func (s *testSigner) ds(t *testing.T) DNSAnswer {
+	t.Helper()
+	digest, err := dsDigest(s.zone, s.key, SHA256DigestType)
+	if err != nil {
+		t.Fatalf("failed to compute DS digest: %v", err)
+	}
+	return DNSAnswer{
+		Name:  s.zone,
+		Type:  DSRecordType,
+		Class: INRecordClass,
+		TTL:   3600,
+		RData: &DSRecord{KeyTag: s.key.KeyTag(), Algorithm: s.key.Algorithm, DigestType: SHA256DigestType, Digest: digest},
+	}
+}
+
+// signRRSet returns the RRSIG record of rrset, valid for an hour around now.
+func (s *testSigner) signRRSet(t *testing.T, rrset []DNSAnswer) DNSAnswer {
+	t.Helper()
+	now := uint32(time.Now().Unix())
+	sig := &RRSIGRecord{
+		TypeCovered: rrset[0].Type,
+		Algorithm:   s.key.Algorithm,
+		Labels:      uint8(labelCount(canonicalName(rrset[0].Name))),
+		OriginalTTL: rrset[0].TTL,
+		Expiration:  now + 3600,
+		Inception:   now - 3600,
+		KeyTag:      s.key.KeyTag(),
+		SignerName:  s.zone,
+	}
+	data, err := signedData(rrset, sig)
+	if err != nil {
+		t.Fatalf("failed to encode %s: %v", rrset[0].Name, err)
+	}
+	if sig.Signature, err = s.sign(data); err != nil {
+		t.Fatalf("failed to sign %s: %v", rrset[0].Name, err)
+	}
+	return DNSAnswer{Name: rrset[0].Name, Type: RRSIGRecordType, Class: rrset[0].Class, TTL: rrset[0].TTL, RData: sig}
+}
+
+func TestVerifyRRSet(t *testing.T) {
+	rrset := []DNSAnswer{
+		{Name: "WWW.Example.com", Type: ARecordType, Class: INRecordClass, TTL: 300, RData: &ARecord{IP: net.IP{192, 0, 2, 1}}},
+		{Name: "WWW.Example.com", Type: ARecordType, Class: INRecordClass, TTL: 300, RData: &ARecord{IP: net.IP{192, 0, 2, 2}}},
+	}
+	tcs := []struct {
+		name      string
+		algorithm uint8
+	}{
+		{"RSA/SHA-256", RSASHA256Algorithm},
+		{"ECDSA P-256", ECDSAP256SHA256Algorithm},
+		{"ECDSA P-384", ECDSAP384SHA384Algorithm},
+		{"Ed25519", ED25519Algorithm},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			signer := newTestSigner(t, "example.com", tc.algorithm)
+			sig := signer.signRRSet(t, rrset).RData.(*RRSIGRecord)
+			keys := []*DNSKEYRecord{signer.key}
+			now := time.Now()
+
+			// The canonical form ignores the order, the case of the owner
+			// name and the TTL the records are received with
+			received := []DNSAnswer{rrset[1], rrset[0]}
+			received[0].Name, received[0].TTL, received[1].TTL = "www.example.com.", 120, 120
+			if _, err := verifyRRSet(received, []*RRSIGRecord{sig}, keys, "example.com", now); err != nil {
+				t.Errorf("expected the signature to verify but got %v", err)
+			}
+
+			tampered := []DNSAnswer{rrset[0], rrset[1]}
+			tampered[1].RData = &ARecord{IP: net.IP{192, 0, 2, 3}}
+			if _, err := verifyRRSet(tampered, []*RRSIGRecord{sig}, keys, "example.com", now); !errors.Is(err, ErrBogus) {
+				t.Errorf("expected %v for tampered records but got %v", ErrBogus, err)
+			}
+			if _, err := verifyRRSet(rrset, []*RRSIGRecord{sig}, keys, "example.com", now.Add(2*time.Hour)); !errors.Is(err, ErrBogus) {
+				t.Errorf("expected %v for an expired signature but got %v", ErrBogus, err)
+			}
+			if _, err := verifyRRSet(rrset, []*RRSIGRecord{sig}, keys, "com", now); !errors.Is(err, ErrBogus) {
+				t.Errorf("expected %v for a signature of another zone but got %v", ErrBogus, err)
+			}
+			if _, err := verifyRRSet(rrset, nil, keys, "example.com", now); !errors.Is(err, ErrBogus) {
+				t.Errorf("expected %v for unsigned records but got %v", ErrBogus, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRRSet_Wildcard(t *testing.T) {
+	signer := newTestSigner(t, "example.com", ED25519Algorithm)
+	wildcard := []DNSAnswer{{Name: "*.example.com", Type: TXTRecordType, Class: INRecordClass, TTL: 300, RData: &TXTRecord{Texts: []string{"wild"}}}}
+	sig := signer.signRRSet(t, wildcard).RData.(*RRSIGRecord)
+	if sig.Labels != 2 {
+		t.Fatalf("expected 2 labels but got %d", sig.Labels)
+	}
+
+	expanded := []DNSAnswer{wildcard[0]}
+	expanded[0].Name = "a.b.example.com"
+	if _, err := verifyRRSet(expanded, []*RRSIGRecord{sig}, []*DNSKEYRecord{signer.key}, "example.com", time.Now()); err != nil {
+		t.Errorf("expected the expansion to verify but got %v", err)
+	}
+}
+
+func TestVerifyRRSet_UnsupportedAlgorithm(t *testing.T) {
+	signer := newTestSigner(t, "example.com", ED25519Algorithm)
+	rrset := []DNSAnswer{{Name: "example.com", Type: ARecordType, Class: INRecordClass, TTL: 300, RData: &ARecord{IP: net.IP{192, 0, 2, 1}}}}
+	sig := signer.signRRSet(t, rrset).RData.(*RRSIGRecord)
+	key := *signer.key
+	key.Algorithm = 5
+	sig.Algorithm, sig.KeyTag = 5, key.KeyTag()
+	_, err := verifyRRSet(rrset, []*RRSIGRecord{sig}, []*DNSKEYRecord{&key}, "example.com", time.Now())
+	if !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("expected %v but got %v", ErrUnsupportedAlgorithm, err)
+	}
+}
+
+// See [RFC4034 5.4]
+// [RFC4034 5.4]: https://datatracker.ietf.org/doc/html/rfc4034#section-5.4
+func TestDSDigest(t *testing.T) {
+	public, _ := base64.StdEncoding.DecodeString(
+		"AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvx" +
+			"egXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==",
+	)
+	key := &DNSKEYRecord{Flags: 256, Protocol: 3, Algorithm: 5, PublicKey: public}
+	if tag := key.KeyTag(); tag != 60485 {
+		t.Errorf("expected key tag 60485 but got %d", tag)
+	}
+
+	tcs := []struct {
+		digestType uint8
+		expected   string
+	}{
+		{SHA1DigestType, "2bb183af5f22588179a53b0a98631fad1a292118"},
+		{SHA256DigestType, "d4b7d520e7bb5f0f67674a0cceb1e3e0614b93c4f9e99b8383f6a1e4469da50a"},
+	}
+	for _, tc := range tcs {
+		digest, err := dsDigest("DSKEY.example.com.", key, tc.digestType)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := hex.EncodeToString(digest); got != tc.expected {
+			t.Errorf("expected digest %s but got %s", tc.expected, got)
+		}
+		ds := &DSRecord{KeyTag: 60485, Algorithm: 5, DigestType: tc.digestType, Digest: digest}
+		if !matchesDS("dskey.example.com", key, ds) {
+			t.Errorf("expected the key to match its DS record")
+		}
+	}
+	if _, err := dsDigest("dskey.example.com", key, 3); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("expected %v but got %v", ErrUnsupportedAlgorithm, err)
+	}
+}
+
+func TestRSAPublicKey(t *testing.T) {
+	// Exponents longer than 255 bytes are preceded by a zero and two bytes
+	long := []byte{0, 0, 3, 1, 0, 1, 0xC5, 0x01}
+	tcs := []struct {
+		name     string
+		key      []byte
+		expected int
+		wantErr  bool
+	}{
+		{"short exponent", []byte{3, 1, 0, 1, 0xC5, 0x01}, 65537, false},
+		{"long exponent form", long, 65537, false},
+		{"empty", nil, 0, true},
+		{"no modulus", []byte{3, 1, 0, 1}, 0, true},
+		{"zero length", []byte{0, 0, 0, 1}, 0, true},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := rsaPublicKey(tc.key)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if key.E != tc.expected || key.N.Int64() != 0xC501 {
+				t.Errorf("expected exponent %d and modulus 50433 but got %d and %d", tc.expected, key.E, key.N)
+			}
+		})
+	}
+}
+
+// See [RFC5155 Appendix A]
+// [RFC5155 Appendix A]: https://datatracker.ietf.org/doc/html/rfc5155#appendix-A
+func TestNSEC3Hash(t *testing.T) {
+	salt := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+	tcs := []struct {
+		name     string
+		expected string
+	}{
+		{"example", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+		{"a.example", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+		{"ns1.example", "2t7b4g4vsa5smi47k61mv5bv1a22bojr"},
+		{"w.example", "k8udemvp1j2f7eg6jebps17vp3n8i58h"},
+		{"*.w.example", "r53bq7cc2uvmubfu5ocmm6pers9tk9en"},
+		{"X.W.Example.", "b4um86eghhds6nea196smvmlo4ors995"},
+	}
+	for _, tc := range tcs {
+		got := strings.ToLower(nsec3Encoding.EncodeToString(nsec3Hash(tc.name, salt, 12)))
+		if got != tc.expected {
+			t.Errorf("expected hash %s of %s but got %s", tc.expected, tc.name, got)
+		}
+	}
+}
+
+// See [RFC4034 6.1]
+// [RFC4034 6.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-6.1
+func TestCompareNames(t *testing.T) {
+	ordered := []string{
+		"",
+		"example",
+		"a.example",
+		"yljkjljk.a.example",
+		"z.a.example",
+		"zabc.a.example",
+		"z.example",
+		"\x01.z.example",
+		"*.z.example",
+		"\x80.z.example",
+	}
+	shuffled := []string{ordered[6], ordered[9], ordered[0], ordered[3], ordered[8], ordered[1], ordered[5], ordered[2], ordered[7], ordered[4]}
+	sort.Slice(shuffled, func(i, j int) bool { return compareNames(shuffled[i], shuffled[j]) < 0 })
+	for i := range ordered {
+		if shuffled[i] != ordered[i] {
+			t.Fatalf("expected order %q but got %q", ordered, shuffled)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tcs := []struct {
+		owner, next, name string
+		expected          bool
+	}{
+		{"a.example", "d.example", "b.example", true},
+		{"a.example", "d.example", "a.example", false},
+		{"a.example", "d.example", "d.example", false},
+		{"a.example", "d.example", "x.a.example", true},
+		{"a.example", "d.example", "e.example", false},
+		// The last record of the chain points back to the apex
+		{"z.example", "example", "zz.example", true},
+		{"z.example", "example", "b.example", false},
+		// A single record covers every other name
+		{"example", "example", "a.example", true},
+	}
+	for _, tc := range tcs {
+		if got := covers(tc.owner, tc.next, tc.name, compareNames); got != tc.expected {
+			t.Errorf("expected covers(%s, %s, %s) to be %t but got %t", tc.owner, tc.next, tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	tcs := []struct {
+		name     string
+		expected int
+	}{
+		{"", 0},
+		{"com", 1},
+		{"www.example.com", 3},
+		{"*.example.com", 2},
+		{"*", 0},
+	}
+	for _, tc := range tcs {
+		if got := labelCount(tc.name); got != tc.expected {
+			t.Errorf("expected %d labels in %q but got %d", tc.expected, tc.name, got)
+		}
+	}
+}
+
+func TestCanonicalRData(t *testing.T) {
+	tcs := []struct {
+		name     string
+		rr       DNSAnswer
+		expected []byte
+	}{
+		{
+			name:     "lowercased names",
+			rr:       DNSAnswer{Type: MXRecordType, RData: &MXRecord{Preference: 10, Exchange: "Mail.Example.COM."}},
+			expected: append([]byte{0, 10}, wireName("mail.example.com")...),
+		},
+		{
+			name:     "names of recent types are kept",
+			rr:       DNSAnswer{Type: NSECRecordType, RData: &NSECRecord{NextDomain: "B.example", Types: []uint16{ARecordType}}},
+			expected: append(wireName("B.example"), 0, 1, 0x40),
+		},
+		{
+			name:     "unknown type",
+			rr:       DNSAnswer{Type: 65280, Data: []byte{1, 2, 3}},
+			expected: []byte{1, 2, 3},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := canonicalRData(tc.rr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hex.EncodeToString(got) != hex.EncodeToString(tc.expected) {
+				t.Errorf("expected %x but got %x", tc.expected, got)
+			}
+		})
+	}
+}
+
+// wireName returns the uncompressed wire format of name.
+func wireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
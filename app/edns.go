@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// minUDPSize is the payload size every client must accept.
+	// See [RFC1035 4.2.1]
+	// [RFC1035 4.2.1]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
+	minUDPSize = 512
+	// maxUDPSize is the payload size this server advertises and accepts.
+	maxUDPSize = 4096
+
+	doFlag = 1 << 15
+)
+
+// ErrBadEDNS is returned when a message holds an invalid OPT pseudo-record.
+var ErrBadEDNS = errors.New("bad OPT pseudo-record")
+
+// EDNS holds the EDNS(0) parameters carried by the OPT pseudo-record in the
+// additional section of a message.
+// See [RFC6891 6.1]
+//
+// [RFC6891 6.1]: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1
+type EDNS struct {
+	// UDPSize is the largest UDP payload the sender can reassemble.
+	UDPSize uint16
+	// ExtendedRCODE holds the upper 8 bits of the 12 bits RCODE.
+	ExtendedRCODE uint8
+	Version       uint8
+	// DO is set when the sender can handle DNSSEC records.
+	DO      bool
+	Options []EDNSOption
+}
+
+// EDNSOption is an option of the OPT pseudo-record RDATA.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// record encodes the EDNS parameters as an OPT pseudo-record.
+func (e *EDNS) record() DNSAnswer {
+	var buff bytes.Buffer
+	for _, opt := range e.Options {
+		binary.Write(&buff, binary.BigEndian, opt.Code)
+		binary.Write(&buff, binary.BigEndian, uint16(len(opt.Data)))
+		buff.Write(opt.Data)
+	}
+	ttl := uint32(e.ExtendedRCODE)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= doFlag
+	}
+
+	return DNSAnswer{
+		Name:  "",
+		Type:  OPTRecordType,
+		Class: e.UDPSize,
+		TTL:   ttl,
+		Data:  buff.Bytes()[:buff.Len()],
+	}
+}
+
+// ednsFromRecord decodes the EDNS parameters of an OPT pseudo-record.
+func ednsFromRecord(a DNSAnswer) (*EDNS, error) {
+	if a.Name != "" {
+		return nil, fmt.Errorf("%w: owner name must be root got %q", ErrBadEDNS, a.Name)
+	}
+	e := &EDNS{
+		UDPSize:       a.Class,
+		ExtendedRCODE: uint8(a.TTL >> 24),
+		Version:       uint8(a.TTL >> 16),
+		DO:            a.TTL&doFlag != 0,
+	}
+	r := bytes.NewReader(a.Data)
+	for r.Len() > 0 {
+		var opt EDNSOption
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &opt.Code); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadEDNS, err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadEDNS, err)
+		}
+		opt.Data = make([]byte, length)
+		if _, err := io.ReadFull(r, opt.Data); err != nil {
+			return nil, fmt.Errorf("%w: option %d: %v", ErrBadEDNS, opt.Code, err)
+		}
+		e.Options = append(e.Options, opt)
+	}
+
+	return e, nil
+}
+
+// extractEDNS removes the OPT pseudo-record from the additional section and
+// stores its parameters in msg.EDNS. A message can hold at most one OPT.
+func (msg *DNSMessage) extractEDNS() error {
+	additionals := msg.Additionals[:0]
+	for _, a := range msg.Additionals {
+		if a.Type != OPTRecordType {
+			additionals = append(additionals, a)
+			continue
+		}
+		if msg.EDNS != nil {
+			return fmt.Errorf("%w: more than one OPT record", ErrBadEDNS)
+		}
+		e, err := ednsFromRecord(a)
+		if err != nil {
+			return err
+		}
+		msg.EDNS = e
+	}
+	msg.Additionals = additionals
+
+	return nil
+}
+
+// SetEDNS attaches an OPT pseudo-record to the message, replacing any
+// existing one. ARCOUNT accounts for the OPT record like AddAdditionals does.
+func (msg *DNSMessage) SetEDNS(e *EDNS) {
+	if msg.EDNS == nil && e != nil {
+		msg.Header.ARCOUNT++
+	}
+	if msg.EDNS != nil && e == nil {
+		msg.Header.ARCOUNT--
+	}
+	msg.EDNS = e
+}
+
+// MaxUDPSize returns the largest UDP payload the sender of msg accepts.
+func (msg *DNSMessage) MaxUDPSize() int {
+	if msg.EDNS == nil || msg.EDNS.UDPSize < minUDPSize {
+		return minUDPSize
+	}
+	return int(msg.EDNS.UDPSize)
+}
+
+// SetRCODE sets the response code of the message. Extended codes larger than
+// 4 bits store their upper bits in the OPT record, which must be set.
+func (msg *DNSMessage) SetRCODE(rcode uint16) {
+	msg.Header.Flags.RCODE = rcode & 0x000F
+	if msg.EDNS != nil {
+		msg.EDNS.ExtendedRCODE = uint8(rcode >> 4)
+	}
+}
+
+// RCODE returns the full response code of the message, including the upper
+// bits stored in the OPT record.
+func (msg *DNSMessage) RCODE() uint16 {
+	if msg.EDNS == nil {
+		return msg.Header.Flags.RCODE
+	}
+	return uint16(msg.EDNS.ExtendedRCODE)<<4 | msg.Header.Flags.RCODE
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEDNS_RoundTrip(t *testing.T) {
+	msg := DNSMessage{}
+	msg.AddQuestions(DNSQuestion{Name: "google.com", Type: ARecordType, Class: INRecordClass})
+	msg.AddAdditionals(DNSAnswer{
+		Name: "ns.google.com", Type: ARecordType, Class: INRecordClass, TTL: 60,
+		RData: &ARecord{IP: []byte{8, 8, 8, 8}},
+		Data:  []byte{8, 8, 8, 8},
+	})
+	msg.SetEDNS(&EDNS{
+		UDPSize: 1232,
+		Version: 0,
+		DO:      true,
+		Options: []EDNSOption{
+			{Code: 10, Data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}},
+		},
+	})
+	msg.SetRCODE(BadVersionResponseCode)
+
+	if msg.Header.ARCOUNT != 2 {
+		t.Fatalf("expected ARCOUNT to account for the OPT record but got %d", msg.Header.ARCOUNT)
+	}
+	buf, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	var result DNSMessage
+	if err := result.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("failed to unmarshal message: %v", err)
+	}
+	if !cmp.Equal(msg.Additionals, result.Additionals) {
+		t.Errorf("additionals do not match: %s", cmp.Diff(msg.Additionals, result.Additionals))
+	}
+	if !cmp.Equal(msg.EDNS, result.EDNS) {
+		t.Errorf("edns does not match: %s", cmp.Diff(msg.EDNS, result.EDNS))
+	}
+	if result.Header.ARCOUNT != 2 {
+		t.Errorf("expected ARCOUNT 2 but got %d", result.Header.ARCOUNT)
+	}
+	if result.RCODE() != BadVersionResponseCode {
+		t.Errorf("expected extended RCODE %d but got %d", BadVersionResponseCode, result.RCODE())
+	}
+	if result.MaxUDPSize() != 1232 {
+		t.Errorf("expected max UDP size 1232 but got %d", result.MaxUDPSize())
+	}
+}
+
+func TestEDNS_UnmarshalBinary(t *testing.T) {
+	header := []byte{0x04, 0xD2, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02}
+	opt := []byte{
+		0x00,       // Root domain
+		0x00, 0x29, // TYPE = OPT
+		0x10, 0x00, // CLASS = UDP payload size 4096
+		0x00, 0x00, 0x80, 0x00, // TTL = DO bit
+		0x00, 0x00, // RDLENGTH = 0
+	}
+
+	tcs := []struct {
+		name         string
+		buf          []byte
+		expectedEDNS *EDNS
+		expectedErr  error
+	}{
+		{
+			name:         "single OPT record",
+			buf:          append(append(append([]byte{}, header[:11]...), 0x01), opt...),
+			expectedEDNS: &EDNS{UDPSize: 4096, DO: true},
+		},
+		{
+			name:        "more than one OPT record",
+			buf:         append(append(append([]byte{}, header...), opt...), opt...),
+			expectedErr: ErrBadEDNS,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var msg DNSMessage
+			err := msg.UnmarshalBinary(tc.buf)
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected error %v but got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(msg.Additionals) != 0 {
+				t.Errorf("expected OPT record to be removed from additionals but got %+v", msg.Additionals)
+			}
+			if !cmp.Equal(tc.expectedEDNS, msg.EDNS) {
+				t.Errorf("edns does not match: %s", cmp.Diff(tc.expectedEDNS, msg.EDNS))
+			}
+		})
+	}
+}
+
+func TestDNSMessage_MaxUDPSize(t *testing.T) {
+	tcs := []struct {
+		name     string
+		edns     *EDNS
+		expected int
+	}{
+		{name: "without EDNS", edns: nil, expected: 512},
+		{name: "advertised size below minimum", edns: &EDNS{UDPSize: 100}, expected: 512},
+		{name: "advertised size", edns: &EDNS{UDPSize: 1232}, expected: 1232},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			msg := DNSMessage{EDNS: tc.edns}
+			if msg.MaxUDPSize() != tc.expected {
+				t.Errorf("expected %d but got %d", tc.expected, msg.MaxUDPSize())
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadGracePeriod is how long the upstreams of replaced forwarding rules
+// are kept open so that in-flight requests can complete.
+const reloadGracePeriod = 10 * time.Second
+
+// forwardRule sends the questions for names under suffix to upstreams.
+type forwardRule struct {
+	suffix string
+	// subdomainsOnly is set by "*." rules, which don't match suffix itself.
+	subdomainsOnly bool
+	upstreams      []string
+}
+
+// matches reports whether name, lowercased and without trailing dot, falls
+// under the rule.
+func (rule *forwardRule) matches(name string) bool {
+	if rule.suffix == "" {
+		return name != "" || !rule.subdomainsOnly
+	}
+	if name == rule.suffix {
+		return !rule.subdomainsOnly
+	}
+	return strings.HasSuffix(name, "."+rule.suffix)
+}
+
+// parseForwardRules reads forwarding rules, one per line, made of a domain
+// suffix followed by the comma separated upstreams to send matching questions
+// to, for example:
+//
+//	# corp.internal and all its subdomains
+//	corp.internal 10.0.0.53:53
+//	# subdomains of consul only
+//	*.consul      127.0.0.1:8600/500ms
+//
+// Upstreams use the same syntax as the -resolver flag. Empty lines and lines
+// starting with # are ignored.
+func parseForwardRules(r io.Reader) ([]forwardRule, error) {
+	var rules []forwardRule
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a domain and its upstreams but got %q", line, text)
+		}
+
+		rule := forwardRule{upstreams: strings.Split(fields[1], ",")}
+		domain := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if seen[domain] {
+			return nil, fmt.Errorf("line %d: duplicate rule for %s", line, fields[0])
+		}
+		seen[domain] = true
+		if strings.HasPrefix(domain, "*.") || domain == "*" {
+			rule.subdomainsOnly = true
+			domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*"), ".")
+		}
+		rule.suffix = domain
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read forwarding rules: %v", err)
+	}
+	return rules, nil
+}
+
+// forwardRoute is a forwarding rule along with the pool serving it.
+type forwardRoute struct {
+	rule     forwardRule
+	upstream *ResolverPool
+}
+
+// ForwardingResolver sends each request to the upstreams of the forwarding
+// rule with the longest suffix matching its question, falling back to a
+// default upstream. Rules are read from a file and can be reloaded at any
+// time.
+type ForwardingResolver struct {
+	fallback Upstream
+	path     string
+	strategy string
+	timeout  time.Duration
+	key      *TSIGKey
+
+	mu     sync.RWMutex
+	routes []forwardRoute
+}
+
+// NewForwardingResolver loads the forwarding rules in path. Upstreams of
+// the rules are pooled with strategy and use timeout unless they set their
+// own. Their requests are signed with key when it is not nil.
+func NewForwardingResolver(
+	fallback Upstream,
+	path string,
+	strategy string,
+	timeout time.Duration,
+	key *TSIGKey,
+) (*ForwardingResolver, error) {
+	r := &ForwardingResolver{
+		fallback: fallback,
+		path:     path,
+		strategy: strategy,
+		timeout:  timeout,
+		key:      key,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the forwarding rules again and swaps them in. The current
+// rules are kept when the file is invalid.
+func (r *ForwardingResolver) Reload() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to open forwarding rules: %v", err)
+	}
+	defer f.Close()
+	rules, err := parseForwardRules(f)
+	if err != nil {
+		return fmt.Errorf("failed to parse forwarding rules %s: %v", r.path, err)
+	}
+
+	routes := make([]forwardRoute, 0, len(rules))
+	for _, rule := range rules {
+		pool, err := NewResolverPool(rule.upstreams, r.strategy, r.timeout)
+		if err != nil {
+			closeRoutes(routes)
+			return fmt.Errorf("failed to create upstreams for %s: %v", rule.suffix, err)
+		}
+		pool.SetTSIGKey(r.key)
+		routes = append(routes, forwardRoute{rule: rule, upstream: pool})
+	}
+
+	r.mu.Lock()
+	old := r.routes
+	r.routes = routes
+	r.mu.Unlock()
+
+	time.AfterFunc(reloadGracePeriod, func() { closeRoutes(old) })
+	log.Printf("loaded %d forwarding rules from %s", len(routes), r.path)
+	return nil
+}
+
+func closeRoutes(routes []forwardRoute) {
+	for _, route := range routes {
+		route.upstream.Close()
+	}
+}
+
+func (r *ForwardingResolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	closeRoutes(r.routes)
+	r.routes = nil
+	return nil
+}
+
+func (r *ForwardingResolver) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	if len(msg.Questions) == 0 {
+		return r.fallback.SendRequest(msg)
+	}
+	return r.route(msg.Questions[0].Name).SendRequest(msg)
+}
+
+// route returns the upstream responsible for name, the one of the matching
+// rule with the longest suffix. A rule for a domain wins over the "*." rule
+// of the same domain.
+func (r *ForwardingResolver) route(name string) Upstream {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var best *forwardRoute
+	for i := range r.routes {
+		route := &r.routes[i]
+		if !route.rule.matches(name) {
+			continue
+		}
+		switch {
+		case best == nil || len(route.rule.suffix) > len(best.rule.suffix):
+			best = route
+		case len(route.rule.suffix) == len(best.rule.suffix) && best.rule.subdomainsOnly && !route.rule.subdomainsOnly:
+			best = route
+		}
+	}
+	if best == nil {
+		return r.fallback
+	}
+	return best.upstream
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseForwardRules(t *testing.T) {
+	tcs := []struct {
+		name        string
+		input       string
+		expected    []forwardRule
+		expectedErr bool
+	}{
+		{
+			name: "rules and comments",
+			input: "# internal zones\n" +
+				"corp.internal 10.0.0.53:53\n" +
+				"\n" +
+				"*.Consul. 127.0.0.1:8600/500ms,127.0.0.2:8600\n",
+			expected: []forwardRule{
+				{suffix: "corp.internal", upstreams: []string{"10.0.0.53:53"}},
+				{suffix: "consul", subdomainsOnly: true, upstreams: []string{"127.0.0.1:8600/500ms", "127.0.0.2:8600"}},
+			},
+		},
+		{name: "missing upstream", input: "corp.internal\n", expectedErr: true},
+		{name: "duplicate rule", input: "corp.internal 10.0.0.1:53\ncorp.internal. 10.0.0.2:53\n", expectedErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseForwardRules(strings.NewReader(tc.input))
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !cmp.Equal(tc.expected, rules, cmp.AllowUnexported(forwardRule{})) {
+				t.Errorf("rules do not match: %s", cmp.Diff(tc.expected, rules, cmp.AllowUnexported(forwardRule{})))
+			}
+		})
+	}
+}
+
+// writeForwardRules writes rules to path, or to a new temporary file when
+// path is empty, and returns the path written to.
+func writeForwardRules(t *testing.T, path string, rules string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "forward.rules")
+	}
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("failed to write forwarding rules: %v", err)
+	}
+	return path
+}
+
+// ipServer starts a fake server answering every A question with ip.
+func ipServer(t *testing.T, ip net.IP) string {
+	return startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		return []*DNSMessage{answerA(req, ip)}
+	})
+}
+
+// answerIP returns the address of the first A record of resp.
+func answerIP(resp *DNSMessage) net.IP {
+	if len(resp.Answers) == 0 {
+		return nil
+	}
+	if a, ok := resp.Answers[0].RData.(*ARecord); ok {
+		return a.IP
+	}
+	return nil
+}
+
+func TestForwardingResolver_RoutesByLongestSuffix(t *testing.T) {
+	corp := ipServer(t, net.IP{10, 0, 0, 1})
+	dev := ipServer(t, net.IP{10, 0, 0, 2})
+	consul := ipServer(t, net.IP{10, 0, 0, 3})
+	fallback := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+		return answerA(msg, net.IP{10, 0, 0, 4}), nil
+	})
+
+	path := writeForwardRules(t, "", fmt.Sprintf(
+		"corp.internal %s\ndev.corp.internal %s\n*.consul %s\n", corp, dev, consul,
+	))
+	forwarder, err := NewForwardingResolver(fallback, path, SequentialStrategy, time.Second, nil)
+	if err != nil {
+		t.Fatalf("failed to create forwarding resolver: %v", err)
+	}
+	defer forwarder.Close()
+
+	tcs := []struct {
+		name     string
+		expected net.IP
+	}{
+		{name: "corp.internal", expected: net.IP{10, 0, 0, 1}},
+		{name: "www.CORP.internal", expected: net.IP{10, 0, 0, 1}},
+		{name: "api.dev.corp.internal", expected: net.IP{10, 0, 0, 2}},
+		{name: "web.service.consul", expected: net.IP{10, 0, 0, 3}},
+		{name: "consul", expected: net.IP{10, 0, 0, 4}},
+		{name: "notcorp.internal", expected: net.IP{10, 0, 0, 4}},
+		{name: "example.com", expected: net.IP{10, 0, 0, 4}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := forwarder.SendRequest(newQuery(tc.name, ARecordType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(resp.Answers) != 1 {
+				t.Fatalf("expected one answer but got %+v", resp.Answers)
+			}
+			if ip := answerIP(resp); !ip.Equal(tc.expected) {
+				t.Errorf("expected answer %v but got %v", tc.expected, ip)
+			}
+		})
+	}
+}
+
+func TestForwardingResolver_DomainRuleWinsOverWildcard(t *testing.T) {
+	domain := ipServer(t, net.IP{10, 0, 0, 1})
+	wildcard := ipServer(t, net.IP{10, 0, 0, 2})
+	fallback := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+		return nil, fmt.Errorf("unexpected request to the default upstream")
+	})
+
+	tcs := []struct {
+		name  string
+		rules string
+	}{
+		{name: "wildcard rule first", rules: fmt.Sprintf("*.corp.internal %s\ncorp.internal %s\n", wildcard, domain)},
+		{name: "domain rule first", rules: fmt.Sprintf("corp.internal %s\n*.corp.internal %s\n", domain, wildcard)},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeForwardRules(t, "", tc.rules)
+			forwarder, err := NewForwardingResolver(fallback, path, SequentialStrategy, time.Second, nil)
+			if err != nil {
+				t.Fatalf("failed to create forwarding resolver: %v", err)
+			}
+			defer forwarder.Close()
+
+			for _, name := range []string{"corp.internal", "www.corp.internal"} {
+				resp, err := forwarder.SendRequest(newQuery(name, ARecordType))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if ip := answerIP(resp); !ip.Equal(net.IP{10, 0, 0, 1}) {
+					t.Errorf("expected %s to be answered by the domain rule but got %v", name, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardingResolver_Reload(t *testing.T) {
+	first := ipServer(t, net.IP{10, 0, 0, 1})
+	second := ipServer(t, net.IP{10, 0, 0, 2})
+	fallback := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+		return nil, fmt.Errorf("unexpected request to the default upstream")
+	})
+
+	path := writeForwardRules(t, "", "corp.internal "+first+"\n")
+	forwarder, err := NewForwardingResolver(fallback, path, SequentialStrategy, time.Second, nil)
+	if err != nil {
+		t.Fatalf("failed to create forwarding resolver: %v", err)
+	}
+	defer forwarder.Close()
+
+	answer := func() net.IP {
+		resp, err := forwarder.SendRequest(newQuery("www.corp.internal", ARecordType))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return answerIP(resp)
+	}
+	if ip := answer(); !ip.Equal(net.IP{10, 0, 0, 1}) {
+		t.Fatalf("expected answer from first upstream but got %v", ip)
+	}
+
+	writeForwardRules(t, path, "corp.internal "+second+"\n")
+	if err := forwarder.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if ip := answer(); !ip.Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("expected answer from second upstream after reload but got %v", ip)
+	}
+
+	writeForwardRules(t, path, "corp.internal\n")
+	if err := forwarder.Reload(); err == nil {
+		t.Fatalf("expected reload of an invalid file to fail")
+	}
+	if ip := answer(); !ip.Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("expected rules to be kept after a failed reload but got answer %v", ip)
+	}
+}
+
+func TestForwardingResolver_TSIG(t *testing.T) {
+	keys := testKeys(t)
+	received := make(chan string, 1)
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		var name string
+		if rr := req.TSIG(); rr != nil {
+			name = rr.Name
+		}
+		received <- name
+		return []*DNSMessage{CreateResponse(req)}
+	})
+	fallback := upstreamFunc(func(msg *DNSMessage) (*DNSMessage, error) {
+		return nil, fmt.Errorf("unexpected request to the default upstream")
+	})
+
+	path := writeForwardRules(t, "", "corp.internal "+addr+"/100ms\n")
+	forwarder, err := NewForwardingResolver(fallback, path, SequentialStrategy, time.Second, keys["update-key"])
+	if err != nil {
+		t.Fatalf("failed to create forwarding resolver: %v", err)
+	}
+	defer forwarder.Close()
+
+	// The unsigned response of the fake server is dropped
+	forwarder.SendRequest(newQuery("www.corp.internal", ARecordType))
+	if name := <-received; name != "update-key" {
+		t.Errorf("expected the request to be signed with update-key but got %q", name)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+)
+
+// Lookup answers q from the records of the zone following the algorithm of
+// [RFC1034 4.3.2]:
+//   - names below a zone cut get a referral to the delegated zone, with its
+//     NS records in the authority section and their addresses as glue,
+//     except for the DS records of the cut, which belong to the parent zone,
+//     see [RFC4035 3.1.4.1];
+//   - names below a DNAME get a CNAME synthesized from it, see [RFC6672 3.3];
+//   - CNAME records, including synthesized ones, are followed while their
+//     target is in the zone;
+//   - names without records are answered from the closest wildcard, see
+//     [RFC4592 3.3.1];
+//   - names without records of the requested type, including empty
+//     non-terminals, get an empty answer and names that don't exist get
+//     NXDOMAIN, both with the SOA record in the authority section.
+//
+// [RFC1034 4.3.2]: https://datatracker.ietf.org/doc/html/rfc1034#section-4.3.2
+// [RFC4035 3.1.4.1]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.1.4.1
+// [RFC6672 3.3]: https://datatracker.ietf.org/doc/html/rfc6672#section-3.3
+// [RFC4592 3.3.1]: https://datatracker.ietf.org/doc/html/rfc4592#section-3.3.1
+func (z *Zone) Lookup(q DNSQuestion) *DNSMessage {
+	resp := &DNSMessage{}
+	resp.Header.Flags.AA = true
+
+	owner := strings.TrimSuffix(q.Name, ".")
+	for aliases := 0; aliases <= maxCNAMEChain; aliases++ {
+		name := canonicalName(owner)
+
+		ns, dname := z.cut(name, q.Type)
+		if ns != nil {
+			// Only the aliases leading to the referral are authoritative
+			resp.Header.Flags.AA = len(resp.Answers) > 0
+			resp.AddAuthorities(ns...)
+			z.addAddresses(resp, ns)
+			return resp
+		}
+		if dname != nil {
+			resp.AddAnswers(*dname)
+			// Transferred records may lack data the server couldn't decode
+			rdata, ok := dname.RData.(*DNAMERecord)
+			if !ok {
+				return resp
+			}
+			synthesized := owner[:len(owner)-len(dname.Name)] + rdata.Target
+			if len(synthesized)+2 > maxNameLength {
+				resp.Header.Flags.RCODE = YXDomainResponseCode
+				return resp
+			}
+			resp.AddAnswers(DNSAnswer{
+				Name:  owner,
+				Type:  CNAMERecordType,
+				Class: dname.Class,
+				TTL:   dname.TTL,
+				RData: &CNAMERecord{Target: synthesized},
+			})
+			if !inZone(canonicalName(synthesized), z.Origin) {
+				return resp
+			}
+			owner = synthesized
+			continue
+		}
+
+		records, exists := z.node(name, owner)
+		if !exists {
+			resp.Header.Flags.RCODE = NameErrorResponseCode
+			resp.AddAuthorities(z.negativeSOA())
+			return resp
+		}
+		var answers []DNSAnswer
+		var cname *DNSAnswer
+		for i, rr := range records {
+			if rr.Type == q.Type || q.Type == ANYRecordType {
+				answers = append(answers, rr)
+			} else if rr.Type == CNAMERecordType {
+				cname = &records[i]
+			}
+		}
+		if len(answers) > 0 {
+			resp.AddAnswers(answers...)
+			z.addAddresses(resp, answers)
+			return resp
+		}
+		if cname == nil {
+			resp.AddAuthorities(z.negativeSOA())
+			return resp
+		}
+		resp.AddAnswers(*cname)
+		rdata, ok := cname.RData.(*CNAMERecord)
+		if !ok || !inZone(canonicalName(rdata.Target), z.Origin) {
+			return resp
+		}
+		owner = rdata.Target
+	}
+
+	return resp
+}
+
+// cut returns the NS records of the zone cut above or at name, or the DNAME
+// record above name, whichever is closest to the origin. The zone cut at name
+// is ignored for DS records, which are answered from the parent side.
+func (z *Zone) cut(name string, rrType uint16) ([]DNSAnswer, *DNSAnswer) {
+	// Walk down from the origin to name
+	var ancestors []string
+	for n := name; n != z.Origin; n = parentName(n) {
+		ancestors = append(ancestors, n)
+	}
+	ancestors = append(ancestors, z.Origin)
+
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		n := ancestors[i]
+		var ns []DNSAnswer
+		for j, rr := range z.nodes[n] {
+			switch {
+			case rr.Type == DNAMERecordType && n != name:
+				return nil, &z.nodes[n][j]
+			case rr.Type == NSRecordType && n != z.Origin && (n != name || rrType != DSRecordType):
+				ns = append(ns, rr)
+			}
+		}
+		if ns != nil {
+			return ns, nil
+		}
+	}
+	return nil, nil
+}
+
+// node returns the records of name, which are synthesized from the closest
+// wildcard with owner as owner name when name has no records. It reports
+// whether name exists, which is the case of empty non-terminals.
+func (z *Zone) node(name, owner string) ([]DNSAnswer, bool) {
+	if records, ok := z.nodes[name]; ok {
+		return records, true
+	}
+	if z.nonTerminals[name] {
+		return nil, true
+	}
+
+	// The wildcard must be a child of the closest encloser, the closest
+	// existing ancestor of name
+	encloser := parentName(name)
+	for encloser != z.Origin {
+		if _, ok := z.nodes[encloser]; ok || z.nonTerminals[encloser] {
+			break
+		}
+		encloser = parentName(encloser)
+	}
+	wildcard := "*"
+	if encloser != "" {
+		wildcard += "." + encloser
+	}
+	records, ok := z.nodes[wildcard]
+	if !ok {
+		return nil, false
+	}
+	synthesized := make([]DNSAnswer, len(records))
+	for i, rr := range records {
+		rr.Name = owner
+		synthesized[i] = rr
+	}
+	return synthesized, true
+}
+
+// addAddresses adds to the additional section the addresses of the hosts
+// named by records, when they are in the zone. They are the glue of
+// referrals.
+// See [RFC1034 4.3.2]
+// [RFC1034 4.3.2]: https://datatracker.ietf.org/doc/html/rfc1034#section-4.3.2
+func (z *Zone) addAddresses(resp *DNSMessage, records []DNSAnswer) {
+	seen := map[string]bool{}
+	for _, rr := range records {
+		var host string
+		switch rdata := rr.RData.(type) {
+		case *NSRecord:
+			host = rdata.Host
+		case *MXRecord:
+			host = rdata.Exchange
+		case *SRVRecord:
+			host = rdata.Target
+		default:
+			continue
+		}
+		host = canonicalName(host)
+		if seen[host] || !inZone(host, z.Origin) {
+			continue
+		}
+		seen[host] = true
+		for _, address := range z.nodes[host] {
+			if address.Type == ARecordType || address.Type == AAAARecordType {
+				resp.AddAdditionals(address)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const semanticsZone = `$ORIGIN example.com.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 900 604800 300
+	NS	ns1
+	MX	10 mail
+ns1	A	192.0.2.1
+mail	A	192.0.2.25
+www	A	192.0.2.2
+alias	CNAME	www
+chain	CNAME	alias
+external	CNAME	www.example.net.
+*.wild	A	192.0.2.100
+host.wild	A	192.0.2.101
+a.b.ent	A	192.0.2.50
+sub	NS	ns.sub
+	NS	ns.example.net.
+	DS	2371 13 2 1F987CC6583E92DF0890718C422D2F48F63DAD6C2D66ED0A6A1B7E9BD4
+ns.sub	A	192.0.2.53
+old	DNAME	new.example.com.
+www.new	A	192.0.2.77
+`
+
+// recordStrings formats records as "name type rdata" to compare them.
+func recordStrings(records []DNSAnswer) []string {
+	var result []string
+	for _, rr := range records {
+		result = append(result, fmt.Sprintf("%s %d %s", rr.Name, rr.Type, rr.RData))
+	}
+	return result
+}
+
+func TestZone_LookupSemantics(t *testing.T) {
+	zone := newTestZone(t, "example.com", semanticsZone)
+	soa := recordStrings([]DNSAnswer{zone.SOA()})
+
+	tcs := []struct {
+		name                string
+		question            string
+		qtype               uint16
+		expectedAA          bool
+		expectedRCODE       uint16
+		expectedAnswers     []string
+		expectedAuthorities []string
+		expectedAdditionals []string
+	}{
+		{
+			name:                "addresses of the answer targets",
+			question:            "example.com",
+			qtype:               MXRecordType,
+			expectedAA:          true,
+			expectedAnswers:     []string{"example.com 15 10 mail.example.com."},
+			expectedAdditionals: []string{"mail.example.com 1 192.0.2.25"},
+		},
+		{
+			name:       "CNAME chain within the zone",
+			question:   "chain.example.com",
+			qtype:      ARecordType,
+			expectedAA: true,
+			expectedAnswers: []string{
+				"chain.example.com 5 alias.example.com.",
+				"alias.example.com 5 www.example.com.",
+				"www.example.com 1 192.0.2.2",
+			},
+		},
+		{
+			name:            "CNAME leaving the zone",
+			question:        "external.example.com",
+			qtype:           ARecordType,
+			expectedAA:      true,
+			expectedAnswers: []string{"external.example.com 5 www.example.net."},
+		},
+		{
+			name:            "wildcard",
+			question:        "x.wild.example.com",
+			qtype:           ARecordType,
+			expectedAA:      true,
+			expectedAnswers: []string{"x.wild.example.com 1 192.0.2.100"},
+		},
+		{
+			name:            "wildcard several labels down",
+			question:        "x.y.wild.example.com",
+			qtype:           ARecordType,
+			expectedAA:      true,
+			expectedAnswers: []string{"x.y.wild.example.com 1 192.0.2.100"},
+		},
+		{
+			name:                "wildcard without the requested type",
+			question:            "x.wild.example.com",
+			qtype:               AAAARecordType,
+			expectedAA:          true,
+			expectedAuthorities: soa,
+		},
+		{
+			name:                "existing name does not match the wildcard",
+			question:            "host.wild.example.com",
+			qtype:               AAAARecordType,
+			expectedAA:          true,
+			expectedAuthorities: soa,
+		},
+		{
+			name:                "empty non-terminal",
+			question:            "b.ent.example.com",
+			qtype:               ARecordType,
+			expectedAA:          true,
+			expectedAuthorities: soa,
+		},
+		{
+			name:     "referral below a zone cut",
+			question: "www.sub.example.com",
+			qtype:    ARecordType,
+			expectedAuthorities: []string{
+				"sub.example.com 2 ns.sub.example.com.",
+				"sub.example.com 2 ns.example.net.",
+			},
+			expectedAdditionals: []string{"ns.sub.example.com 1 192.0.2.53"},
+		},
+		{
+			name:     "referral at a zone cut",
+			question: "sub.example.com",
+			qtype:    NSRecordType,
+			expectedAuthorities: []string{
+				"sub.example.com 2 ns.sub.example.com.",
+				"sub.example.com 2 ns.example.net.",
+			},
+			expectedAdditionals: []string{"ns.sub.example.com 1 192.0.2.53"},
+		},
+		{
+			name:            "DS records at a zone cut",
+			question:        "sub.example.com",
+			qtype:           DSRecordType,
+			expectedAA:      true,
+			expectedAnswers: []string{"sub.example.com 43 2371 13 2 1F987CC6583E92DF0890718C422D2F48F63DAD6C2D66ED0A6A1B7E9BD4"},
+		},
+		{
+			name:     "DS records below a zone cut",
+			question: "www.sub.example.com",
+			qtype:    DSRecordType,
+			expectedAuthorities: []string{
+				"sub.example.com 2 ns.sub.example.com.",
+				"sub.example.com 2 ns.example.net.",
+			},
+			expectedAdditionals: []string{"ns.sub.example.com 1 192.0.2.53"},
+		},
+		{
+			name:       "DNAME",
+			question:   "www.old.example.com",
+			qtype:      ARecordType,
+			expectedAA: true,
+			expectedAnswers: []string{
+				"old.example.com 39 new.example.com.",
+				"www.old.example.com 5 www.new.example.com.",
+				"www.new.example.com 1 192.0.2.77",
+			},
+		},
+		{
+			name:                "missing name",
+			question:            "missing.example.com",
+			qtype:               ARecordType,
+			expectedAA:          true,
+			expectedRCODE:       NameErrorResponseCode,
+			expectedAuthorities: soa,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp := zone.Lookup(DNSQuestion{Name: tc.question, Type: tc.qtype, Class: INRecordClass})
+			if resp.Header.Flags.AA != tc.expectedAA {
+				t.Errorf("expected AA %v but got %v", tc.expectedAA, resp.Header.Flags.AA)
+			}
+			if resp.Header.Flags.RCODE != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+			}
+			if diff := cmp.Diff(tc.expectedAnswers, recordStrings(resp.Answers)); diff != "" {
+				t.Errorf("answers do not match: %s", diff)
+			}
+			if diff := cmp.Diff(tc.expectedAuthorities, recordStrings(resp.Authorities)); diff != "" {
+				t.Errorf("authorities do not match: %s", diff)
+			}
+			if diff := cmp.Diff(tc.expectedAdditionals, recordStrings(resp.Additionals)); diff != "" {
+				t.Errorf("additionals do not match: %s", diff)
+			}
+		})
+	}
+}
+
+func TestZone_LookupAliasesWithoutData(t *testing.T) {
+	// Records transferred with data the server couldn't decode
+	records := []DNSAnswer{
+		{Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 60, RData: &SOARecord{MName: "ns.example.com"}},
+		{Name: "alias.example.com", Type: CNAMERecordType, Class: INRecordClass, TTL: 60, Data: []byte{0xFF}},
+		{Name: "old.example.com", Type: DNAMERecordType, Class: INRecordClass, TTL: 60, Data: []byte{0xFF}},
+	}
+	zone, err := NewZone("example.com", records)
+	if err != nil {
+		t.Fatalf("failed to create zone: %v", err)
+	}
+
+	tcs := []struct {
+		name            string
+		question        string
+		expectedAnswers []string
+	}{
+		{name: "CNAME", question: "alias.example.com", expectedAnswers: []string{"alias.example.com 5"}},
+		{name: "DNAME", question: "www.old.example.com", expectedAnswers: []string{"old.example.com 39"}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp := zone.Lookup(DNSQuestion{Name: tc.question, Type: ARecordType, Class: INRecordClass})
+			var answers []string
+			for _, rr := range resp.Answers {
+				answers = append(answers, fmt.Sprintf("%s %d", rr.Name, rr.Type))
+			}
+			if diff := cmp.Diff(tc.expectedAnswers, answers); diff != "" {
+				t.Errorf("answers do not match: %s", diff)
+			}
+		})
+	}
+}
@@ -1,32 +1,226 @@
 package main
 
 import (
-	"encoding/hex"
+	"bytes"
 	"flag"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-var resolverAddress string
+const listenAddress = "127.0.0.1:2053"
+
+var (
+	mode            string
+	rootHints       string
+	resolverAddress string
+	strategy        string
+	resolverTimeout time.Duration
+	forwardRules    string
+	workerCount     int
+	queueSize       int
+	cacheSize       int
+	staleWindow     time.Duration
+	zoneFiles       originFlags
+	allowTransfer   originFlags
+	secondaryZones  originFlags
+	notifyTargets   originFlags
+	allowUpdate     originFlags
+	tsigKeysFile    string
+	resolverKey     string
+	trustAnchors    string
+)
+
+// originFlags collects the origin=value pairs of a repeated flag.
+type originFlags []string
+
+func (f *originFlags) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *originFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("expected origin=value but got %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// Handler answers requests from the zones the server is authoritative for,
+// forwarding the other questions to an upstream.
+type Handler struct {
+	upstream Upstream
+	zones    *ZoneStore
+	// transferACLs holds the networks and keys allowed to transfer each zone.
+	transferACLs map[string]*acl
+	// secondaries holds the zones transferred from a primary, which may
+	// announce their changes.
+	secondaries map[string]*Secondary
+	// updateACLs holds the networks and keys allowed to update each zone.
+	updateACLs map[string]*acl
+	updateMu   sync.Mutex
+	// keys holds the TSIG keys requests may be signed with.
+	keys map[string]*TSIGKey
+}
 
 func main() {
+	flag.StringVar(
+		&mode,
+		"mode",
+		ForwardMode,
+		"how questions are answered: forward to the resolvers or recursive from the root servers",
+	)
+	flag.StringVar(
+		&rootHints,
+		"root-hints",
+		defaultRootHints,
+		"comma separated IP addresses of the root servers used in recursive mode",
+	)
 	flag.StringVar(
 		&resolverAddress,
 		"resolver",
 		"8.8.8.8:53",
-		"address of DNS resolver to forward requests to: 0.0.0.0:53",
+		"comma separated addresses of DNS resolvers to forward requests to, "+
+			"each with an optional timeout: 8.8.8.8:53/500ms,1.1.1.1:53",
+	)
+	flag.StringVar(
+		&strategy,
+		"strategy",
+		SequentialStrategy,
+		"order in which resolvers are tried: sequential, round-robin, random or fastest",
+	)
+	flag.DurationVar(&resolverTimeout, "resolver-timeout", readWriteTiemeout, "default timeout of a resolver")
+	flag.StringVar(
+		&forwardRules,
+		"forward-rules",
+		"",
+		"file of domain suffixes forwarded to their own resolvers, reloaded on SIGHUP",
+	)
+	flag.IntVar(&workerCount, "workers", 64, "number of UDP requests processed concurrently")
+	flag.IntVar(
+		&queueSize,
+		"queue",
+		256,
+		"number of UDP requests waiting for a worker before reads are paused",
+	)
+	flag.IntVar(&cacheSize, "cache-size", 10<<20, "maximum size of the response cache in bytes, 0 disables it")
+	flag.DurationVar(
+		&staleWindow,
+		"stale-window",
+		24*time.Hour,
+		"how long expired cache entries are served when the upstream fails, 0 disables it",
+	)
+
+	flag.Var(&zoneFiles, "zone", "zone served authoritatively from a master file: example.com=example.com.zone, repeatable")
+	flag.Var(
+		&allowTransfer,
+		"allow-transfer",
+		"comma separated addresses, networks or key:name TSIG keys allowed to transfer a zone: example.com=192.0.2.1,10.0.0.0/8,key:transfer-key, repeatable",
+	)
+
+	flag.Var(
+		&allowUpdate,
+		"allow-update",
+		"comma separated addresses, networks or key:name TSIG keys allowed to update a zone: example.com=192.0.2.1,10.0.0.0/8,key:update-key, repeatable",
+	)
+	flag.Var(
+		&secondaryZones,
+		"secondary",
+		"zone transferred from a primary server and kept up to date, optionally with a TSIG key: example.com=192.0.2.1:53/transfer-key, repeatable",
+	)
+	flag.Var(
+		&notifyTargets,
+		"notify",
+		"comma separated addresses of the secondaries notified when a zone changes, optionally with a TSIG key: example.com=192.0.2.2:53/transfer-key, repeatable",
+	)
+	flag.StringVar(&tsigKeysFile, "tsig-keys", "", "file of the TSIG keys authenticating transfers, notifications, updates and requests")
+	flag.StringVar(&resolverKey, "resolver-key", "", "name of the TSIG key signing the requests sent to the resolvers and to the upstreams of the forwarding rules")
+	flag.StringVar(
+		&trustAnchors,
+		"trust-anchors",
+		"",
+		"master file of the DS or DNSKEY records the answers of the resolvers are validated from with DNSSEC",
 	)
 
 	flag.Parse()
 
-	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
+	keys := map[string]*TSIGKey{}
+	if tsigKeysFile != "" {
+		loaded, err := LoadTSIGKeys(tsigKeysFile)
+		if err != nil {
+			log.Printf("failed to load TSIG keys: %v", err)
+			return
+		}
+		keys = loaded
+	}
+	notifier, err := NewNotifier(notifyTargets, keys, resolverTimeout)
+	if err != nil {
+		log.Printf("invalid -notify: %v", err)
+		return
+	}
+	zones := NewZoneStore()
+	zones.Watch(notifier.ZoneChanged)
+	for _, zoneFile := range zoneFiles {
+		origin, path, _ := strings.Cut(zoneFile, "=")
+		zone, err := LoadZone(origin, path)
+		if err != nil {
+			log.Printf("failed to load zone %s: %v", origin, err)
+			return
+		}
+		zones.Add(zone)
+		log.Printf("serving zone %s with %d records from %s", fqdn(zone.Origin), len(zone.Records()), path)
+	}
+	secondaries := map[string]*Secondary{}
+	for _, secondaryZone := range secondaryZones {
+		origin, primary, _ := strings.Cut(secondaryZone, "=")
+		primary, keyName, _ := strings.Cut(primary, "/")
+		key, err := keyNamed(keys, keyName)
+		if err != nil {
+			log.Printf("invalid -secondary %s: %v", secondaryZone, err)
+			return
+		}
+		secondary := NewSecondary(origin, primary, key, zones, resolverTimeout)
+		defer secondary.Close()
+		secondaries[secondary.origin] = secondary
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddress)
 	if err != nil {
 		log.Fatalf("Failed to resolve UDP address: %v", err)
 	}
 
-	resolver, err := NewResolver(resolverAddress)
+	resolverTSIGKey, err := keyNamed(keys, resolverKey)
 	if err != nil {
-		log.Printf("failed to create resolver for address %s: %v", resolverAddress, err)
+		log.Printf("invalid -resolver-key: %v", err)
+		return
+	}
+
+	var resolver Upstream
+	switch mode {
+	case ForwardMode:
+		pool, err := NewResolverPool(strings.Split(resolverAddress, ","), strategy, resolverTimeout)
+		if err != nil {
+			log.Printf("failed to create resolvers for addresses %s: %v", resolverAddress, err)
+			return
+		}
+		defer pool.Close()
+		pool.SetTSIGKey(resolverTSIGKey)
+		resolver = pool
+	case RecursiveMode:
+		recursive, err := NewRecursiveResolver(strings.Split(rootHints, ","), resolverTimeout)
+		if err != nil {
+			log.Printf("failed to create recursive resolver: %v", err)
+			return
+		}
+		resolver = recursive
+	default:
+		log.Printf("unknown mode: %q", mode)
 		return
 	}
 
@@ -36,44 +230,188 @@ func main() {
 	}
 	defer udpConn.Close()
 
-	buf := make([]byte, 512)
+	tcpListener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.Fatalf("Failed to bind to TCP address: %v", err)
+	}
+	defer tcpListener.Close()
 
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
+	upstream := resolver
+	if forwardRules != "" {
+		forwarder, err := NewForwardingResolver(resolver, forwardRules, strategy, resolverTimeout, resolverTSIGKey)
 		if err != nil {
-			log.Printf("Error receiving data: %v", err)
-			continue
+			log.Printf("failed to load forwarding rules: %v", err)
+			return
 		}
+		defer forwarder.Close()
+		go reloadOnHangup(forwarder)
+		upstream = forwarder
+	}
+	if trustAnchors != "" {
+		anchors, err := ParseZoneFile(trustAnchors, "")
+		if err != nil {
+			log.Printf("failed to load trust anchors: %v", err)
+			return
+		}
+		validator, err := NewValidatingResolver(upstream, anchors)
+		if err != nil {
+			log.Printf("invalid trust anchors: %v", err)
+			return
+		}
+		upstream = validator
+	}
+	if cacheSize > 0 {
+		upstream = NewCachingResolver(upstream, NewCache(cacheSize, staleWindow))
+	}
 
-		log.Printf("processing request from %s: %s", source, hex.EncodeToString(buf[:size]))
+	transferACLs, err := parseACLs(allowTransfer, keys)
+	if err != nil {
+		log.Printf("invalid -allow-transfer: %v", err)
+		return
+	}
+	updateACLs, err := parseACLs(allowUpdate, keys)
+	if err != nil {
+		log.Printf("invalid -allow-update: %v", err)
+		return
+	}
+	handler := &Handler{
+		upstream:     upstream,
+		zones:        zones,
+		transferACLs: transferACLs,
+		secondaries:  secondaries,
+		updateACLs:   updateACLs,
+		keys:         keys,
+	}
+	go serveTCP(tcpListener, handler)
+	serveUDP(udpConn, handler, workerCount, queueSize)
+}
 
-		req := DNSMessage{}
-		if err := req.UnmarshalBinary(buf[:size]); err != nil {
-			log.Printf("failed to parse request: %v", err)
-			return
+// reloadOnHangup reloads the forwarding rules every time the process receives
+// SIGHUP.
+func reloadOnHangup(forwarder *ForwardingResolver) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := forwarder.Reload(); err != nil {
+			log.Printf("failed to reload forwarding rules: %v", err)
 		}
+	}
+}
 
-		log.Printf("REQ: %+v\n", req)
-		resp, err := processMessage(resolver, &req)
-		if err != nil {
-			log.Printf("failed to process message: %v", err)
-			continue
+// handleRequest decodes a request from client, processes it and returns the
+// encoded responses, a single one except for zone transfers. Responses sent
+// over UDP are truncated to the payload size the client advertised. Signed
+// requests are checked and their responses signed with the same key. It
+// returns nil when nothing must be sent back.
+func (h *Handler) handleRequest(data []byte, client net.Addr, udp bool) [][]byte {
+	req := DNSMessage{}
+	if err := req.UnmarshalBinary(data); err != nil {
+		log.Printf("failed to parse request: %v", err)
+		return formatError(data)
+	}
+
+	log.Printf("REQ: %+v\n", req)
+	// See [RFC8945 5.1]
+	// [RFC8945 5.1]: https://datatracker.ietf.org/doc/html/rfc8945#section-5.1
+	if req.misplacedTSIG() {
+		log.Printf("rejecting request from %s with a TSIG record before its last record", client)
+		return formatError(data)
+	}
+	var session *tsigSession
+	if rr := req.TSIG(); rr != nil {
+		tsig, ok := rr.RData.(*TSIGRecord)
+		if !ok {
+			log.Printf("rejecting request from %s with a malformed TSIG record", client)
+			return formatError(data)
 		}
-		response, err := resp.MarshalBinary()
-		if err != nil {
-			log.Printf("failed to marshal respoinse: %v\n", err)
-			continue
+		var err error
+		if session, err = h.verifyRequest(data, rr.Name, tsig); err != nil {
+			log.Printf("rejecting request signed with key %s from %s: %v", fqdn(rr.Name), client, err)
+			return h.tsigErrorResponse(&req, rr.Name, tsig, session, err)
 		}
+		req.removeTSIG()
+	}
 
-		_, err = udpConn.WriteToUDP(response, source)
+	maxSize := maxTCPMessageSize
+	if udp {
+		maxSize = req.MaxUDPSize()
+	}
+	var key *TSIGKey
+	if session != nil {
+		key = session.key
+		maxSize -= key.recordSize()
+	}
+	responses := h.respond(&req, client, key, udp, maxSize)
+	if session == nil {
+		return responses
+	}
+	for i, response := range responses {
+		signed, err := session.sign(response)
 		if err != nil {
-			log.Println("Failed to send response:", err)
+			log.Printf("failed to sign response: %v", err)
+			return nil
 		}
-		log.Printf("request processed %s", source)
+		responses[i] = signed
 	}
+	return responses
 }
 
-func processMessage(resolver *Resolver, req *DNSMessage) (*DNSMessage, error) {
+// respond returns the encoded responses to req from client, signed with key
+// when it is not nil. Responses other than zone transfers are truncated to
+// maxSize bytes.
+func (h *Handler) respond(req *DNSMessage, client net.Addr, key *TSIGKey, udp bool, maxSize int) [][]byte {
+	if isTransferRequest(req) {
+		return h.transfer(req, client, key, udp)
+	}
+	switch req.Header.Flags.OPCODE {
+	case NotifyOpCode:
+		return h.notify(req, client, key)
+	case UpdateOpCode:
+		return h.update(req, client, key)
+	}
+	resp, err := h.processMessage(req)
+	if err != nil {
+		log.Printf("failed to process message: %v", err)
+		return nil
+	}
+	response, err := resp.Truncate(maxSize)
+	if err != nil {
+		log.Printf("failed to marshal respoinse: %v\n", err)
+		return nil
+	}
+
+	return [][]byte{response}
+}
+
+// formatError returns the encoded FORMERR response to the request data, or
+// nil when it must not be answered.
+func formatError(data []byte) [][]byte {
+	resp := formatErrorResponse(data)
+	if resp == nil {
+		return nil
+	}
+	response, err := resp.MarshalBinary()
+	if err != nil {
+		log.Printf("failed to marshal format error response: %v\n", err)
+		return nil
+	}
+	return [][]byte{response}
+}
+
+// formatErrorResponse builds a FORMERR response to a request that could not be
+// parsed. It returns nil when the header itself is unreadable or when the
+// packet is a response, which must never be answered.
+func formatErrorResponse(data []byte) *DNSMessage {
+	var header DNSHeader
+	if err := readHeader(bytes.NewReader(data), &header); err != nil || header.Flags.QR {
+		return nil
+	}
+	resp := CreateResponse(&DNSMessage{Header: header})
+	resp.Header.Flags.RCODE = FormatErrorResponseCode
+	return resp
+}
+
+func (h *Handler) processMessage(req *DNSMessage) (*DNSMessage, error) {
 	resp := CreateResponse(req)
 
 	switch req.Header.Flags.OPCODE {
@@ -83,11 +421,43 @@ func processMessage(resolver *Resolver, req *DNSMessage) (*DNSMessage, error) {
 		return resp, nil
 	}
 
+	// Only EDNS version 0 exists, later versions must be answered with BADVERS
+	// See [RFC6891 6.1.3]
+	// [RFC6891 6.1.3]: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.3
+	var upstreamEDNS *EDNS
+	if req.EDNS != nil {
+		resp.SetEDNS(&EDNS{UDPSize: maxUDPSize})
+		if req.EDNS.Version > 0 {
+			resp.SetRCODE(BadVersionResponseCode)
+			return resp, nil
+		}
+		// Ask the upstream for answers sized for the client
+		upstreamSize := req.MaxUDPSize()
+		if upstreamSize > maxUDPSize {
+			upstreamSize = maxUDPSize
+		}
+		upstreamEDNS = &EDNS{UDPSize: uint16(upstreamSize), DO: req.EDNS.DO}
+	}
+
+	dnssecOK := req.EDNS != nil && req.EDNS.DO
+	authenticated := len(req.Questions) > 0
 	for i, q := range req.Questions {
-		req := DNSMessage{
+		if zone := h.zones.Find(q.Name); zone != nil {
+			local := zone.Lookup(q)
+			resp.Header.Flags.AA = local.Header.Flags.AA
+			relayResponse(resp, local)
+			resp.Header.Flags.RA = h.upstream != nil
+			authenticated = false
+			continue
+		}
+
+		// The resolver picks a random query ID
+		upstreamReq := DNSMessage{
 			Header: DNSHeader{
-				ID:      uint16(i),
-				Flags:   DNSHeaderFlags{},
+				Flags: DNSHeaderFlags{
+					RD: req.Header.Flags.RD,
+					CD: req.Header.Flags.CD,
+				},
 				QDCOUNT: 1,
 			},
 			Questions: []DNSQuestion{
@@ -98,15 +468,64 @@ func processMessage(resolver *Resolver, req *DNSMessage) (*DNSMessage, error) {
 				},
 			},
 		}
-		r, err := resolver.SendRequest(&req)
+		upstreamReq.SetEDNS(upstreamEDNS)
+		r, err := h.upstream.SendRequest(&upstreamReq)
 		if err != nil {
 			log.Printf("failed to send resolver request: %v", err)
-			resp.Header.Flags.RCODE = ServerFailureResponseCode
+			resp.SetRCODE(ServerFailureResponseCode)
 			return resp, nil
 		}
-		resp.AddAnswers(r.Answers[0])
+		authenticated = authenticated && r.Header.Flags.AD
+		if !dnssecOK {
+			r = withoutDNSSEC(r, q.Type)
+		}
+		relayResponse(resp, r)
 		log.Printf("resolver request %d successfull", i)
 	}
 
+	// AD is only set for the clients that show they understand it
+	// See [RFC6840 5.8]
+	// [RFC6840 5.8]: https://datatracker.ietf.org/doc/html/rfc6840#section-5.8
+	resp.Header.Flags.AD = authenticated && (dnssecOK || req.Header.Flags.AD)
 	return resp, nil
 }
+
+// withoutDNSSEC returns a copy of msg without the DNSSEC records that were not
+// asked for with rrType, for the clients that didn't set the DO flag.
+// See [RFC4035 3.2.1]
+// [RFC4035 3.2.1]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2.1
+func withoutDNSSEC(msg *DNSMessage, rrType uint16) *DNSMessage {
+	stripped := &DNSMessage{Header: msg.Header}
+	stripped.Header.ANCOUNT, stripped.Header.NSCOUNT, stripped.Header.ARCOUNT = 0, 0, 0
+	stripped.SetEDNS(msg.EDNS)
+	keep := func(records []DNSAnswer) []DNSAnswer {
+		var kept []DNSAnswer
+		for _, rr := range records {
+			switch rr.Type {
+			case RRSIGRecordType, NSECRecordType, NSEC3RecordType:
+				if rr.Type != rrType {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	stripped.AddAnswers(keep(msg.Answers)...)
+	stripped.AddAuthorities(keep(msg.Authorities)...)
+	stripped.AddAdditionals(keep(msg.Additionals)...)
+	return stripped
+}
+
+// relayResponse copies the records and the outcome of an upstream response
+// into the response sent to the client. The first error reported by an
+// upstream, such as NXDOMAIN, is kept.
+func relayResponse(resp *DNSMessage, upstream *DNSMessage) {
+	resp.AddAnswers(upstream.Answers...)
+	resp.AddAuthorities(upstream.Authorities...)
+	resp.AddAdditionals(upstream.Additionals...)
+	resp.Header.Flags.RA = upstream.Header.Flags.RA
+	if resp.RCODE() == NoErrorResponseCode {
+		resp.SetRCODE(upstream.RCODE())
+	}
+}
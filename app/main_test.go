@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProcessMessage_RelaysUpstreamResponse(t *testing.T) {
+	tcs := []struct {
+		name                string
+		upstream            func(req *DNSMessage) *DNSMessage
+		expectedRCODE       uint16
+		expectedAnswers     int
+		expectedAuthorities int
+		expectedAdditionals int
+	}{
+		{
+			name: "relay every record of a CNAME chain",
+			upstream: func(req *DNSMessage) *DNSMessage {
+				resp := CreateResponse(req)
+				resp.Header.Flags.RA = true
+				resp.AddAnswers(
+					DNSAnswer{
+						Name: "www.example.com", Type: CNAMERecordType, Class: INRecordClass, TTL: 60,
+						RData: &CNAMERecord{Target: "web.example.com"},
+					},
+					DNSAnswer{
+						Name: "web.example.com", Type: ARecordType, Class: INRecordClass, TTL: 60,
+						RData: &ARecord{IP: net.IP{192, 0, 2, 1}},
+					},
+					DNSAnswer{
+						Name: "web.example.com", Type: ARecordType, Class: INRecordClass, TTL: 60,
+						RData: &ARecord{IP: net.IP{192, 0, 2, 2}},
+					},
+				)
+				resp.AddAuthorities(DNSAnswer{
+					Name: "example.com", Type: NSRecordType, Class: INRecordClass, TTL: 60,
+					RData: &NSRecord{Host: "ns.example.com"},
+				})
+				resp.AddAdditionals(DNSAnswer{
+					Name: "ns.example.com", Type: ARecordType, Class: INRecordClass, TTL: 60,
+					RData: &ARecord{IP: net.IP{192, 0, 2, 53}},
+				})
+				return resp
+			},
+			expectedRCODE:       NoErrorResponseCode,
+			expectedAnswers:     3,
+			expectedAuthorities: 1,
+			expectedAdditionals: 1,
+		},
+		{
+			name: "relay NXDOMAIN",
+			upstream: func(req *DNSMessage) *DNSMessage {
+				resp := CreateResponse(req)
+				resp.Header.Flags.RCODE = NameErrorResponseCode
+				resp.AddAuthorities(DNSAnswer{
+					Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 60,
+					RData: &SOARecord{MName: "ns.example.com", RName: "hostmaster.example.com", Minimum: 60},
+				})
+				return resp
+			},
+			expectedRCODE:       NameErrorResponseCode,
+			expectedAuthorities: 1,
+		},
+		{
+			name: "relay NODATA",
+			upstream: func(req *DNSMessage) *DNSMessage {
+				return CreateResponse(req)
+			},
+			expectedRCODE: NoErrorResponseCode,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+				return []*DNSMessage{tc.upstream(req)}
+			})
+			resolver, err := NewResolver(addr)
+			if err != nil {
+				t.Fatalf("failed to create resolver: %v", err)
+			}
+			defer resolver.Close()
+
+			req := newQuery("www.example.com", ARecordType)
+			req.Header.ID = 1234
+			req.Header.Flags.RD = true
+			resp, err := (&Handler{upstream: resolver}).processMessage(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Header.ID != 1234 || !resp.Header.Flags.QR {
+				t.Errorf("response header does not match the request: %+v", resp.Header)
+			}
+			if resp.RCODE() != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.RCODE())
+			}
+			if len(resp.Answers) != tc.expectedAnswers ||
+				len(resp.Authorities) != tc.expectedAuthorities ||
+				len(resp.Additionals) != tc.expectedAdditionals {
+				t.Errorf(
+					"expected %d/%d/%d records but got %d/%d/%d",
+					tc.expectedAnswers, tc.expectedAuthorities, tc.expectedAdditionals,
+					len(resp.Answers), len(resp.Authorities), len(resp.Additionals),
+				)
+			}
+			if int(resp.Header.ANCOUNT) != len(resp.Answers) {
+				t.Errorf("ANCOUNT %d does not match %d answers", resp.Header.ANCOUNT, len(resp.Answers))
+			}
+		})
+	}
+}
+
+func TestProcessMessage_AnswersFromZones(t *testing.T) {
+	zones := NewZoneStore()
+	zones.Add(newTestZone(t, "example.com", lookupZone))
+	upstream := &countingUpstream{ttl: 60, ip: net.IP{198, 51, 100, 1}}
+	handler := &Handler{upstream: upstream, zones: zones}
+
+	tcs := []struct {
+		name          string
+		question      string
+		expectedAA    bool
+		expectedRCODE uint16
+		expectedCalls int
+	}{
+		{name: "name in the zone", question: "www.example.com", expectedAA: true, expectedRCODE: NoErrorResponseCode},
+		{name: "missing name in the zone", question: "missing.example.com", expectedAA: true, expectedRCODE: NameErrorResponseCode},
+		{name: "name outside of the zone", question: "www.example.net", expectedRCODE: NoErrorResponseCode, expectedCalls: 1},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			calls := upstream.Calls()
+			resp, err := handler.processMessage(newQuery(tc.question, ARecordType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Header.Flags.AA != tc.expectedAA {
+				t.Errorf("expected AA %v but got %v", tc.expectedAA, resp.Header.Flags.AA)
+			}
+			if resp.RCODE() != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.RCODE())
+			}
+			if got := upstream.Calls() - calls; got != tc.expectedCalls {
+				t.Errorf("expected %d upstream requests but got %d", tc.expectedCalls, got)
+			}
+		})
+	}
+}
+
+func TestProcessMessage_CheckingDisabled(t *testing.T) {
+	received := make(chan bool, 1)
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		received <- req.Header.Flags.CD
+		return []*DNSMessage{CreateResponse(req)}
+	})
+	resolver, err := NewResolver(addr)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer resolver.Close()
+
+	req := newQuery("www.example.com", ARecordType)
+	req.Header.Flags.CD = true
+	resp, err := (&Handler{upstream: resolver}).processMessage(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !<-received {
+		t.Errorf("expected the CD flag to be forwarded upstream")
+	}
+	if !resp.Header.Flags.CD {
+		t.Errorf("expected the CD flag to be copied into the response")
+	}
+}
+
+func TestProcessMessage_DNSSEC(t *testing.T) {
+	upstream, anchor := newValidationFixture(t)
+	zones := NewZoneStore()
+	zones.Add(newTestZone(t, "example.com", lookupZone))
+	handler := &Handler{upstream: newTestValidator(t, upstream, anchor), zones: zones}
+
+	tcs := []struct {
+		name               string
+		question           string
+		dnssecOK           bool
+		authenticatedData  bool
+		expectedAD         bool
+		expectedSignatures bool
+	}{
+		{name: "DNSSEC aware client", question: "www.example", dnssecOK: true, expectedAD: true, expectedSignatures: true},
+		{name: "client without DO", question: "www.example"},
+		{name: "client asking for AD", question: "www.example", authenticatedData: true, expectedAD: true},
+		{name: "insecure answer", question: "www.insecure.example", dnssecOK: true},
+		{name: "answer from a local zone", question: "www.example.com", dnssecOK: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := newQuery(tc.question, ARecordType)
+			req.Header.Flags.RD = true
+			req.Header.Flags.AD = tc.authenticatedData
+			req.SetEDNS(&EDNS{UDPSize: 1232, DO: tc.dnssecOK})
+			resp, err := handler.processMessage(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.RCODE() != NoErrorResponseCode || len(resp.Answers) == 0 {
+				t.Fatalf("expected an answer but got RCODE %d and %d records", resp.RCODE(), len(resp.Answers))
+			}
+			if resp.Header.Flags.AD != tc.expectedAD {
+				t.Errorf("expected AD %v but got %v", tc.expectedAD, resp.Header.Flags.AD)
+			}
+			signed := false
+			for _, rr := range resp.Answers {
+				signed = signed || rr.Type == RRSIGRecordType
+			}
+			if signed != tc.expectedSignatures {
+				t.Errorf("expected signatures %v but got %v", tc.expectedSignatures, signed)
+			}
+			if int(resp.Header.ANCOUNT) != len(resp.Answers) {
+				t.Errorf("ANCOUNT %d does not match %d answers", resp.Header.ANCOUNT, len(resp.Answers))
+			}
+		})
+	}
+}
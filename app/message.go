@@ -3,12 +3,49 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"strings"
 )
 
+// Errors returned when decoding a malformed message.
+var (
+	// ErrTruncated is returned when the message ends before a field is complete.
+	ErrTruncated = errors.New("message truncated")
+	// ErrBadPointer is returned when a compression pointer does not point
+	// backward to a previous name, which includes pointer loops.
+	ErrBadPointer = errors.New("bad compression pointer")
+	// ErrLabelTooLong is returned when a label is longer than 63 bytes.
+	ErrLabelTooLong = errors.New("label longer than 63 bytes")
+	// ErrNameTooLong is returned when a domain name is longer than 255 bytes.
+	ErrNameTooLong = errors.New("domain name longer than 255 bytes")
+	// ErrBadRData is returned when a record RDATA does not match its RDLENGTH.
+	ErrBadRData = errors.New("bad rdata")
+)
+
+const (
+	// See [RFC1035 2.3.4]
+	// [RFC1035 2.3.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-2.3.4
+	maxLabelLength = 63
+	maxNameLength  = 255
+
+	headerLength = 12
+	// minQuestionLength is the size of a question for the root domain.
+	minQuestionLength = 5
+	// minAnswerLength is the size of a record for the root domain with no data.
+	minAnswerLength = 11
+)
+
+// truncated wraps err with ErrTruncated when it reports a premature end of data.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrTruncated, err)
+	}
+	return err
+}
+
 type DNSHeader struct {
 	ID      uint16
 	Flags   DNSHeaderFlags
@@ -65,7 +102,13 @@ func (header DNSHeader) MarshalBinary() ([]byte, error) {
 	if header.Flags.RA {
 		flags |= 1 << 7
 	}
-	flags |= header.Flags.Z << 4
+	flags |= header.Flags.Z << 6
+	if header.Flags.AD {
+		flags |= 1 << 5
+	}
+	if header.Flags.CD {
+		flags |= 1 << 4
+	}
 	flags |= header.Flags.RCODE
 
 	binary.BigEndian.PutUint16(buff[2:4], flags)
@@ -77,6 +120,10 @@ func (header DNSHeader) MarshalBinary() ([]byte, error) {
 	return buff, nil
 }
 
+// DNSHeaderFlags holds the flags of the header. DNSSEC took the AD and CD
+// bits from the Z field, which is left with a single bit.
+// See [RFC4035 3.2]
+// [RFC4035 3.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2
 type DNSHeaderFlags struct {
 	QR     bool
 	OPCODE uint16 // 4bit
@@ -84,19 +131,26 @@ type DNSHeaderFlags struct {
 	TC     bool
 	RD     bool
 	RA     bool
-	Z      uint16 // 3bit
+	Z      uint16 // 1bit
+	AD     bool   // authentic data, the records were validated
+	CD     bool   // checking disabled, the client validates the records
 	RCODE  uint16 // 4bit
 }
 
 func (f *DNSHeaderFlags) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("%w: header flags need 2 bytes got %d", ErrTruncated, len(data))
+	}
 	flags := binary.BigEndian.Uint16(data)
 	qrMask := uint16(0x8000)
 	opcodeMask := uint16(0x7800)
 	aaMask := uint16(0x0400)
 	tcMask := uint16(0x0200)
 	rdMask := uint16(0x0100)
-	raMask := uint16(0x0050)
-	zMask := uint16(0x0070)
+	raMask := uint16(0x0080)
+	zMask := uint16(0x0040)
+	adMask := uint16(0x0020)
+	cdMask := uint16(0x0010)
 	rcodeMask := uint16(0x000F)
 
 	f.QR = (flags & qrMask) != 0
@@ -105,7 +159,9 @@ func (f *DNSHeaderFlags) UnmarshalBinary(data []byte) error {
 	f.TC = (flags & tcMask) != 0
 	f.RD = (flags & rdMask) != 0
 	f.RA = (flags & raMask) != 0
-	f.Z = uint16((flags & zMask) << 4)
+	f.Z = uint16((flags & zMask) >> 6)
+	f.AD = (flags & adMask) != 0
+	f.CD = (flags & cdMask) != 0
 	f.RCODE = uint16(flags & rcodeMask)
 
 	return nil
@@ -120,18 +176,25 @@ type DNSQuestion struct {
 func (q DNSQuestion) MarshalBinary() ([]byte, error) {
 	var buff bytes.Buffer
 
-	serializedDomain := MarshalDomain(q.Name)
-	if _, err := buff.Write(serializedDomain); err != nil {
+	if err := q.marshal(&buff, nil); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(&buff, binary.BigEndian, q.Type); err != nil {
-		return nil, err
+
+	return buff.Bytes()[:buff.Len()], nil
+}
+
+// marshal appends the question to buff, compressing its name against the
+// names already registered in compression when it is not nil.
+func (q DNSQuestion) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	writeDomain(buff, q.Name, compression)
+	if err := binary.Write(buff, binary.BigEndian, q.Type); err != nil {
+		return err
 	}
-	if err := binary.Write(&buff, binary.BigEndian, q.Class); err != nil {
-		return nil, err
+	if err := binary.Write(buff, binary.BigEndian, q.Class); err != nil {
+		return err
 	}
 
-	return buff.Bytes()[:buff.Len()], nil
+	return nil
 }
 
 func (q *DNSQuestion) UnMarshalBinary(buf []byte) error {
@@ -141,14 +204,17 @@ func (q *DNSQuestion) UnMarshalBinary(buf []byte) error {
 	for {
 		labelLen, err := r.ReadByte()
 		if err != nil {
-			return err
+			return truncated(err)
 		}
 		if labelLen == 0x00 {
 			break
 		}
+		if labelLen > maxLabelLength {
+			return ErrLabelTooLong
+		}
 		labelBytes := make([]byte, labelLen)
-		if _, err := r.Read(labelBytes); err != nil {
-			return err
+		if _, err := io.ReadFull(r, labelBytes); err != nil {
+			return truncated(err)
 		}
 		if s.Len() != 0 {
 			s.WriteRune('.')
@@ -158,48 +224,84 @@ func (q *DNSQuestion) UnMarshalBinary(buf []byte) error {
 
 	q.Name = s.String()
 	if err := binary.Read(r, binary.BigEndian, &q.Type); err != nil {
-		return err
+		return truncated(err)
 	}
 	if err := binary.Read(r, binary.BigEndian, &q.Class); err != nil {
-		return err
+		return truncated(err)
 	}
 
 	return nil
 }
 
+// DNSAnswer is a resource record as found in the answer, authority and
+// additional sections of a message.
+//
+// RData holds the decoded data for the supported record types and takes
+// precedence over Data when marshalling. Data always holds the raw RDATA bytes
+// read from the wire, so records of unknown types can still be relayed.
 type DNSAnswer struct {
 	Name  string
 	Type  uint16
 	Class uint16
 	TTL   uint32
 	Data  []byte
+	RData RData
 }
 
 func (a DNSAnswer) MarshalBinary() ([]byte, error) {
 	var buff bytes.Buffer
 
-	if _, err := buff.Write(MarshalDomain(a.Name)); err != nil {
-		return nil, err
-	}
-	binary.Write(&buff, binary.BigEndian, a.Type)
-	binary.Write(&buff, binary.BigEndian, a.Class)
-	binary.Write(&buff, binary.BigEndian, a.TTL)
-	binary.Write(&buff, binary.BigEndian, uint16(len(a.Data)))
-	if _, err := buff.Write(a.Data); err != nil {
+	if err := a.marshal(&buff, nil); err != nil {
 		return nil, err
 	}
 
 	return buff.Bytes()[:buff.Len()], nil
 }
 
+// marshal appends the resource record to buff, compressing its owner name
+// against the names already registered in compression when it is not nil.
+func (a DNSAnswer) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	writeDomain(buff, a.Name, compression)
+	binary.Write(buff, binary.BigEndian, a.Type)
+	binary.Write(buff, binary.BigEndian, a.Class)
+	binary.Write(buff, binary.BigEndian, a.TTL)
+	if a.RData == nil {
+		binary.Write(buff, binary.BigEndian, uint16(len(a.Data)))
+		if _, err := buff.Write(a.Data); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Reserve RDLENGTH and fill it once the data is written as compression
+	// makes its size unknown beforehand.
+	lengthOffset := buff.Len()
+	buff.Write([]byte{0x0, 0x0})
+	if err := a.RData.marshal(buff, compression); err != nil {
+		return fmt.Errorf("failed to encode %s rdata: %w", a.Name, err)
+	}
+	rdLen := buff.Len() - lengthOffset - 2
+	if rdLen > 0xFFFF {
+		return fmt.Errorf("rdata of %s is too long: %d", a.Name, rdLen)
+	}
+	binary.BigEndian.PutUint16(buff.Bytes()[lengthOffset:], uint16(rdLen))
+
+	return nil
+}
+
 type DNSMessage struct {
-	Header    DNSHeader
-	Questions []DNSQuestion
-	Answers   []DNSAnswer
+	Header      DNSHeader
+	Questions   []DNSQuestion
+	Answers     []DNSAnswer
+	Authorities []DNSAnswer
+	Additionals []DNSAnswer
+	// EDNS holds the OPT pseudo-record, which is kept out of Additionals but
+	// still counted in Header.ARCOUNT.
+	EDNS *EDNS
 }
 
 // CreateResponse create a DNS response base on a DNS request
-// It automatically set DNSHeader.ID, DNSHeaderFlags.QR, DNSHeaderFlags.OPCODE, DNSHeaderFlags.RD
+// It automatically set DNSHeader.ID, DNSHeaderFlags.QR, DNSHeaderFlags.OPCODE, DNSHeaderFlags.RD, DNSHeaderFlags.CD
 func CreateResponse(req *DNSMessage) *DNSMessage {
 	msg := &DNSMessage{
 		Header: DNSHeader{
@@ -208,6 +310,7 @@ func CreateResponse(req *DNSMessage) *DNSMessage {
 				QR:     true,
 				OPCODE: req.Header.Flags.OPCODE,
 				RD:     req.Header.Flags.RD,
+				CD:     req.Header.Flags.CD,
 			},
 			QDCOUNT: uint16(len(req.Questions)),
 		},
@@ -229,8 +332,74 @@ func (msg *DNSMessage) AddAnswers(answers ...DNSAnswer) {
 	msg.Header.ANCOUNT += uint16(len(answers))
 }
 
+func (msg *DNSMessage) AddAuthorities(authorities ...DNSAnswer) {
+	msg.Authorities = append(msg.Authorities, authorities...)
+	msg.Header.NSCOUNT += uint16(len(authorities))
+}
+
+func (msg *DNSMessage) AddAdditionals(additionals ...DNSAnswer) {
+	msg.Additionals = append(msg.Additionals, additionals...)
+	msg.Header.ARCOUNT += uint16(len(additionals))
+}
+
+// Truncate encodes the message so that it fits in size bytes. Whole RRsets
+// are dropped starting from the end of the message. Dropping answer or
+// authority records sets the TC flag while additional records are dropped
+// silently, see [RFC2181 9]. The OPT record is always kept.
+//
+// [RFC2181 9]: https://datatracker.ietf.org/doc/html/rfc2181#section-9
+func (msg *DNSMessage) Truncate(size int) ([]byte, error) {
+	for {
+		buf, err := msg.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) <= size || !msg.dropLastRRset() {
+			return buf, nil
+		}
+	}
+}
+
+// dropLastRRset removes the RRset of the last record of the message. It
+// returns false when there is no record left to remove.
+func (msg *DNSMessage) dropLastRRset() bool {
+	sections := []struct {
+		records *[]DNSAnswer
+		count   *uint16
+		tc      bool
+	}{
+		{&msg.Additionals, &msg.Header.ARCOUNT, false},
+		{&msg.Authorities, &msg.Header.NSCOUNT, true},
+		{&msg.Answers, &msg.Header.ANCOUNT, true},
+	}
+	for _, section := range sections {
+		records := *section.records
+		if len(records) == 0 {
+			continue
+		}
+		last := records[len(records)-1]
+		kept := make([]DNSAnswer, 0, len(records))
+		for _, rr := range records {
+			if rr.Type != last.Type || rr.Class != last.Class || !strings.EqualFold(rr.Name, last.Name) {
+				kept = append(kept, rr)
+			}
+		}
+		*section.count -= uint16(len(records) - len(kept))
+		*section.records = kept
+		if section.tc {
+			msg.Header.Flags.TC = true
+		}
+		return true
+	}
+
+	return false
+}
+
+// UnmarshalBinary decodes a message from its wire format. Malformed messages
+// are reported with one of ErrTruncated, ErrBadPointer, ErrLabelTooLong,
+// ErrNameTooLong, ErrBadRData or ErrBadEDNS.
 func (msg *DNSMessage) UnmarshalBinary(data []byte) error {
-	byteCount := 12
+	byteCount := headerLength
 	r := bytes.NewReader(data)
 	if err := readHeader(r, &msg.Header); err != nil {
 		return err
@@ -242,17 +411,34 @@ func (msg *DNSMessage) UnmarshalBinary(data []byte) error {
 	}
 	byteCount += n
 	msg.Questions = questions
-	answers, _, err := readAnswers(r, byteCount, msg.Header.ANCOUNT)
+	answers, n, err := readAnswers(r, data, byteCount, msg.Header.ANCOUNT)
 	if err != nil {
 		return err
 	}
+	byteCount += n
 	msg.Answers = answers
+	authorities, n, err := readAnswers(r, data, byteCount, msg.Header.NSCOUNT)
+	if err != nil {
+		return err
+	}
+	byteCount += n
+	msg.Authorities = authorities
+	additionals, _, err := readAnswers(r, data, byteCount, msg.Header.ARCOUNT)
+	if err != nil {
+		return err
+	}
+	msg.Additionals = additionals
 
-	return nil
+	return msg.extractEDNS()
 }
 
+// MarshalBinary encodes the message in its wire format. Domain names are
+// compressed across the whole message as described in [RFC1035 4.1.4].
+//
+// [RFC1035 4.1.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
 func (msg DNSMessage) MarshalBinary() ([]byte, error) {
 	var buff bytes.Buffer
+	compression := compressionMap{}
 
 	header, err := msg.Header.MarshalBinary()
 	if err != nil {
@@ -262,20 +448,19 @@ func (msg DNSMessage) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 	for _, q := range msg.Questions {
-		b, err := q.MarshalBinary()
-		if err != nil {
-			return nil, err
-		}
-		if _, err := buff.Write(b); err != nil {
+		if err := q.marshal(&buff, compression); err != nil {
 			return nil, err
 		}
 	}
-	for _, a := range msg.Answers {
-		b, err := a.MarshalBinary()
-		if err != nil {
-			return nil, err
+	for _, section := range [][]DNSAnswer{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, a := range section {
+			if err := a.marshal(&buff, compression); err != nil {
+				return nil, err
+			}
 		}
-		if _, err := buff.Write(b); err != nil {
+	}
+	if msg.EDNS != nil {
+		if err := msg.EDNS.record().marshal(&buff, compression); err != nil {
 			return nil, err
 		}
 	}
@@ -286,29 +471,73 @@ func (msg DNSMessage) MarshalBinary() ([]byte, error) {
 func MarshalDomain(domain string) []byte {
 	var buff bytes.Buffer
 
+	writeDomain(&buff, domain, nil)
+
+	return buff.Bytes()[:buff.Len()]
+}
+
+// maxPointerOffset is the largest offset a compression pointer can hold (14 bits).
+const maxPointerOffset = 0x3FFF
+
+// compressionMap maps domain name suffixes to the offset where they were first
+// written in the message being built.
+type compressionMap map[string]int
+
+// writeDomain appends domain to buff as a sequence of labels. When compression
+// is not nil, the longest suffix already present in the message is replaced by
+// a pointer and every newly written suffix is registered for later names.
+func writeDomain(buff *bytes.Buffer, domain string, compression compressionMap) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" { // Root domain
+		buff.WriteByte(0x0)
+		return
+	}
+
 	labels := strings.Split(domain, ".")
-	for _, label := range labels {
+	for i, label := range labels {
+		if compression != nil {
+			suffix := strings.Join(labels[i:], ".")
+			if offset, ok := compression[suffix]; ok {
+				binary.Write(buff, binary.BigEndian, uint16(0xC000|offset))
+				return
+			}
+			if buff.Len() <= maxPointerOffset {
+				compression[suffix] = buff.Len()
+			}
+		}
 		b := []byte(label)
 		buff.WriteByte(uint8(len(b)))
 		buff.Write(b)
 	}
 	buff.WriteByte(0x0)
-
-	return buff.Bytes()[:buff.Len()]
 }
 
 func UnMarshalDomain(buf []byte) (string, error) {
 	var s strings.Builder
-	var i uint
-	maxLen := uint(len(buf) - 1) // Exclude the 0x00 at the end
+	var i int
 
-	for i < maxLen {
-		strLen := uint(buf[i])
+	for {
+		if i >= len(buf) {
+			return "", ErrTruncated
+		}
+		strLen := int(buf[i])
 		i++
+		if strLen == 0 {
+			break
+		}
+		if strLen > maxLabelLength {
+			return "", ErrLabelTooLong
+		}
+		if i+strLen > len(buf) {
+			return "", ErrTruncated
+		}
+		if s.Len() != 0 {
+			s.WriteRune('.')
+		}
 		s.Write(buf[i : i+strLen])
 		i += strLen
-		if i < maxLen {
-			s.WriteRune('.')
+		if s.Len() > maxNameLength {
+			return "", ErrNameTooLong
 		}
 	}
 
@@ -317,85 +546,100 @@ func UnMarshalDomain(buf []byte) (string, error) {
 
 func readHeader(r io.Reader, header *DNSHeader) error {
 	if err := binary.Read(r, binary.BigEndian, &header.ID); err != nil {
-		return err
+		return truncated(err)
 	}
 	flags := make([]byte, 2)
-	if _, err := r.Read(flags); err != nil {
-		return err
+	if _, err := io.ReadFull(r, flags); err != nil {
+		return truncated(err)
 	}
 	if err := header.Flags.UnmarshalBinary(flags); err != nil {
 		return err
 	}
 	if err := binary.Read(r, binary.BigEndian, &header.QDCOUNT); err != nil {
-		return err
+		return truncated(err)
 	}
 	if err := binary.Read(r, binary.BigEndian, &header.ANCOUNT); err != nil {
-		return err
+		return truncated(err)
 	}
 	if err := binary.Read(r, binary.BigEndian, &header.NSCOUNT); err != nil {
-		return err
+		return truncated(err)
 	}
 	if err := binary.Read(r, binary.BigEndian, &header.ARCOUNT); err != nil {
-		return err
+		return truncated(err)
 	}
 
 	return nil
 }
 
-// readDomain read labels and build the domain. It follows encountered pointers.
-// It stops after encountering either 0x00 or a pointer.
+// readDomain read labels and build the domain starting at pos, the current
+// position of r. It follows encountered pointers and returns the number of
+// bytes the name occupies at pos, which doesn't include bytes read through
+// pointers.
+//
+// Pointers must point strictly before the name that contains them, which
+// rules out forward pointers and loops. Labels and the whole name are bound
+// by the [RFC1035 2.3.4] size limits.
+//
+// [RFC1035 2.3.4]: https://datatracker.ietf.org/doc/html/rfc1035#section-2.3.4
 func readDomain(r *bytes.Reader, pos int) (string, int, error) {
 	byteCount := 0
 	labels := []string{}
+	nameLength := 1 // The terminating root label
+	limit := pos
+	resume := -1
 	log.Println("read domain")
 
 	for {
 		b, err := r.ReadByte()
 		if err != nil {
-			return "", byteCount, fmt.Errorf("failed to read domain head byte: %v", err)
+			return "", byteCount, fmt.Errorf("failed to read domain head byte: %w", truncated(err))
+		}
+		if resume < 0 {
+			byteCount++
 		}
-		byteCount++
 		if b == 0 { // End of domain
 			break
 		}
-		if b >= 192 { // this is a pointer
-			// Discard the readbyte and re-read as a uint16 with the following byte
-			if err := r.UnreadByte(); err != nil {
-				return "", byteCount, fmt.Errorf("failed to unread ptr first byte: %v", err)
+		switch b & 0xC0 {
+		case 0xC0: // this is a pointer
+			low, err := r.ReadByte()
+			if err != nil {
+				return "", byteCount, fmt.Errorf("failed to read pointer bytes: %w", truncated(err))
 			}
-			byteCount--
-			var offset uint16
-			if err := binary.Read(r, binary.BigEndian, &offset); err != nil {
-				return "", byteCount, fmt.Errorf("failed to read pointer bytes: %v", err)
+			offset := int(b&0x3F)<<8 | int(low) // Discard the first 2 bit indicating this is a pointer
+			if offset >= limit {
+				return "", byteCount, fmt.Errorf("%w: offset %d from name at %d", ErrBadPointer, offset, limit)
 			}
-			byteCount += 2
-			offset &= 0x3FFF // Discard the first 2 bit indicating this is a pointer
-			original := pos + byteCount
-			_, err := r.Seek(int64(offset), io.SeekStart)
-			if err != nil {
+			if resume < 0 {
+				byteCount++
+				resume = readerOffset(r)
+			}
+			limit = offset
+			if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
 				return "", byteCount, fmt.Errorf("failed to seek to pointer offset: %v", err)
 			}
-			str, _, err := readDomain(r, int(offset))
-			if err != nil {
-				return "", byteCount, fmt.Errorf("failed to recursively call readDomain: %v", err)
+		case 0x00:
+			buf := make([]byte, b)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return "", byteCount, fmt.Errorf("failed to read label: %w", truncated(err))
 			}
-			_, err = r.Seek(int64(original), io.SeekStart)
-			if err != nil {
-				return "", byteCount, fmt.Errorf("failed to seek back to original position: %v", err)
+			if resume < 0 {
+				byteCount += len(buf)
 			}
-			labels = append(labels, str)
-			break
-		} else {
-			size := b
-			buf := make([]byte, size)
-			n, err := r.Read(buf)
-			if err != nil {
-				return "", byteCount, fmt.Errorf("failed to read label: %v", err)
+			nameLength += len(buf) + 1
+			if nameLength > maxNameLength {
+				return "", byteCount, ErrNameTooLong
 			}
-			byteCount += n
 			labels = append(labels, string(buf))
+		default: // 0x40 and 0x80 would be labels longer than 63 bytes
+			return "", byteCount, fmt.Errorf("%w: length byte %#x", ErrLabelTooLong, b)
 		}
+	}
 
+	if resume >= 0 {
+		if _, err := r.Seek(int64(resume), io.SeekStart); err != nil {
+			return "", byteCount, fmt.Errorf("failed to seek back to original position: %v", err)
+		}
 	}
 
 	s := strings.Join(labels, ".")
@@ -409,17 +653,17 @@ func readQuestion(r *bytes.Reader, pos int) (DNSQuestion, int, error) {
 	if err != nil {
 		return DNSQuestion{}, byteCount, err
 	}
-	byteCount = +n
+	byteCount += n
 
 	question := DNSQuestion{
 		Name: domain,
 	}
 	if err := binary.Read(r, binary.BigEndian, &question.Type); err != nil {
-		return DNSQuestion{}, byteCount, err
+		return DNSQuestion{}, byteCount, truncated(err)
 	}
 	byteCount += 2
 	if err := binary.Read(r, binary.BigEndian, &question.Class); err != nil {
-		return DNSQuestion{}, byteCount, err
+		return DNSQuestion{}, byteCount, truncated(err)
 	}
 	byteCount += 2
 
@@ -427,6 +671,9 @@ func readQuestion(r *bytes.Reader, pos int) (DNSQuestion, int, error) {
 }
 
 func readQuestions(r *bytes.Reader, pos int, qcount uint16) ([]DNSQuestion, int, error) {
+	if int(qcount)*minQuestionLength > r.Len() {
+		return nil, 0, fmt.Errorf("%w: %d questions announced for %d bytes", ErrTruncated, qcount, r.Len())
+	}
 	byteCount := 0
 	questions := make([]DNSQuestion, 0, qcount)
 	for i := 0; i < int(qcount); i++ {
@@ -441,7 +688,9 @@ func readQuestions(r *bytes.Reader, pos int, qcount uint16) ([]DNSQuestion, int,
 	return questions, byteCount, nil
 }
 
-func readAnswer(r *bytes.Reader, pos int) (DNSAnswer, int, error) {
+// readAnswer reads the record at pos, the current position of r in data, the
+// whole message.
+func readAnswer(r *bytes.Reader, data []byte, pos int) (DNSAnswer, int, error) {
 	var answer DNSAnswer
 	byteCount := 0
 	domain, n, err := readDomain(r, pos)
@@ -451,39 +700,54 @@ func readAnswer(r *bytes.Reader, pos int) (DNSAnswer, int, error) {
 	answer.Name = domain
 	byteCount += n
 	if err := binary.Read(r, binary.BigEndian, &answer.Type); err != nil {
-		return DNSAnswer{}, byteCount, err
+		return DNSAnswer{}, byteCount, truncated(err)
 	}
 	byteCount += 2
 	if err := binary.Read(r, binary.BigEndian, &answer.Class); err != nil {
-		return DNSAnswer{}, byteCount, err
+		return DNSAnswer{}, byteCount, truncated(err)
 	}
 	byteCount += 2
 	if err := binary.Read(r, binary.BigEndian, &answer.TTL); err != nil {
-		return DNSAnswer{}, byteCount, err
+		return DNSAnswer{}, byteCount, truncated(err)
 	}
 	byteCount += 4
 
 	var rdLen uint16
 	if err := binary.Read(r, binary.BigEndian, &rdLen); err != nil {
-		return DNSAnswer{}, byteCount, err
+		return DNSAnswer{}, byteCount, truncated(err)
 	}
 	byteCount += 2
+	rdStart := readerOffset(r)
 	buf := make([]byte, rdLen)
-	n, err = r.Read(buf)
+	n, err = io.ReadFull(r, buf)
 	if err != nil {
-		return DNSAnswer{}, byteCount, err
+		return DNSAnswer{}, byteCount, fmt.Errorf("failed to read %d bytes of rdata: %w", rdLen, truncated(err))
 	}
 	byteCount += n
-	answer.Data = buf[:n]
+	answer.Data = buf
+
+	// The message is cut at the end of the RDATA so that decoders can't read
+	// past RDLENGTH
+	rdata := bytes.NewReader(data[:rdStart+n])
+	if _, err := rdata.Seek(int64(rdStart), io.SeekStart); err != nil {
+		return DNSAnswer{}, byteCount, err
+	}
+	answer.RData, err = readRData(rdata, answer.Type, n)
+	if err != nil {
+		return DNSAnswer{}, byteCount, err
+	}
 
 	return answer, byteCount, nil
 }
 
-func readAnswers(r *bytes.Reader, pos int, ancount uint16) ([]DNSAnswer, int, error) {
+func readAnswers(r *bytes.Reader, data []byte, pos int, ancount uint16) ([]DNSAnswer, int, error) {
+	if int(ancount)*minAnswerLength > r.Len() {
+		return nil, 0, fmt.Errorf("%w: %d records announced for %d bytes", ErrTruncated, ancount, r.Len())
+	}
 	byteCount := 0
 	answers := make([]DNSAnswer, ancount)
 	for i := 0; i < int(ancount); i++ {
-		answer, n, err := readAnswer(r, pos+byteCount)
+		answer, n, err := readAnswer(r, data, pos+byteCount)
 		if err != nil {
 			return nil, byteCount, err
 		}
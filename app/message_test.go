@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net"
 	"reflect"
 	"testing"
 
@@ -27,6 +29,23 @@ func TestDNSMessage_Serialize(t *testing.T) {
 			},
 			expected: []byte{0x04, 0xD2, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
 		},
+		{
+			name: "serialize DNSSEC header flags apart from Z",
+			msg: DNSMessage{
+				Header: DNSHeader{
+					ID: 1234,
+					Flags: DNSHeaderFlags{
+						QR: true,
+						RD: true,
+						RA: true,
+						Z:  1,
+						AD: true,
+						CD: true,
+					},
+				},
+			},
+			expected: []byte{0x04, 0xD2, 0x81, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
 		{
 			name: "serialize question section in correct binary representation",
 			msg: DNSMessage{
@@ -85,7 +104,89 @@ func TestDNSMessage_Serialize(t *testing.T) {
 				0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00,
 				0x00, 0x01, 0x00, 0x01,
 				// Answers
+				0xC0, 0x0C, // Pointer to the question name
+				0x0, 0x01, 0x0, 0x01, 0x0, 0x0, 0x0, 0x3C, 0x0, 0x04, 0x08, 0x08, 0x08,
+				0x08,
+			},
+		},
+		{
+			name: "compress repeated suffixes across sections",
+			msg: DNSMessage{
+				Header: DNSHeader{
+					ID: 1234,
+					Flags: DNSHeaderFlags{
+						QR: true,
+					},
+					QDCOUNT: 1,
+					ANCOUNT: 1,
+				},
+				Questions: []DNSQuestion{
+					{
+						Name:  "google.com",
+						Type:  0x01,
+						Class: 0x01,
+					},
+				},
+				Answers: []DNSAnswer{
+					{
+						Name:  "www.google.com",
+						Type:  1,
+						Class: 1,
+						TTL:   60,
+						Data:  []byte{0x8, 0x8, 0x8, 0x8},
+					},
+				},
+			},
+			expected: []byte{
+				// Header
+				0x04, 0xD2, 0x80, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+				// Questions
 				0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00,
+				0x00, 0x01, 0x00, 0x01,
+				// Answers
+				0x03, 0x77, 0x77, 0x77, 0xC0, 0x0C, // www + pointer to google.com
+				0x0, 0x01, 0x0, 0x01, 0x0, 0x0, 0x0, 0x3C, 0x0, 0x04, 0x08, 0x08, 0x08,
+				0x08,
+			},
+		},
+		{
+			name: "serialize authority and additional sections after answers",
+			msg: DNSMessage{
+				Header: DNSHeader{
+					ID: 1234,
+					Flags: DNSHeaderFlags{
+						QR: true,
+					},
+					NSCOUNT: 1,
+					ARCOUNT: 1,
+				},
+				Authorities: []DNSAnswer{
+					{
+						Name:  "com",
+						Type:  2,
+						Class: 1,
+						TTL:   60,
+						Data:  []byte{0x01, 0x61, 0x00},
+					},
+				},
+				Additionals: []DNSAnswer{
+					{
+						Name:  "a",
+						Type:  1,
+						Class: 1,
+						TTL:   60,
+						Data:  []byte{0x8, 0x8, 0x8, 0x8},
+					},
+				},
+			},
+			expected: []byte{
+				// Header
+				0x04, 0xD2, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01,
+				// Authorities
+				0x03, 0x63, 0x6f, 0x6d, 0x00,
+				0x0, 0x02, 0x0, 0x01, 0x0, 0x0, 0x0, 0x3C, 0x0, 0x03, 0x01, 0x61, 0x00,
+				// Additionals
+				0x01, 0x61, 0x00,
 				0x0, 0x01, 0x0, 0x01, 0x0, 0x0, 0x0, 0x3C, 0x0, 0x04, 0x08, 0x08, 0x08,
 				0x08,
 			},
@@ -326,6 +427,7 @@ func TestReadAnswer(t *testing.T) {
 				Class: 1,
 				TTL:   60,
 				Data:  []byte{0x08, 0x08, 0x08, 0x08},
+				RData: &ARecord{IP: net.IP{0x08, 0x08, 0x08, 0x08}},
 			},
 			expectByteReadCount: 26,
 		},
@@ -341,7 +443,7 @@ func TestReadAnswer(t *testing.T) {
 					t.Fatalf("failed to seek to pos when setting up test")
 				}
 			}
-			answer, n, err := readAnswer(r, tc.pos)
+			answer, n, err := readAnswer(r, tc.buf, tc.pos)
 			if err != nil {
 				t.Fatalf("unexpected error: %v\n", err)
 			}
@@ -387,6 +489,7 @@ func TestReadAnswers(t *testing.T) {
 					Class: 1,
 					TTL:   60,
 					Data:  []byte{0x08, 0x08, 0x08, 0x08},
+					RData: &ARecord{IP: net.IP{0x08, 0x08, 0x08, 0x08}},
 				},
 				{
 					Name:  "google.com",
@@ -394,6 +497,7 @@ func TestReadAnswers(t *testing.T) {
 					Class: 1,
 					TTL:   60,
 					Data:  []byte{0x08, 0x08, 0x08, 0x08},
+					RData: &ARecord{IP: net.IP{0x08, 0x08, 0x08, 0x08}},
 				},
 			},
 			expectByteReadCount: 52,
@@ -410,7 +514,7 @@ func TestReadAnswers(t *testing.T) {
 					t.Fatalf("failed to seek to pos when setting up test")
 				}
 			}
-			answers, n, err := readAnswers(r, tc.pos, 2)
+			answers, n, err := readAnswers(r, tc.buf, tc.pos, 2)
 			if err != nil {
 				t.Fatalf("unexpected error: %v\n", err)
 			}
@@ -447,7 +551,9 @@ func TestDNSMessage_MarshalBinary(t *testing.T) {
 				Class: 1,
 			},
 		},
-		Answers: []DNSAnswer{},
+		Answers:     []DNSAnswer{},
+		Authorities: []DNSAnswer{},
+		Additionals: []DNSAnswer{},
 	}
 
 	var request DNSMessage
@@ -458,3 +564,253 @@ func TestDNSMessage_MarshalBinary(t *testing.T) {
 		t.Errorf("result does not match expected output: %s", cmp.Diff(expectedMessage, request))
 	}
 }
+
+func TestDNSMessage_UnmarshalBinary_AllSections(t *testing.T) {
+	expectedMessage := DNSMessage{
+		Header: DNSHeader{
+			ID: 1234,
+			Flags: DNSHeaderFlags{
+				QR: true,
+			},
+			QDCOUNT: 1,
+			ANCOUNT: 1,
+			NSCOUNT: 1,
+			ARCOUNT: 1,
+		},
+		Questions: []DNSQuestion{
+			{Name: "google.com", Type: 1, Class: 1},
+		},
+		Answers: []DNSAnswer{
+			{
+				Name: "google.com", Type: 1, Class: 1, TTL: 60,
+				Data:  []byte{0x08, 0x08, 0x08, 0x08},
+				RData: &ARecord{IP: net.IP{0x08, 0x08, 0x08, 0x08}},
+			},
+		},
+		Authorities: []DNSAnswer{
+			{
+				Name: "com", Type: 2, Class: 1, TTL: 60,
+				Data:  []byte{0x01, 0x61, 0x00},
+				RData: &NSRecord{Host: "a"},
+			},
+		},
+		Additionals: []DNSAnswer{
+			{
+				Name: "a", Type: 1, Class: 1, TTL: 60,
+				Data:  []byte{0x08, 0x08, 0x08, 0x08},
+				RData: &ARecord{IP: net.IP{0x08, 0x08, 0x08, 0x08}},
+			},
+		},
+	}
+
+	buf, err := expectedMessage.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	var msg DNSMessage
+	if err := msg.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("failed to unmarshal message: %v", err)
+	}
+	if !cmp.Equal(expectedMessage, msg) {
+		t.Errorf("result does not match expected output: %s", cmp.Diff(expectedMessage, msg))
+	}
+}
+
+func TestDNSMessage_UnmarshalBinary_Malformed(t *testing.T) {
+	header := func(qdcount, ancount byte) []byte {
+		return []byte{0x04, 0xD2, 0x01, 0x00, 0x00, qdcount, 0x00, ancount, 0x00, 0x00, 0x00, 0x00}
+	}
+	longName := []byte{}
+	for i := 0; i < 5; i++ {
+		longName = append(longName, 63)
+		longName = append(longName, bytes.Repeat([]byte{0x61}, 63)...)
+	}
+	longName = append(longName, 0x00, 0x00, 0x01, 0x00, 0x01)
+
+	tcs := []struct {
+		name        string
+		buf         []byte
+		expectedErr error
+	}{
+		{
+			name:        "truncated header",
+			buf:         []byte{0x04, 0xD2, 0x01},
+			expectedErr: ErrTruncated,
+		},
+		{
+			name:        "truncated question",
+			buf:         append(header(1, 0), 0x06, 0x67, 0x6f, 0x6f),
+			expectedErr: ErrTruncated,
+		},
+		{
+			name:        "more questions announced than bytes",
+			buf:         append(header(0xFF, 0), 0x00, 0x00, 0x01, 0x00, 0x01),
+			expectedErr: ErrTruncated,
+		},
+		{
+			name:        "pointer to itself",
+			buf:         append(header(1, 0), 0xC0, 0x0C, 0x00, 0x01, 0x00, 0x01),
+			expectedErr: ErrBadPointer,
+		},
+		{
+			name:        "forward pointer",
+			buf:         append(header(1, 0), 0xC0, 0x0E, 0x00, 0x00, 0x01, 0x00, 0x01),
+			expectedErr: ErrBadPointer,
+		},
+		{
+			name:        "label longer than 63 bytes",
+			buf:         append(header(1, 0), 0x40, 0x61, 0x00, 0x00, 0x01, 0x00, 0x01),
+			expectedErr: ErrLabelTooLong,
+		},
+		{
+			name:        "name longer than 255 bytes",
+			buf:         append(header(1, 0), longName...),
+			expectedErr: ErrNameTooLong,
+		},
+		{
+			name: "truncated rdata",
+			buf: append(header(0, 1),
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x04, 0x08, 0x08,
+			),
+			expectedErr: ErrTruncated,
+		},
+		{
+			name: "rdata not matching its type",
+			buf: append(header(0, 1),
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x02, 0x08, 0x08,
+			),
+			expectedErr: ErrBadRData,
+		},
+		{
+			name: "CAA tag longer than its rdata",
+			buf: append(header(0, 2),
+				0x00, 0x01, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x02, 0x00, 0x05,
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x04, 0x08, 0x08, 0x08, 0x08,
+			),
+			expectedErr: ErrBadRData,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var msg DNSMessage
+			err := msg.UnmarshalBinary(tc.buf)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("expected error %v but got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDNSMessage_Truncate(t *testing.T) {
+	record := func(name string, rrType uint16, rdata RData) DNSAnswer {
+		return DNSAnswer{Name: name, Type: rrType, Class: INRecordClass, TTL: 60, RData: rdata}
+	}
+	txt := func(n int) RData {
+		return &TXTRecord{Texts: []string{string(bytes.Repeat([]byte{0x61}, n))}}
+	}
+	newMessage := func() *DNSMessage {
+		msg := &DNSMessage{}
+		msg.AddQuestions(DNSQuestion{Name: "example.com", Type: TXTRecordType, Class: INRecordClass})
+		msg.AddAnswers(
+			record("example.com", TXTRecordType, txt(200)),
+			record("example.com", TXTRecordType, txt(200)),
+		)
+		msg.AddAuthorities(record("example.com", NSRecordType, &NSRecord{Host: "ns.example.com"}))
+		msg.AddAdditionals(record("ns.example.com", ARecordType, &ARecord{IP: net.IP{192, 0, 2, 1}}))
+		msg.SetEDNS(&EDNS{UDPSize: 512})
+		return msg
+	}
+
+	tcs := []struct {
+		name                string
+		size                int
+		expectedAnswers     int
+		expectedAuthorities int
+		expectedAdditionals int
+		expectedTC          bool
+	}{
+		{
+			name:                "message fits",
+			size:                4096,
+			expectedAnswers:     2,
+			expectedAuthorities: 1,
+			expectedAdditionals: 1,
+		},
+		{
+			name:                "drop additional records silently",
+			size:                490,
+			expectedAnswers:     2,
+			expectedAuthorities: 1,
+			expectedAdditionals: 0,
+		},
+		{
+			name:                "drop the whole answer RRset",
+			size:                400,
+			expectedAnswers:     0,
+			expectedAuthorities: 0,
+			expectedAdditionals: 0,
+			expectedTC:          true,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			msg := newMessage()
+			buf, err := msg.Truncate(tc.size)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(buf) > tc.size {
+				t.Errorf("expected at most %d bytes but got %d", tc.size, len(buf))
+			}
+
+			var result DNSMessage
+			if err := result.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("truncated message is not parseable: %v", err)
+			}
+			if len(result.Answers) != tc.expectedAnswers ||
+				len(result.Authorities) != tc.expectedAuthorities ||
+				len(result.Additionals) != tc.expectedAdditionals {
+				t.Errorf(
+					"expected %d/%d/%d records but got %d/%d/%d",
+					tc.expectedAnswers, tc.expectedAuthorities, tc.expectedAdditionals,
+					len(result.Answers), len(result.Authorities), len(result.Additionals),
+				)
+			}
+			if result.Header.Flags.TC != tc.expectedTC {
+				t.Errorf("expected TC to be %v", tc.expectedTC)
+			}
+			if result.EDNS == nil {
+				t.Errorf("expected OPT record to be kept")
+			}
+		})
+	}
+}
+
+func TestDNSHeaderFlags_UnmarshalBinary(t *testing.T) {
+	tcs := []struct {
+		name     string
+		data     []byte
+		expected DNSHeaderFlags
+	}{
+		{name: "authentic data", data: []byte{0x81, 0xA0}, expected: DNSHeaderFlags{QR: true, RD: true, RA: true, AD: true}},
+		{name: "checking disabled", data: []byte{0x01, 0x10}, expected: DNSHeaderFlags{RD: true, CD: true}},
+		{name: "reserved bit", data: []byte{0x00, 0x40}, expected: DNSHeaderFlags{Z: 1}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var flags DNSHeaderFlags
+			if err := flags.UnmarshalBinary(tc.data); err != nil {
+				t.Fatalf("failed to unmarshal flags: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, flags); diff != "" {
+				t.Errorf("flags do not match: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// notifyAttempts is how many times a NOTIFY message is sent to a secondary
+// that doesn't answer.
+const notifyAttempts = 5
+
+// Notifier announces the changes of zones to their secondaries with NOTIFY
+// messages so that they refresh them without waiting for their refresh
+// interval.
+// See [RFC1996 3]
+// [RFC1996 3]: https://datatracker.ietf.org/doc/html/rfc1996#section-3
+type Notifier struct {
+	// secondaries holds the secondaries of each zone.
+	secondaries map[string][]notifyTarget
+	timeout     time.Duration
+}
+
+// notifyTarget is a secondary notified of the changes of a zone.
+type notifyTarget struct {
+	addr string
+	// key signs the NOTIFY messages when it is not nil.
+	key *TSIGKey
+}
+
+// NewNotifier creates a notifier from origin=secondaries values, where
+// secondaries is a comma separated list of secondary addresses, each
+// optionally followed by /name to sign the messages with the key of keys
+// with that name.
+func NewNotifier(values []string, keys map[string]*TSIGKey, timeout time.Duration) (*Notifier, error) {
+	n := &Notifier{secondaries: map[string][]notifyTarget{}, timeout: timeout}
+	for _, value := range values {
+		origin, secondaries, _ := strings.Cut(value, "=")
+		origin = canonicalName(origin)
+		for _, secondary := range strings.Split(secondaries, ",") {
+			addr, keyName, _ := strings.Cut(strings.TrimSpace(secondary), "/")
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid secondary address %q for %s: %v", addr, fqdn(origin), err)
+			}
+			key, err := keyNamed(keys, keyName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid secondary %q for %s: %v", secondary, fqdn(origin), err)
+			}
+			n.secondaries[origin] = append(n.secondaries[origin], notifyTarget{addr: addr, key: key})
+		}
+	}
+	return n, nil
+}
+
+// ZoneChanged sends NOTIFY messages for zone to its secondaries in the
+// background.
+func (n *Notifier) ZoneChanged(zone *Zone) {
+	for _, target := range n.secondaries[zone.Origin] {
+		go n.notify(target, zone)
+	}
+}
+
+// notify sends a NOTIFY message carrying the SOA record of zone to target
+// until it is acknowledged. The message is sent again when no response
+// arrives in time.
+// See [RFC1996 3.6]
+// [RFC1996 3.6]: https://datatracker.ietf.org/doc/html/rfc1996#section-3.6
+func (n *Notifier) notify(target notifyTarget, zone *Zone) {
+	req := &DNSMessage{}
+	req.Header.Flags.OPCODE = NotifyOpCode
+	req.Header.Flags.AA = true
+	req.AddQuestions(DNSQuestion{Name: zone.Origin, Type: SOARecordType, Class: INRecordClass})
+	req.AddAnswers(zone.SOA())
+
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		resp, err := exchange(target.addr, req, n.timeout, target.key)
+		if err != nil {
+			log.Printf("failed to notify %s of zone %s (attempt %d): %v", target.addr, fqdn(zone.Origin), attempt, err)
+			continue
+		}
+		if resp.Header.Flags.RCODE != NoErrorResponseCode {
+			log.Printf("%s refused the notification of zone %s with RCODE %d", target.addr, fqdn(zone.Origin), resp.Header.Flags.RCODE)
+		}
+		return
+	}
+}
+
+// notify answers a NOTIFY message from client by scheduling the refresh of
+// the zone it names, provided that the server is a secondary of the zone and
+// client its primary. The message must be signed, key being the key it was
+// signed with, when the zone is transferred with a TSIG key.
+// See [RFC1996 3.7]
+// [RFC1996 3.7]: https://datatracker.ietf.org/doc/html/rfc1996#section-3.7
+func (h *Handler) notify(req *DNSMessage, client net.Addr, key *TSIGKey) [][]byte {
+	// Acknowledgements are only expected by the socket that sent the NOTIFY
+	if req.Header.Flags.QR {
+		return nil
+	}
+
+	resp := CreateResponse(req)
+	resp.Header.Flags.RCODE = NoErrorResponseCode
+	if len(req.Questions) != 1 || req.Questions[0].Type != SOARecordType {
+		resp.Header.Flags.RCODE = FormatErrorResponseCode
+	} else {
+		origin := canonicalName(req.Questions[0].Name)
+		secondary := h.secondaries[origin]
+		if secondary == nil || !secondary.isPrimary(client) || !secondary.signedBy(key) {
+			log.Printf("refusing notification of zone %s from %s", fqdn(origin), client)
+			resp.Header.Flags.RCODE = RefusedResponseCode
+		} else {
+			log.Printf("zone %s changed on %s, refreshing it", fqdn(origin), client)
+			resp.Header.Flags.AA = true
+			secondary.Notify()
+		}
+	}
+
+	response, err := resp.MarshalBinary()
+	if err != nil {
+		log.Printf("failed to marshal notify response: %v", err)
+		return nil
+	}
+	return [][]byte{response}
+}
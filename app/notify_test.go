@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	received := make(chan *DNSMessage, 1)
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		received <- req
+		resp := CreateResponse(req)
+		resp.Header.Flags.RCODE = NoErrorResponseCode
+		return []*DNSMessage{resp}
+	})
+	notifier, err := NewNotifier([]string{"example.com=" + addr}, nil, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create notifier: %v", err)
+	}
+	zones := NewZoneStore()
+	zones.Watch(notifier.ZoneChanged)
+	zones.Add(newTestZone(t, "example.com", versionedZone(7, "3600 600 86400 300", "")))
+	zones.Add(newTestZone(t, "example.net", versionedZone(1, "3600 600 86400 300", "")))
+
+	select {
+	case req := <-received:
+		if req.Header.Flags.OPCODE != NotifyOpCode {
+			t.Errorf("expected OPCODE %d but got %d", NotifyOpCode, req.Header.Flags.OPCODE)
+		}
+		if len(req.Questions) != 1 || req.Questions[0].Name != "example.com" || req.Questions[0].Type != SOARecordType {
+			t.Errorf("expected the SOA question of example.com but got %+v", req.Questions)
+		}
+		if len(req.Answers) != 1 || soaSerial(req.Answers[0]) != 7 {
+			t.Errorf("expected the SOA record with serial 7 but got %+v", req.Answers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a NOTIFY message")
+	}
+	select {
+	case req := <-received:
+		t.Errorf("expected a single NOTIFY message but got %+v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandler_Notify(t *testing.T) {
+	primary := &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 5353}
+
+	tcs := []struct {
+		name           string
+		origin         string
+		qtype          uint16
+		client         net.Addr
+		expectedRCODE  uint16
+		expectedNotify bool
+	}{
+		{
+			name:           "from the primary",
+			origin:         "Example.com.",
+			qtype:          SOARecordType,
+			client:         primary,
+			expectedRCODE:  NoErrorResponseCode,
+			expectedNotify: true,
+		},
+		{
+			name:          "from another server",
+			origin:        "example.com",
+			qtype:         SOARecordType,
+			client:        &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 53},
+			expectedRCODE: RefusedResponseCode,
+		},
+		{
+			name:          "zone without primary",
+			origin:        "example.net",
+			qtype:         SOARecordType,
+			client:        primary,
+			expectedRCODE: RefusedResponseCode,
+		},
+		{
+			name:          "not about the SOA record",
+			origin:        "example.com",
+			qtype:         ARecordType,
+			client:        primary,
+			expectedRCODE: FormatErrorResponseCode,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			secondary := &Secondary{origin: "example.com", primary: "192.0.2.1:53", notify: make(chan struct{}, 1)}
+			handler := &Handler{secondaries: map[string]*Secondary{"example.com": secondary}}
+
+			req := newQuery(tc.origin, tc.qtype)
+			req.Header.Flags.OPCODE = NotifyOpCode
+			buf, err := req.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			responses := handler.handleRequest(buf, tc.client, true)
+			if len(responses) != 1 {
+				t.Fatalf("expected a single response but got %d", len(responses))
+			}
+			var resp DNSMessage
+			if err := resp.UnmarshalBinary(responses[0]); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if !resp.Header.Flags.QR || resp.Header.Flags.OPCODE != NotifyOpCode {
+				t.Errorf("expected a NOTIFY response but got %+v", resp.Header.Flags)
+			}
+			if resp.Header.Flags.RCODE != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+			}
+			if notified := len(secondary.notify) == 1; notified != tc.expectedNotify {
+				t.Errorf("expected refresh scheduled %v but got %v", tc.expectedNotify, notified)
+			}
+		})
+	}
+}
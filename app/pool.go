@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategies selecting the order in which a ResolverPool tries its upstreams.
+const (
+	// SequentialStrategy always tries upstreams in their configured order.
+	SequentialStrategy = "sequential"
+	// RoundRobinStrategy starts with the next upstream for every request.
+	RoundRobinStrategy = "round-robin"
+	// RandomStrategy tries upstreams in a random order.
+	RandomStrategy = "random"
+	// FastestStrategy tries upstreams by increasing smoothed round trip time.
+	FastestStrategy = "fastest"
+)
+
+const (
+	// maxUpstreamFailures is the number of consecutive failures after which an
+	// upstream is considered dead.
+	maxUpstreamFailures = 3
+	// probeInterval is how often dead upstreams are probed.
+	probeInterval = 10 * time.Second
+)
+
+// poolUpstream is an upstream of a ResolverPool along with its health.
+type poolUpstream struct {
+	resolver *Resolver
+
+	mu       sync.Mutex
+	srtt     time.Duration
+	failures int
+}
+
+// recordSuccess updates the smoothed round trip time with rtt and clears the
+// failure count.
+func (u *poolUpstream) recordSuccess(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+	u.updateSRTT(rtt)
+}
+
+// recordFailure counts a failure, penalizing the smoothed round trip time as
+// if the upstream answered right at the timeout.
+func (u *poolUpstream) recordFailure() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	u.updateSRTT(u.resolver.timeout)
+	if u.failures == maxUpstreamFailures {
+		log.Printf("upstream %s marked as dead after %d failures", u.resolver.serverUDPAddr, u.failures)
+	}
+}
+
+func (u *poolUpstream) updateSRTT(rtt time.Duration) {
+	if u.srtt == 0 {
+		u.srtt = rtt
+		return
+	}
+	u.srtt = u.srtt*7/8 + rtt/8
+}
+
+func (u *poolUpstream) isDead() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.failures >= maxUpstreamFailures
+}
+
+func (u *poolUpstream) SRTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.srtt
+}
+
+// ResolverPool forwards requests to a list of upstream servers, failing over
+// to the next one when an upstream errors or answers SERVFAIL. Upstreams
+// failing repeatedly are skipped until a periodic probe succeeds.
+type ResolverPool struct {
+	upstreams []*poolUpstream
+	strategy  string
+
+	mu   sync.Mutex
+	next int
+	rng  *rand.Rand
+
+	done chan struct{}
+}
+
+// NewResolverPool creates a pool from upstream specs of the form
+// "address[/timeout]", for example "8.8.8.8:53/500ms". Upstreams without a
+// timeout use defaultTimeout.
+func NewResolverPool(specs []string, strategy string, defaultTimeout time.Duration) (*ResolverPool, error) {
+	switch strategy {
+	case SequentialStrategy, RoundRobinStrategy, RandomStrategy, FastestStrategy:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy: %q", strategy)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no upstream configured")
+	}
+
+	p := &ResolverPool{
+		strategy: strategy,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:     make(chan struct{}),
+	}
+	for _, spec := range specs {
+		addr, timeout, err := parseUpstreamSpec(spec, defaultTimeout)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		resolver, err := NewResolver(addr)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to create resolver for address %s: %w", addr, err)
+		}
+		resolver.timeout = timeout
+		p.upstreams = append(p.upstreams, &poolUpstream{resolver: resolver})
+	}
+	go p.probeLoop(probeInterval)
+
+	return p, nil
+}
+
+// parseUpstreamSpec splits an "address[/timeout]" upstream spec.
+func parseUpstreamSpec(spec string, defaultTimeout time.Duration) (string, time.Duration, error) {
+	spec = strings.TrimSpace(spec)
+	addr, rawTimeout, found := strings.Cut(spec, "/")
+	if !found {
+		return addr, defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(rawTimeout)
+	if err != nil || timeout <= 0 {
+		return "", 0, fmt.Errorf("invalid timeout for upstream %s: %q", addr, rawTimeout)
+	}
+	return addr, timeout, nil
+}
+
+// SetTSIGKey makes every upstream of the pool sign its requests with key. It
+// must be called before the pool is used.
+func (p *ResolverPool) SetTSIGKey(key *TSIGKey) {
+	for _, u := range p.upstreams {
+		u.resolver.SetTSIGKey(key)
+	}
+}
+
+func (p *ResolverPool) Close() error {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	for _, u := range p.upstreams {
+		u.resolver.Close()
+	}
+	return nil
+}
+
+func (p *ResolverPool) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	var lastResp *DNSMessage
+	var lastErr error
+
+	for _, u := range p.order() {
+		start := time.Now()
+		resp, err := u.resolver.SendRequest(msg)
+		if err != nil {
+			log.Printf("upstream %s failed: %v", u.resolver.serverUDPAddr, err)
+			u.recordFailure()
+			lastErr = err
+			continue
+		}
+		if resp.RCODE() == ServerFailureResponseCode {
+			u.recordFailure()
+			lastResp, lastErr = resp, nil
+			continue
+		}
+		u.recordSuccess(time.Since(start))
+		return resp, nil
+	}
+
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, fmt.Errorf("all upstreams failed: %w", lastErr)
+}
+
+// order returns the upstreams in the order they must be tried for a request.
+// Dead upstreams are left out unless every upstream is dead.
+func (p *ResolverPool) order() []*poolUpstream {
+	upstreams := make([]*poolUpstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !u.isDead() {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = append(upstreams, p.upstreams...)
+	}
+
+	switch p.strategy {
+	case RoundRobinStrategy:
+		p.mu.Lock()
+		start := p.next % len(upstreams)
+		p.next++
+		p.mu.Unlock()
+		upstreams = append(upstreams[start:], upstreams[:start]...)
+	case RandomStrategy:
+		p.mu.Lock()
+		p.rng.Shuffle(len(upstreams), func(i, j int) {
+			upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+		})
+		p.mu.Unlock()
+	case FastestStrategy:
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return upstreams[i].SRTT() < upstreams[j].SRTT()
+		})
+	}
+
+	return upstreams
+}
+
+// probeLoop periodically sends a query for the root NS records to dead
+// upstreams and brings them back once they answer.
+func (p *ResolverPool) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.probe()
+		}
+	}
+}
+
+func (p *ResolverPool) probe() {
+	for _, u := range p.upstreams {
+		if !u.isDead() {
+			continue
+		}
+		probe := &DNSMessage{}
+		probe.AddQuestions(DNSQuestion{Name: "", Type: NSRecordType, Class: INRecordClass})
+		start := time.Now()
+		if _, err := u.resolver.SendRequest(probe); err != nil {
+			log.Printf("upstream %s is still dead: %v", u.resolver.serverUDPAddr, err)
+			continue
+		}
+		log.Printf("upstream %s is back", u.resolver.serverUDPAddr)
+		u.recordSuccess(time.Since(start))
+	}
+}
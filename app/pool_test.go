@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreamSpec(t *testing.T) {
+	tcs := []struct {
+		name            string
+		spec            string
+		expectedAddr    string
+		expectedTimeout time.Duration
+		expectedErr     bool
+	}{
+		{name: "default timeout", spec: "8.8.8.8:53", expectedAddr: "8.8.8.8:53", expectedTimeout: time.Second},
+		{name: "custom timeout", spec: " 1.1.1.1:53/500ms", expectedAddr: "1.1.1.1:53", expectedTimeout: 500 * time.Millisecond},
+		{name: "invalid timeout", spec: "1.1.1.1:53/soon", expectedErr: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			addr, timeout, err := parseUpstreamSpec(tc.spec, time.Second)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if addr != tc.expectedAddr || timeout != tc.expectedTimeout {
+				t.Errorf("expected %s/%v but got %s/%v", tc.expectedAddr, tc.expectedTimeout, addr, timeout)
+			}
+		})
+	}
+}
+
+// countingServer starts a fake server answering every request with ip and
+// counting the requests it received.
+func countingServer(t *testing.T, ip net.IP, count *int32) string {
+	return startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		atomic.AddInt32(count, 1)
+		return []*DNSMessage{answerA(req, ip)}
+	})
+}
+
+func TestResolverPool_FailsOverAndMarksDeadUpstreams(t *testing.T) {
+	var deadCalls, aliveCalls int32
+	dead := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		atomic.AddInt32(&deadCalls, 1)
+		return nil
+	})
+	alive := countingServer(t, net.IP{10, 0, 0, 1}, &aliveCalls)
+
+	pool, err := NewResolverPool([]string{dead + "/50ms", alive}, SequentialStrategy, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	for i := 0; i < maxUpstreamFailures+2; i++ {
+		resp, err := pool.SendRequest(newQuery("example.com", ARecordType))
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+		if len(resp.Answers) != 1 {
+			t.Fatalf("expected one answer but got %+v", resp.Answers)
+		}
+	}
+
+	if got := atomic.LoadInt32(&deadCalls); got != maxUpstreamFailures {
+		t.Errorf("expected dead upstream to be skipped after %d failures but it got %d requests", maxUpstreamFailures, got)
+	}
+	if got := atomic.LoadInt32(&aliveCalls); got != maxUpstreamFailures+2 {
+		t.Errorf("expected %d requests on the alive upstream but got %d", maxUpstreamFailures+2, got)
+	}
+}
+
+func TestResolverPool_ProbesDeadUpstreams(t *testing.T) {
+	var healthy int32
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return nil
+		}
+		return []*DNSMessage{CreateResponse(req)}
+	})
+
+	pool, err := NewResolverPool([]string{addr + "/50ms"}, SequentialStrategy, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	for i := 0; i < maxUpstreamFailures; i++ {
+		if _, err := pool.SendRequest(newQuery("example.com", ARecordType)); err == nil {
+			t.Fatalf("expected request %d to fail", i)
+		}
+	}
+	if !pool.upstreams[0].isDead() {
+		t.Fatalf("expected upstream to be marked as dead")
+	}
+
+	pool.probe()
+	if !pool.upstreams[0].isDead() {
+		t.Fatalf("expected upstream to stay dead while it does not answer")
+	}
+	atomic.StoreInt32(&healthy, 1)
+	pool.probe()
+	if pool.upstreams[0].isDead() {
+		t.Errorf("expected upstream to be alive after a successful probe")
+	}
+}
+
+func TestResolverPool_Strategies(t *testing.T) {
+	tcs := []struct {
+		name     string
+		strategy string
+		prepare  func(pool *ResolverPool)
+		expected [2]int32
+	}{
+		{name: "sequential", strategy: SequentialStrategy, expected: [2]int32{4, 0}},
+		{name: "round robin", strategy: RoundRobinStrategy, expected: [2]int32{2, 2}},
+		{
+			name:     "fastest",
+			strategy: FastestStrategy,
+			prepare: func(pool *ResolverPool) {
+				pool.upstreams[0].recordSuccess(100 * time.Millisecond)
+				pool.upstreams[1].recordSuccess(time.Millisecond)
+			},
+			expected: [2]int32{0, 4},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var calls [2]int32
+			first := countingServer(t, net.IP{10, 0, 0, 1}, &calls[0])
+			second := countingServer(t, net.IP{10, 0, 0, 2}, &calls[1])
+
+			pool, err := NewResolverPool([]string{first, second}, tc.strategy, time.Second)
+			if err != nil {
+				t.Fatalf("failed to create pool: %v", err)
+			}
+			defer pool.Close()
+			if tc.prepare != nil {
+				tc.prepare(pool)
+			}
+
+			for i := 0; i < 4; i++ {
+				if _, err := pool.SendRequest(newQuery("example.com", ARecordType)); err != nil {
+					t.Fatalf("request %d failed: %v", i, err)
+				}
+			}
+			got := [2]int32{atomic.LoadInt32(&calls[0]), atomic.LoadInt32(&calls[1])}
+			if got != tc.expected {
+				t.Errorf("expected requests per upstream %v but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestResolverPool_FallsBackToServerFailure(t *testing.T) {
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		resp := CreateResponse(req)
+		resp.Header.Flags.RCODE = ServerFailureResponseCode
+		return []*DNSMessage{resp}
+	})
+
+	pool, err := NewResolverPool([]string{addr}, SequentialStrategy, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer pool.Close()
+
+	resp, err := pool.SendRequest(newQuery("example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.RCODE() != ServerFailureResponseCode {
+		t.Errorf("expected RCODE %d but got %d", ServerFailureResponseCode, resp.RCODE())
+	}
+}
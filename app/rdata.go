@@ -0,0 +1,989 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RData is the typed representation of the RDATA section of a resource record.
+// Records whose type has no RData implementation keep their raw bytes in
+// DNSAnswer.Data.
+type RData interface {
+	// Type returns the record TYPE this data belongs to.
+	Type() uint16
+	// String returns the data in zone file presentation format.
+	String() string
+
+	// marshal appends the RDATA wire format to buff. Embedded domain names may
+	// be compressed against compression when it is not nil.
+	marshal(buff *bytes.Buffer, compression compressionMap) error
+	// unmarshal decodes length bytes of RDATA from r. r spans the message up
+	// to the end of the RDATA so that compressed domain names can be
+	// followed but the record can't be read past.
+	unmarshal(r *bytes.Reader, length int) error
+}
+
+// newRData returns an empty RData for the given record type or nil when the
+// type is not supported.
+func newRData(rrType uint16) RData {
+	switch rrType {
+	case ARecordType:
+		return &ARecord{}
+	case NSRecordType:
+		return &NSRecord{}
+	case CNAMERecordType:
+		return &CNAMERecord{}
+	case SOARecordType:
+		return &SOARecord{}
+	case PTRRecordType:
+		return &PTRRecord{}
+	case MXRecordType:
+		return &MXRecord{}
+	case TXTRecordType:
+		return &TXTRecord{}
+	case AAAARecordType:
+		return &AAAARecord{}
+	case SRVRecordType:
+		return &SRVRecord{}
+	case DNAMERecordType:
+		return &DNAMERecord{}
+	case CAARecordType:
+		return &CAARecord{}
+	case TSIGRecordType:
+		return &TSIGRecord{}
+	case DNSKEYRecordType:
+		return &DNSKEYRecord{}
+	case RRSIGRecordType:
+		return &RRSIGRecord{}
+	case DSRecordType:
+		return &DSRecord{}
+	case NSECRecordType:
+		return &NSECRecord{}
+	case NSEC3RecordType:
+		return &NSEC3Record{}
+	case NSEC3PARAMRecordType:
+		return &NSEC3PARAMRecord{}
+	}
+	return nil
+}
+
+// readRData decodes the RDATA of a record of type rrType starting at the
+// current position of r, which must end with the RDATA: decoding past its
+// end is reported as ErrBadRData. It returns nil without error for
+// unsupported types.
+func readRData(r *bytes.Reader, rrType uint16, length int) (RData, error) {
+	rdata := newRData(rrType)
+	if rdata == nil || length == 0 {
+		return nil, nil
+	}
+	start := readerOffset(r)
+	if err := rdata.unmarshal(r, length); err != nil {
+		if errors.Is(err, ErrBadPointer) ||
+			errors.Is(err, ErrLabelTooLong) || errors.Is(err, ErrNameTooLong) {
+			return nil, fmt.Errorf("failed to decode type %d rdata: %w", rrType, err)
+		}
+		return nil, fmt.Errorf("%w: failed to decode type %d rdata: %v", ErrBadRData, rrType, truncated(err))
+	}
+	if read := readerOffset(r) - start; read != length {
+		return nil, fmt.Errorf("%w: type %d rdata is %d bytes long but %d were decoded", ErrBadRData, rrType, length, read)
+	}
+
+	return rdata, nil
+}
+
+// readerOffset returns the current position of r from the start of its data.
+func readerOffset(r *bytes.Reader) int {
+	return int(r.Size()) - r.Len()
+}
+
+// fqdn returns name in its fully qualified presentation form, with the
+// trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// readRDataDomain reads a possibly compressed domain name embedded in RDATA.
+func readRDataDomain(r *bytes.Reader) (string, error) {
+	name, _, err := readDomain(r, readerOffset(r))
+	return name, err
+}
+
+// ARecord holds a host IPv4 address.
+// See [RFC1035 3.4.1]
+//
+// [RFC1035 3.4.1]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.4.1
+type ARecord struct {
+	IP net.IP
+}
+
+func (rd *ARecord) Type() uint16 { return ARecordType }
+
+func (rd *ARecord) String() string { return rd.IP.String() }
+
+func (rd *ARecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	ip := rd.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("invalid IPv4 address: %v", rd.IP)
+	}
+	buff.Write(ip)
+	return nil
+}
+
+func (rd *ARecord) unmarshal(r *bytes.Reader, length int) error {
+	if length != net.IPv4len {
+		return fmt.Errorf("invalid A record length: %d", length)
+	}
+	rd.IP = make(net.IP, net.IPv4len)
+	_, err := io.ReadFull(r, rd.IP)
+	return err
+}
+
+// AAAARecord holds a host IPv6 address.
+// See [RFC3596 2.2]
+//
+// [RFC3596 2.2]: https://datatracker.ietf.org/doc/html/rfc3596#section-2.2
+type AAAARecord struct {
+	IP net.IP
+}
+
+func (rd *AAAARecord) Type() uint16 { return AAAARecordType }
+
+func (rd *AAAARecord) String() string { return rd.IP.String() }
+
+func (rd *AAAARecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	ip := rd.IP.To16()
+	if ip == nil {
+		return fmt.Errorf("invalid IPv6 address: %v", rd.IP)
+	}
+	buff.Write(ip)
+	return nil
+}
+
+func (rd *AAAARecord) unmarshal(r *bytes.Reader, length int) error {
+	if length != net.IPv6len {
+		return fmt.Errorf("invalid AAAA record length: %d", length)
+	}
+	rd.IP = make(net.IP, net.IPv6len)
+	_, err := io.ReadFull(r, rd.IP)
+	return err
+}
+
+// CNAMERecord holds the canonical name of an alias.
+// See [RFC1035 3.3.1]
+//
+// [RFC1035 3.3.1]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.1
+type CNAMERecord struct {
+	Target string
+}
+
+func (rd *CNAMERecord) Type() uint16 { return CNAMERecordType }
+
+func (rd *CNAMERecord) String() string { return fqdn(rd.Target) }
+
+func (rd *CNAMERecord) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	writeDomain(buff, rd.Target, compression)
+	return nil
+}
+
+func (rd *CNAMERecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	rd.Target, err = readRDataDomain(r)
+	return err
+}
+
+// NSRecord holds the name of an authoritative name server.
+// See [RFC1035 3.3.11]
+//
+// [RFC1035 3.3.11]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.11
+type NSRecord struct {
+	Host string
+}
+
+func (rd *NSRecord) Type() uint16 { return NSRecordType }
+
+func (rd *NSRecord) String() string { return fqdn(rd.Host) }
+
+func (rd *NSRecord) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	writeDomain(buff, rd.Host, compression)
+	return nil
+}
+
+func (rd *NSRecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	rd.Host, err = readRDataDomain(r)
+	return err
+}
+
+// PTRRecord holds a pointer to another location of the domain name space.
+// See [RFC1035 3.3.12]
+//
+// [RFC1035 3.3.12]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.12
+type PTRRecord struct {
+	Target string
+}
+
+func (rd *PTRRecord) Type() uint16 { return PTRRecordType }
+
+func (rd *PTRRecord) String() string { return fqdn(rd.Target) }
+
+func (rd *PTRRecord) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	writeDomain(buff, rd.Target, compression)
+	return nil
+}
+
+func (rd *PTRRecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	rd.Target, err = readRDataDomain(r)
+	return err
+}
+
+// MXRecord holds a mail exchange for the owner name.
+// See [RFC1035 3.3.9]
+//
+// [RFC1035 3.3.9]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.9
+type MXRecord struct {
+	Preference uint16
+	Exchange   string
+}
+
+func (rd *MXRecord) Type() uint16 { return MXRecordType }
+
+func (rd *MXRecord) String() string {
+	return fmt.Sprintf("%d %s", rd.Preference, fqdn(rd.Exchange))
+}
+
+func (rd *MXRecord) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	binary.Write(buff, binary.BigEndian, rd.Preference)
+	writeDomain(buff, rd.Exchange, compression)
+	return nil
+}
+
+func (rd *MXRecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	if err := binary.Read(r, binary.BigEndian, &rd.Preference); err != nil {
+		return err
+	}
+	rd.Exchange, err = readRDataDomain(r)
+	return err
+}
+
+// TXTRecord holds one or more character strings.
+// See [RFC1035 3.3.14]
+//
+// [RFC1035 3.3.14]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.14
+type TXTRecord struct {
+	Texts []string
+}
+
+func (rd *TXTRecord) Type() uint16 { return TXTRecordType }
+
+func (rd *TXTRecord) String() string {
+	texts := make([]string, 0, len(rd.Texts))
+	for _, text := range rd.Texts {
+		texts = append(texts, strconv.Quote(text))
+	}
+	return strings.Join(texts, " ")
+}
+
+func (rd *TXTRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	for _, text := range rd.Texts {
+		if err := writeCharacterString(buff, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rd *TXTRecord) unmarshal(r *bytes.Reader, length int) error {
+	rd.Texts = nil
+	end := readerOffset(r) + length
+	for readerOffset(r) < end {
+		text, err := readCharacterString(r)
+		if err != nil {
+			return err
+		}
+		rd.Texts = append(rd.Texts, text)
+	}
+	return nil
+}
+
+// SOARecord marks the start of a zone of authority.
+// See [RFC1035 3.3.13]
+//
+// [RFC1035 3.3.13]: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.13
+type SOARecord struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (rd *SOARecord) Type() uint16 { return SOARecordType }
+
+func (rd *SOARecord) String() string {
+	return fmt.Sprintf(
+		"%s %s %d %d %d %d %d",
+		fqdn(rd.MName), fqdn(rd.RName), rd.Serial, rd.Refresh, rd.Retry, rd.Expire, rd.Minimum,
+	)
+}
+
+func (rd *SOARecord) marshal(buff *bytes.Buffer, compression compressionMap) error {
+	writeDomain(buff, rd.MName, compression)
+	writeDomain(buff, rd.RName, compression)
+	for _, v := range []uint32{rd.Serial, rd.Refresh, rd.Retry, rd.Expire, rd.Minimum} {
+		binary.Write(buff, binary.BigEndian, v)
+	}
+	return nil
+}
+
+func (rd *SOARecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	if rd.MName, err = readRDataDomain(r); err != nil {
+		return err
+	}
+	if rd.RName, err = readRDataDomain(r); err != nil {
+		return err
+	}
+	for _, v := range []*uint32{&rd.Serial, &rd.Refresh, &rd.Retry, &rd.Expire, &rd.Minimum} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SRVRecord holds the location of a service. Its target is never compressed.
+// See [RFC2782]
+//
+// [RFC2782]: https://datatracker.ietf.org/doc/html/rfc2782
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (rd *SRVRecord) Type() uint16 { return SRVRecordType }
+
+func (rd *SRVRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.Priority, rd.Weight, rd.Port, fqdn(rd.Target))
+}
+
+func (rd *SRVRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	for _, v := range []uint16{rd.Priority, rd.Weight, rd.Port} {
+		binary.Write(buff, binary.BigEndian, v)
+	}
+	writeDomain(buff, rd.Target, nil)
+	return nil
+}
+
+func (rd *SRVRecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	for _, v := range []*uint16{&rd.Priority, &rd.Weight, &rd.Port} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	rd.Target, err = readRDataDomain(r)
+	return err
+}
+
+// DNAMERecord redirects a whole subtree of the domain name space to another
+// domain. Its target is never compressed.
+// See [RFC6672 2.1]
+//
+// [RFC6672 2.1]: https://datatracker.ietf.org/doc/html/rfc6672#section-2.1
+type DNAMERecord struct {
+	Target string
+}
+
+func (rd *DNAMERecord) Type() uint16 { return DNAMERecordType }
+
+func (rd *DNAMERecord) String() string { return fqdn(rd.Target) }
+
+func (rd *DNAMERecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	writeDomain(buff, rd.Target, nil)
+	return nil
+}
+
+func (rd *DNAMERecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	rd.Target, err = readRDataDomain(r)
+	return err
+}
+
+// CAARecord restricts which certification authorities may issue certificates
+// for the owner name.
+// See [RFC8659 4.1]
+//
+// [RFC8659 4.1]: https://datatracker.ietf.org/doc/html/rfc8659#section-4.1
+type CAARecord struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (rd *CAARecord) Type() uint16 { return CAARecordType }
+
+func (rd *CAARecord) String() string {
+	return fmt.Sprintf("%d %s %s", rd.Flags, rd.Tag, strconv.Quote(rd.Value))
+}
+
+func (rd *CAARecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	buff.WriteByte(rd.Flags)
+	if err := writeCharacterString(buff, rd.Tag); err != nil {
+		return err
+	}
+	buff.WriteString(rd.Value)
+	return nil
+}
+
+func (rd *CAARecord) unmarshal(r *bytes.Reader, length int) (err error) {
+	end := readerOffset(r) + length
+	if rd.Flags, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if rd.Tag, err = readCharacterString(r); err != nil {
+		return err
+	}
+	if readerOffset(r) > end {
+		return fmt.Errorf("CAA tag of %d bytes overflows the record", len(rd.Tag))
+	}
+	value, err := readBytesUntil(r, end)
+	if err != nil {
+		return err
+	}
+	rd.Value = string(value)
+	return nil
+}
+
+// TSIGRecord holds the signature of a message, which is the last record of
+// its additional section. Its algorithm name is never compressed.
+// See [RFC8945 4.2]
+//
+// [RFC8945 4.2]: https://datatracker.ietf.org/doc/html/rfc8945#section-4.2
+type TSIGRecord struct {
+	Algorithm string
+	// TimeSigned is the number of seconds since the epoch, on 48 bits.
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	OtherData  []byte
+}
+
+func (rd *TSIGRecord) Type() uint16 { return TSIGRecordType }
+
+func (rd *TSIGRecord) String() string {
+	return fmt.Sprintf(
+		"%s %d %d %d %s %d %d %d %s",
+		fqdn(rd.Algorithm), rd.TimeSigned, rd.Fudge, len(rd.MAC), base64.StdEncoding.EncodeToString(rd.MAC),
+		rd.OriginalID, rd.Error, len(rd.OtherData), base64.StdEncoding.EncodeToString(rd.OtherData),
+	)
+}
+
+func (rd *TSIGRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	if rd.TimeSigned >= 1<<48 || len(rd.MAC) > 0xFFFF || len(rd.OtherData) > 0xFFFF {
+		return fmt.Errorf("invalid TSIG record fields")
+	}
+	writeDomain(buff, rd.Algorithm, nil)
+	binary.Write(buff, binary.BigEndian, uint16(rd.TimeSigned>>32))
+	binary.Write(buff, binary.BigEndian, uint32(rd.TimeSigned))
+	binary.Write(buff, binary.BigEndian, rd.Fudge)
+	binary.Write(buff, binary.BigEndian, uint16(len(rd.MAC)))
+	buff.Write(rd.MAC)
+	binary.Write(buff, binary.BigEndian, rd.OriginalID)
+	binary.Write(buff, binary.BigEndian, rd.Error)
+	binary.Write(buff, binary.BigEndian, uint16(len(rd.OtherData)))
+	buff.Write(rd.OtherData)
+	return nil
+}
+
+func (rd *TSIGRecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	if rd.Algorithm, err = readRDataDomain(r); err != nil {
+		return err
+	}
+	var high uint16
+	var low uint32
+	if err := binary.Read(r, binary.BigEndian, &high); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &low); err != nil {
+		return err
+	}
+	rd.TimeSigned = uint64(high)<<32 | uint64(low)
+	if err := binary.Read(r, binary.BigEndian, &rd.Fudge); err != nil {
+		return err
+	}
+	if rd.MAC, err = readUint16Bytes(r); err != nil {
+		return err
+	}
+	for _, v := range []*uint16{&rd.OriginalID, &rd.Error} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	rd.OtherData, err = readUint16Bytes(r)
+	return err
+}
+
+// readUint16Bytes reads bytes prefixed by their 2 bytes length.
+func readUint16Bytes(r *bytes.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeCharacterString appends a length prefixed <character-string>.
+func writeCharacterString(buff *bytes.Buffer, s string) error {
+	if len(s) > 255 {
+		return fmt.Errorf("character string longer than 255 bytes: %d", len(s))
+	}
+	buff.WriteByte(uint8(len(s)))
+	buff.WriteString(s)
+	return nil
+}
+
+// readCharacterString reads a length prefixed <character-string>.
+func readCharacterString(r *bytes.Reader) (string, error) {
+	size, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// DNSKEYRecord holds a public key signing the records of a zone.
+// See [RFC4034 2.1]
+//
+// [RFC4034 2.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-2.1
+type DNSKEYRecord struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (rd *DNSKEYRecord) Type() uint16 { return DNSKEYRecordType }
+
+func (rd *DNSKEYRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.Flags, rd.Protocol, rd.Algorithm, base64.StdEncoding.EncodeToString(rd.PublicKey))
+}
+
+func (rd *DNSKEYRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	binary.Write(buff, binary.BigEndian, rd.Flags)
+	buff.WriteByte(rd.Protocol)
+	buff.WriteByte(rd.Algorithm)
+	buff.Write(rd.PublicKey)
+	return nil
+}
+
+func (rd *DNSKEYRecord) unmarshal(r *bytes.Reader, length int) (err error) {
+	end := readerOffset(r) + length
+	if err := binary.Read(r, binary.BigEndian, &rd.Flags); err != nil {
+		return err
+	}
+	if rd.Protocol, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if rd.Algorithm, err = r.ReadByte(); err != nil {
+		return err
+	}
+	rd.PublicKey, err = readBytesUntil(r, end)
+	return err
+}
+
+// KeyTag returns the tag identifying the key in RRSIG and DS records.
+// See [RFC4034 B]
+//
+// [RFC4034 B]: https://datatracker.ietf.org/doc/html/rfc4034#appendix-B
+func (rd *DNSKEYRecord) KeyTag() uint16 {
+	var buff bytes.Buffer
+	rd.marshal(&buff, nil)
+	var ac uint32
+	for i, b := range buff.Bytes() {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += (ac >> 16) & 0xFFFF
+	return uint16(ac)
+}
+
+// RRSIGRecord holds the signature of an RRset. Its signer name is never
+// compressed. Inception and Expiration are numbers of seconds since the epoch
+// compared with serial number arithmetic.
+// See [RFC4034 3.1]
+//
+// [RFC4034 3.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.1
+type RRSIGRecord struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func (rd *RRSIGRecord) Type() uint16 { return RRSIGRecordType }
+
+func (rd *RRSIGRecord) String() string {
+	return fmt.Sprintf(
+		"%s %d %d %d %s %s %d %s %s",
+		recordTypeName(rd.TypeCovered), rd.Algorithm, rd.Labels, rd.OriginalTTL,
+		formatSignatureTime(rd.Expiration), formatSignatureTime(rd.Inception), rd.KeyTag,
+		fqdn(rd.SignerName), base64.StdEncoding.EncodeToString(rd.Signature),
+	)
+}
+
+func (rd *RRSIGRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	binary.Write(buff, binary.BigEndian, rd.TypeCovered)
+	buff.WriteByte(rd.Algorithm)
+	buff.WriteByte(rd.Labels)
+	for _, v := range []uint32{rd.OriginalTTL, rd.Expiration, rd.Inception} {
+		binary.Write(buff, binary.BigEndian, v)
+	}
+	binary.Write(buff, binary.BigEndian, rd.KeyTag)
+	writeDomain(buff, rd.SignerName, nil)
+	buff.Write(rd.Signature)
+	return nil
+}
+
+func (rd *RRSIGRecord) unmarshal(r *bytes.Reader, length int) (err error) {
+	end := readerOffset(r) + length
+	if err := binary.Read(r, binary.BigEndian, &rd.TypeCovered); err != nil {
+		return err
+	}
+	if rd.Algorithm, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if rd.Labels, err = r.ReadByte(); err != nil {
+		return err
+	}
+	for _, v := range []*uint32{&rd.OriginalTTL, &rd.Expiration, &rd.Inception} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	if err := binary.Read(r, binary.BigEndian, &rd.KeyTag); err != nil {
+		return err
+	}
+	if rd.SignerName, err = readRDataDomain(r); err != nil {
+		return err
+	}
+	rd.Signature, err = readBytesUntil(r, end)
+	return err
+}
+
+// signatureTimeLayout is the presentation format of the inception and
+// expiration of RRSIG records.
+// See [RFC4034 3.2]
+//
+// [RFC4034 3.2]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.2
+const signatureTimeLayout = "20060102150405"
+
+func formatSignatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(signatureTimeLayout)
+}
+
+// DSRecord holds the digest of the DNSKEY record of a delegated zone, which
+// is stored in the parent zone.
+// See [RFC4034 5.1]
+//
+// [RFC4034 5.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-5.1
+type DSRecord struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (rd *DSRecord) Type() uint16 { return DSRecordType }
+
+func (rd *DSRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.KeyTag, rd.Algorithm, rd.DigestType, strings.ToUpper(hex.EncodeToString(rd.Digest)))
+}
+
+func (rd *DSRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	binary.Write(buff, binary.BigEndian, rd.KeyTag)
+	buff.WriteByte(rd.Algorithm)
+	buff.WriteByte(rd.DigestType)
+	buff.Write(rd.Digest)
+	return nil
+}
+
+func (rd *DSRecord) unmarshal(r *bytes.Reader, length int) (err error) {
+	end := readerOffset(r) + length
+	if err := binary.Read(r, binary.BigEndian, &rd.KeyTag); err != nil {
+		return err
+	}
+	if rd.Algorithm, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if rd.DigestType, err = r.ReadByte(); err != nil {
+		return err
+	}
+	rd.Digest, err = readBytesUntil(r, end)
+	return err
+}
+
+// NSECRecord proves that no name exists between its owner and the next name
+// of the zone in canonical order, and which types its owner has. Its next
+// domain name is never compressed.
+// See [RFC4034 4.1]
+//
+// [RFC4034 4.1]: https://datatracker.ietf.org/doc/html/rfc4034#section-4.1
+type NSECRecord struct {
+	NextDomain string
+	Types      []uint16
+}
+
+func (rd *NSECRecord) Type() uint16 { return NSECRecordType }
+
+func (rd *NSECRecord) String() string {
+	return strings.Join(append([]string{fqdn(rd.NextDomain)}, typeNames(rd.Types)...), " ")
+}
+
+func (rd *NSECRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	writeDomain(buff, rd.NextDomain, nil)
+	writeTypeBitmap(buff, rd.Types)
+	return nil
+}
+
+func (rd *NSECRecord) unmarshal(r *bytes.Reader, length int) (err error) {
+	end := readerOffset(r) + length
+	if rd.NextDomain, err = readRDataDomain(r); err != nil {
+		return err
+	}
+	rd.Types, err = readTypeBitmap(r, end)
+	return err
+}
+
+// NSEC3Record is the NSEC record of hashed owner names: it proves that no
+// name hashes between the hash in its owner name and NextHashed.
+// See [RFC5155 3.2]
+//
+// [RFC5155 3.2]: https://datatracker.ietf.org/doc/html/rfc5155#section-3.2
+type NSEC3Record struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []uint16
+}
+
+func (rd *NSEC3Record) Type() uint16 { return NSEC3RecordType }
+
+func (rd *NSEC3Record) String() string {
+	fields := []string{
+		fmt.Sprintf("%d %d %d %s", rd.HashAlgorithm, rd.Flags, rd.Iterations, formatSalt(rd.Salt)),
+		nsec3Encoding.EncodeToString(rd.NextHashed),
+	}
+	return strings.Join(append(fields, typeNames(rd.Types)...), " ")
+}
+
+func (rd *NSEC3Record) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	if len(rd.Salt) > 255 || len(rd.NextHashed) > 255 {
+		return fmt.Errorf("invalid NSEC3 record fields")
+	}
+	buff.WriteByte(rd.HashAlgorithm)
+	buff.WriteByte(rd.Flags)
+	binary.Write(buff, binary.BigEndian, rd.Iterations)
+	buff.WriteByte(uint8(len(rd.Salt)))
+	buff.Write(rd.Salt)
+	buff.WriteByte(uint8(len(rd.NextHashed)))
+	buff.Write(rd.NextHashed)
+	writeTypeBitmap(buff, rd.Types)
+	return nil
+}
+
+func (rd *NSEC3Record) unmarshal(r *bytes.Reader, length int) (err error) {
+	end := readerOffset(r) + length
+	if rd.HashAlgorithm, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if rd.Flags, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &rd.Iterations); err != nil {
+		return err
+	}
+	if rd.Salt, err = readUint8Bytes(r); err != nil {
+		return err
+	}
+	if rd.NextHashed, err = readUint8Bytes(r); err != nil {
+		return err
+	}
+	rd.Types, err = readTypeBitmap(r, end)
+	return err
+}
+
+// NSEC3PARAMRecord holds the parameters authoritative servers hash names
+// with to find the NSEC3 records proving their absence.
+// See [RFC5155 4.2]
+//
+// [RFC5155 4.2]: https://datatracker.ietf.org/doc/html/rfc5155#section-4.2
+type NSEC3PARAMRecord struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+}
+
+func (rd *NSEC3PARAMRecord) Type() uint16 { return NSEC3PARAMRecordType }
+
+func (rd *NSEC3PARAMRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.HashAlgorithm, rd.Flags, rd.Iterations, formatSalt(rd.Salt))
+}
+
+func (rd *NSEC3PARAMRecord) marshal(buff *bytes.Buffer, _ compressionMap) error {
+	if len(rd.Salt) > 255 {
+		return fmt.Errorf("salt longer than 255 bytes: %d", len(rd.Salt))
+	}
+	buff.WriteByte(rd.HashAlgorithm)
+	buff.WriteByte(rd.Flags)
+	binary.Write(buff, binary.BigEndian, rd.Iterations)
+	buff.WriteByte(uint8(len(rd.Salt)))
+	buff.Write(rd.Salt)
+	return nil
+}
+
+func (rd *NSEC3PARAMRecord) unmarshal(r *bytes.Reader, _ int) (err error) {
+	if rd.HashAlgorithm, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if rd.Flags, err = r.ReadByte(); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &rd.Iterations); err != nil {
+		return err
+	}
+	rd.Salt, err = readUint8Bytes(r)
+	return err
+}
+
+// nsec3Encoding is the Base32 encoding with extended hex alphabet of hashed
+// owner names.
+// See [RFC5155 3.3]
+//
+// [RFC5155 3.3]: https://datatracker.ietf.org/doc/html/rfc5155#section-3.3
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// formatSalt returns the presentation format of an NSEC3 salt, - when empty.
+func formatSalt(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+// writeTypeBitmap appends the type bit maps of NSEC and NSEC3 records: the
+// types are grouped in windows of 256 types, each holding a bitmap of up to
+// 32 bytes.
+// See [RFC4034 4.1.2]
+//
+// [RFC4034 4.1.2]: https://datatracker.ietf.org/doc/html/rfc4034#section-4.1.2
+func writeTypeBitmap(buff *bytes.Buffer, types []uint16) {
+	var windows [256][32]byte
+	var lengths [256]int
+	for _, t := range types {
+		window, bit := t>>8, t&0xFF
+		windows[window][bit/8] |= 0x80 >> (bit % 8)
+		if int(bit/8)+1 > lengths[window] {
+			lengths[window] = int(bit/8) + 1
+		}
+	}
+	for window, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		buff.WriteByte(uint8(window))
+		buff.WriteByte(uint8(length))
+		buff.Write(windows[window][:length])
+	}
+}
+
+// readTypeBitmap reads type bit maps up to the offset end of r and returns
+// the types in ascending order.
+func readTypeBitmap(r *bytes.Reader, end int) ([]uint16, error) {
+	var types []uint16
+	last := -1
+	for readerOffset(r) < end {
+		window, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if int(window) <= last || length == 0 || length > 32 {
+			return nil, fmt.Errorf("invalid type bitmap window %d of length %d", window, length)
+		}
+		last = int(window)
+		bitmap := make([]byte, length)
+		if _, err := io.ReadFull(r, bitmap); err != nil {
+			return nil, err
+		}
+		for i, b := range bitmap {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, uint16(window)<<8|uint16(i*8+bit))
+				}
+			}
+		}
+	}
+	return types, nil
+}
+
+// readUint8Bytes reads bytes prefixed by their 1 byte length.
+func readUint8Bytes(r *bytes.Reader) ([]byte, error) {
+	size, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readBytesUntil reads the bytes of r up to the offset end, which ends the
+// RDATA.
+func readBytesUntil(r *bytes.Reader, end int) ([]byte, error) {
+	if end < readerOffset(r) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, end-readerOffset(r))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// rdataSamples holds a record of every supported type.
+var rdataSamples = []struct {
+	name  string
+	rdata RData
+}{
+	{name: "A", rdata: &ARecord{IP: net.IP{192, 0, 2, 1}}},
+	{name: "AAAA", rdata: &AAAARecord{IP: net.ParseIP("2001:db8::1")}},
+	{name: "CNAME", rdata: &CNAMERecord{Target: "www.example.com"}},
+	{name: "DNAME", rdata: &DNAMERecord{Target: "example.net"}},
+	{name: "NS", rdata: &NSRecord{Host: "ns1.example.com"}},
+	{name: "PTR", rdata: &PTRRecord{Target: "host.example.com"}},
+	{name: "MX", rdata: &MXRecord{Preference: 10, Exchange: "mail.example.com"}},
+	{name: "TXT", rdata: &TXTRecord{Texts: []string{"v=spf1 -all", ""}}},
+	{
+		name: "SOA",
+		rdata: &SOARecord{
+			MName:   "ns1.example.com",
+			RName:   "hostmaster.example.com",
+			Serial:  2024010101,
+			Refresh: 7200,
+			Retry:   3600,
+			Expire:  1209600,
+			Minimum: 300,
+		},
+	},
+	{name: "SRV", rdata: &SRVRecord{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example.com"}},
+	{name: "CAA", rdata: &CAARecord{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}},
+	{
+		name: "TSIG",
+		rdata: &TSIGRecord{
+			Algorithm:  HMACSHA256,
+			TimeSigned: 1700000000,
+			Fudge:      300,
+			MAC:        []byte{0xde, 0xad, 0xbe, 0xef},
+			OriginalID: 42,
+			Error:      BadTimeResponseCode,
+			OtherData:  []byte{0, 0, 0x65, 0x53, 0xf1, 0x00},
+		},
+	},
+	{name: "DNSKEY", rdata: &DNSKEYRecord{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte{1, 2, 3, 4}}},
+	{
+		name: "RRSIG",
+		rdata: &RRSIGRecord{
+			TypeCovered: ARecordType,
+			Algorithm:   13,
+			Labels:      2,
+			OriginalTTL: 3600,
+			Expiration:  1700003600,
+			Inception:   1700000000,
+			KeyTag:      12345,
+			SignerName:  "example.com",
+			Signature:   []byte{0xde, 0xad, 0xbe, 0xef},
+		},
+	},
+	{name: "DS", rdata: &DSRecord{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: []byte{0xca, 0xfe}}},
+	{
+		name:  "NSEC",
+		rdata: &NSECRecord{NextDomain: "www.example.com", Types: []uint16{ARecordType, RRSIGRecordType, NSECRecordType, CAARecordType}},
+	},
+	{
+		name: "NSEC3",
+		rdata: &NSEC3Record{
+			HashAlgorithm: 1,
+			Flags:         1,
+			Iterations:    10,
+			Salt:          []byte{0xab, 0xcd},
+			NextHashed:    []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+			Types:         []uint16{ARecordType, NSRecordType, SOARecordType, RRSIGRecordType, DNSKEYRecordType, NSEC3PARAMRecordType},
+		},
+	},
+	{name: "NSEC3PARAM", rdata: &NSEC3PARAMRecord{HashAlgorithm: 1, Iterations: 10, Salt: []byte{0xab, 0xcd}}},
+}
+
+func TestRData_RoundTrip(t *testing.T) {
+	for _, tc := range rdataSamples {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			msg := DNSMessage{}
+			msg.AddQuestions(DNSQuestion{Name: "example.com", Type: tc.rdata.Type(), Class: INRecordClass})
+			msg.AddAnswers(DNSAnswer{
+				Name:  "example.com",
+				Type:  tc.rdata.Type(),
+				Class: INRecordClass,
+				TTL:   60,
+				RData: tc.rdata,
+			})
+
+			buf, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal message: %v", err)
+			}
+			var result DNSMessage
+			if err := result.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("failed to unmarshal message: %v", err)
+			}
+			if len(result.Answers) != 1 {
+				t.Fatalf("expected 1 answer but got %d", len(result.Answers))
+			}
+			if !cmp.Equal(tc.rdata, result.Answers[0].RData) {
+				t.Errorf("rdata does not match: %s", cmp.Diff(tc.rdata, result.Answers[0].RData))
+			}
+		})
+	}
+}
+
+func TestRData_TruncatedRData(t *testing.T) {
+	for rrType := 0; rrType <= 0xFFFF; rrType++ {
+		if newRData(uint16(rrType)) == nil {
+			continue
+		}
+		found := false
+		for _, tc := range rdataSamples {
+			found = found || tc.rdata.Type() == uint16(rrType)
+		}
+		if !found {
+			t.Errorf("no sample of type %d", rrType)
+		}
+	}
+
+	// A record for the root name following the truncated one, whose bytes
+	// must not be decoded as part of its RDATA
+	next := []byte{0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x04, 0xFF, 0xFF, 0xFF, 0xFF}
+	for _, tc := range rdataSamples {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			msg := DNSMessage{}
+			msg.AddQuestions(DNSQuestion{Name: "example.com", Type: tc.rdata.Type(), Class: INRecordClass})
+			msg.AddAnswers(DNSAnswer{Name: "example.com", Type: tc.rdata.Type(), Class: INRecordClass, TTL: 60, RData: tc.rdata})
+			buf, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal message: %v", err)
+			}
+			var decoded DNSMessage
+			if err := decoded.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("failed to unmarshal message: %v", err)
+			}
+			// The record is the last of the message
+			rdStart := len(buf) - len(decoded.Answers[0].Data)
+
+			// Empty RDATA is valid, UPDATE requests use it to delete RRsets
+			for length := 1; length < len(decoded.Answers[0].Data); length++ {
+				truncated := append([]byte{}, buf[:rdStart+length]...)
+				truncated = append(truncated, next...)
+				binary.BigEndian.PutUint16(truncated[6:], 2)
+				binary.BigEndian.PutUint16(truncated[rdStart-2:], uint16(length))
+
+				var result DNSMessage
+				err := result.UnmarshalBinary(truncated)
+				if err == nil {
+					// Cuts between fields of variable length, such as keys
+					// and signatures, leave the encoding of a shorter record
+					var encoded bytes.Buffer
+					if err := result.Answers[0].RData.marshal(&encoded, nil); err != nil {
+						t.Fatalf("failed to marshal rdata: %v", err)
+					}
+					if !bytes.Equal(encoded.Bytes(), buf[rdStart:rdStart+length]) {
+						t.Errorf("expected %d bytes of rdata to be rejected but got %v", length, result.Answers[0].RData)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrBadRData) {
+					t.Errorf("expected %d bytes of rdata to be bad rdata but got %v", length, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRData_DecompressNames(t *testing.T) {
+	buf := []byte{
+		0x04, 0xD2, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, // Header
+		0x03, 0x77, 0x77, 0x77, 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00, // www.google.com
+		0x00, 0x05, 0x00, 0x01, // TYPE = CNAME, CLASS = IN
+		0xC0, 0x0C, // Pointer to www.google.com
+		0x00, 0x05, 0x00, 0x01, // TYPE = CNAME, CLASS = IN
+		0x00, 0x00, 0x00, 0x3C, // TTL = 60
+		0x00, 0x06, // RDLENGTH = 6
+		0x03, 0x66, 0x6f, 0x6f, 0xC0, 0x10, // foo + pointer to google.com
+	}
+
+	var msg DNSMessage
+	if err := msg.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("failed to unmarshal message: %v", err)
+	}
+	expected := &CNAMERecord{Target: "foo.google.com"}
+	if !cmp.Equal(expected, msg.Answers[0].RData) {
+		t.Errorf("rdata does not match: %s", cmp.Diff(expected, msg.Answers[0].RData))
+	}
+}
+
+func TestRData_UnknownTypeKeepsRawData(t *testing.T) {
+	answer := DNSAnswer{Name: "example.com", Type: 65280, Class: INRecordClass, TTL: 60, Data: []byte{0x01, 0x02}}
+
+	buf, err := answer.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal answer: %v", err)
+	}
+	result, _, err := readAnswer(bytes.NewReader(buf), buf, 0)
+	if err != nil {
+		t.Fatalf("failed to read answer: %v", err)
+	}
+	if result.RData != nil {
+		t.Errorf("expected no rdata for unknown type but got %v", result.RData)
+	}
+	if !bytes.Equal(answer.Data, result.Data) {
+		t.Errorf("expected data %x but got %x", answer.Data, result.Data)
+	}
+}
+
+func TestDNSKEYRecord_KeyTag(t *testing.T) {
+	// 0x0101 + 0x030D + 0x0102 + 0x0304 summed as 16 bits words
+	key := &DNSKEYRecord{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte{1, 2, 3, 4}}
+	if tag := key.KeyTag(); tag != 0x0814 {
+		t.Errorf("expected key tag %d but got %d", 0x0814, tag)
+	}
+}
+
+func TestRData_BadTypeBitmap(t *testing.T) {
+	tcs := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty window", data: []byte{0x00, 0x00}},
+		{name: "window longer than 32 bytes", data: append([]byte{0x00, 33}, make([]byte, 33)...)},
+		{name: "windows out of order", data: []byte{0x01, 0x01, 0x80, 0x00, 0x01, 0x40}},
+		{name: "truncated window", data: []byte{0x00, 0x02, 0x40}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// NSEC record for the root name followed by the bitmap
+			data := append([]byte{0x00}, tc.data...)
+			if _, err := readRData(bytes.NewReader(data), NSECRecordType, len(data)); !errors.Is(err, ErrBadRData) && !errors.Is(err, ErrTruncated) {
+				t.Errorf("expected a decoding error but got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ForwardMode sends every question to the configured resolvers.
+	ForwardMode = "forward"
+	// RecursiveMode resolves questions iteratively starting from the root
+	// servers.
+	RecursiveMode = "recursive"
+)
+
+// defaultRootHints are the addresses of the root servers.
+// See [root hints]
+// [root hints]: https://www.internic.net/domain/named.root
+const defaultRootHints = "198.41.0.4,170.247.170.2,192.33.4.12,199.7.91.13,192.203.230.10,192.5.5.241," +
+	"192.112.36.4,198.97.190.53,192.36.148.17,192.58.128.30,193.0.14.129,199.7.83.42,202.12.27.33"
+
+const (
+	// maxReferrals is the number of referrals followed for a single question.
+	maxReferrals = 16
+	// maxCNAMEChain is the number of aliases followed for a single question.
+	maxCNAMEChain = 8
+	// maxRecursionDepth limits the nested resolutions of name server
+	// addresses.
+	maxRecursionDepth = 4
+	// maxDelegations is the number of delegations kept in memory.
+	maxDelegations = 10000
+)
+
+var ErrResolutionLoop = errors.New("resolution exceeded its limits")
+
+// delegation is a zone along with the addresses of its name servers.
+type delegation struct {
+	zone      string
+	servers   []string
+	expiresAt time.Time
+}
+
+// RecursiveResolver answers questions by walking the DNS tree from the root
+// servers, following referrals down to the authoritative servers. The
+// delegations learnt on the way are cached until their NS records expire.
+type RecursiveResolver struct {
+	rootServers []string
+	// port is the port every name server is queried on.
+	port    string
+	timeout time.Duration
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+	now         func() time.Time
+}
+
+// NewRecursiveResolver creates a resolver starting from the root servers at
+// the rootHints IP addresses, querying each server for at most timeout.
+func NewRecursiveResolver(rootHints []string, timeout time.Duration) (*RecursiveResolver, error) {
+	r := &RecursiveResolver{
+		port:        "53",
+		timeout:     timeout,
+		delegations: map[string]*delegation{},
+		now:         time.Now,
+	}
+	for _, hint := range rootHints {
+		ip := net.ParseIP(strings.TrimSpace(hint))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid root hint: %q", hint)
+		}
+		r.rootServers = append(r.rootServers, ip.String())
+	}
+	if len(r.rootServers) == 0 {
+		return nil, fmt.Errorf("no root hint configured")
+	}
+	return r, nil
+}
+
+func (r *RecursiveResolver) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	resp := CreateResponse(msg)
+	resp.Header.Flags.RA = true
+	if len(msg.Questions) == 0 {
+		return resp, nil
+	}
+
+	result, err := r.resolve(msg.Questions[0], 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.AddAnswers(result.Answers...)
+	resp.AddAuthorities(result.Authorities...)
+	resp.Header.Flags.RCODE = result.Header.Flags.RCODE
+	return resp, nil
+}
+
+// resolve answers q, following the CNAME records leading to other names. The
+// returned message holds the whole chain of answers and, for negative
+// answers, the authority section of the last response.
+func (r *RecursiveResolver) resolve(q DNSQuestion, depth int) (*DNSMessage, error) {
+	if depth > maxRecursionDepth {
+		return nil, fmt.Errorf("failed to resolve %s: %w", q.Name, ErrResolutionLoop)
+	}
+
+	result := &DNSMessage{}
+	name := q.Name
+	seen := map[string]bool{}
+	for {
+		seen[canonicalName(name)] = true
+		resp, err := r.query(DNSQuestion{Name: name, Type: q.Type, Class: q.Class}, depth)
+		if err != nil {
+			return nil, err
+		}
+		result.Header.Flags.RCODE = resp.Header.Flags.RCODE
+
+		target, found := followAnswers(result, resp, name, q.Type)
+		if found || resp.Header.Flags.RCODE != NoErrorResponseCode || strings.EqualFold(target, name) {
+			result.AddAuthorities(resp.Authorities...)
+			return result, nil
+		}
+		// The alias leads to a name the server is not authoritative for
+		if seen[canonicalName(target)] || len(seen) > maxCNAMEChain {
+			return nil, fmt.Errorf("failed to resolve %s: CNAME chain too long: %w", q.Name, ErrResolutionLoop)
+		}
+		name = target
+	}
+}
+
+// followAnswers adds the records of resp answering name to result, following
+// the CNAME records found along the way. The RRSIG records covering them and
+// the DNAME records the aliases are synthesized from are kept for
+// validation. It returns the last name reached and whether records of type
+// rrType were found for it.
+func followAnswers(result, resp *DNSMessage, name string, rrType uint16) (string, bool) {
+	for aliases := 0; aliases <= maxCNAMEChain; aliases++ {
+		var found bool
+		for _, rr := range resp.Answers {
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			if rr.Type == rrType || rrType == ANYRecordType {
+				result.AddAnswers(rr)
+				found = true
+			} else if signs(rr, rrType) {
+				result.AddAnswers(rr)
+			}
+		}
+		if found {
+			return name, true
+		}
+
+		var cname *CNAMERecord
+		for _, rr := range resp.Answers {
+			if c, ok := rr.RData.(*CNAMERecord); ok && strings.EqualFold(rr.Name, name) {
+				cname = c
+				break
+			}
+		}
+		if cname == nil {
+			return name, false
+		}
+		for _, rr := range resp.Answers {
+			owner := canonicalName(rr.Name)
+			switch {
+			case (rr.Type == DNAMERecordType || signs(rr, DNAMERecordType)) &&
+				owner != canonicalName(name) && inZone(canonicalName(name), owner):
+				result.AddAnswers(rr)
+			case (rr.Type == CNAMERecordType || signs(rr, CNAMERecordType)) && owner == canonicalName(name):
+				result.AddAnswers(rr)
+			}
+		}
+		name = cname.Target
+	}
+	return name, false
+}
+
+// signs reports whether rr is an RRSIG record covering records of type
+// rrType.
+func signs(rr DNSAnswer, rrType uint16) bool {
+	sig, ok := rr.RData.(*RRSIGRecord)
+	return ok && sig.TypeCovered == rrType
+}
+
+// query asks the name servers closest to q.Name for q, following referrals
+// until it reaches a server that answers it.
+func (r *RecursiveResolver) query(q DNSQuestion, depth int) (*DNSMessage, error) {
+	// The DS records of a zone are served by its parent
+	// See [RFC4035 3.1.4.1]
+	// [RFC4035 3.1.4.1]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.1.4.1
+	name := canonicalName(q.Name)
+	if q.Type == DSRecordType {
+		name = parentName(name)
+	}
+	current := r.closestDelegation(name)
+
+	for referrals := 0; referrals < maxReferrals; referrals++ {
+		req := &DNSMessage{}
+		req.AddQuestions(q)
+		req.SetEDNS(&EDNS{UDPSize: maxUDPSize, DO: true})
+		resp, err := r.ask(current, req)
+		if err != nil {
+			return nil, err
+		}
+
+		next, ttl := referral(resp, q.Name, current.zone)
+		if len(resp.Answers) > 0 || resp.Header.Flags.AA ||
+			resp.Header.Flags.RCODE != NoErrorResponseCode || next == nil ||
+			q.Type == DSRecordType && next.zone == canonicalName(q.Name) {
+			return resp, nil
+		}
+
+		next.servers = r.nameServerAddresses(resp, next, current.zone, depth)
+		if len(next.servers) == 0 {
+			return nil, fmt.Errorf("failed to find the address of any name server of %s", next.zone)
+		}
+		r.storeDelegation(next, ttl)
+		log.Printf("following referral for %s to %s", q.Name, fqdn(next.zone))
+		current = next
+	}
+
+	return nil, fmt.Errorf("failed to resolve %s: too many referrals: %w", q.Name, ErrResolutionLoop)
+}
+
+// ask sends req to the servers of d in turn until one of them answers.
+func (r *RecursiveResolver) ask(d *delegation, req *DNSMessage) (*DNSMessage, error) {
+	var lastErr error
+	for _, server := range d.servers {
+		resp, err := exchange(net.JoinHostPort(server, r.port), req, r.timeout, nil)
+		if err != nil {
+			log.Printf("name server %s of %s failed: %v", server, fqdn(d.zone), err)
+			lastErr = err
+			continue
+		}
+		if rcode := resp.Header.Flags.RCODE; rcode == ServerFailureResponseCode || rcode == RefusedResponseCode {
+			lastErr = fmt.Errorf("name server %s of %s answered with RCODE %d", server, fqdn(d.zone), rcode)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no name server of %s answered: %v", fqdn(d.zone), lastErr)
+}
+
+// referral returns the delegation found in the authority section of resp and
+// the TTL of its NS records. It must be for a zone containing name and below
+// zone, the zone of the server that sent resp, so that referrals can only
+// lead down the tree. The servers of the returned delegation are the names
+// of the name servers, not their addresses.
+func referral(resp *DNSMessage, name, zone string) (*delegation, uint32) {
+	var d *delegation
+	var ttl uint32
+	for _, rr := range resp.Authorities {
+		ns, ok := rr.RData.(*NSRecord)
+		if !ok {
+			continue
+		}
+		child := canonicalName(rr.Name)
+		if child == zone || !inZone(child, zone) || !inZone(canonicalName(name), child) {
+			continue
+		}
+		if d == nil {
+			d = &delegation{zone: child}
+			ttl = rr.TTL
+		}
+		if child != d.zone {
+			continue
+		}
+		if rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		d.servers = append(d.servers, canonicalName(ns.Host))
+	}
+	return d, ttl
+}
+
+// nameServerAddresses returns the addresses of the name servers of d, which
+// holds their names. Glue records are used for the name servers within zone,
+// the zone of the server that sent the referral. The others are resolved.
+func (r *RecursiveResolver) nameServerAddresses(resp *DNSMessage, d *delegation, zone string, depth int) []string {
+	var addresses []string
+	for _, host := range d.servers {
+		var glue []string
+		if inZone(host, zone) {
+			for _, rr := range resp.Additionals {
+				a, ok := rr.RData.(*ARecord)
+				if ok && canonicalName(rr.Name) == host {
+					glue = append(glue, a.IP.String())
+				}
+			}
+		}
+		if len(glue) > 0 {
+			addresses = append(addresses, glue...)
+			continue
+		}
+
+		result, err := r.resolve(DNSQuestion{Name: host, Type: ARecordType, Class: INRecordClass}, depth+1)
+		if err != nil {
+			log.Printf("failed to resolve name server %s: %v", host, err)
+			continue
+		}
+		for _, rr := range result.Answers {
+			if a, ok := rr.RData.(*ARecord); ok {
+				addresses = append(addresses, a.IP.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// closestDelegation returns the cached delegation of the zone closest to
+// name, or the root servers.
+func (r *RecursiveResolver) closestDelegation(name string) *delegation {
+	name = canonicalName(name)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for {
+		if d, ok := r.delegations[name]; ok {
+			if now.Before(d.expiresAt) {
+				return d
+			}
+			delete(r.delegations, name)
+		}
+		if name == "" {
+			break
+		}
+		name = parentName(name)
+	}
+	return &delegation{servers: r.rootServers}
+}
+
+// storeDelegation caches d for ttl seconds.
+func (r *RecursiveResolver) storeDelegation(d *delegation, ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	d.expiresAt = now.Add(time.Duration(ttl) * time.Second)
+	if len(r.delegations) >= maxDelegations {
+		for zone, cached := range r.delegations {
+			if !now.Before(cached.expiresAt) {
+				delete(r.delegations, zone)
+			}
+		}
+		if len(r.delegations) >= maxDelegations {
+			return
+		}
+	}
+	r.delegations[d.zone] = d
+}
+
+// canonicalName returns name lowercased and without trailing dot, the form
+// used to compare names.
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// inZone reports whether the canonical name is zone or one of its
+// subdomains.
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// referralTo refers req to the name server host of zone, with an address
+// record for it in the additional section unless glue is nil.
+func referralTo(req *DNSMessage, zone, host string, glue net.IP) *DNSMessage {
+	resp := CreateResponse(req)
+	resp.AddAuthorities(DNSAnswer{
+		Name: zone, Type: NSRecordType, Class: INRecordClass, TTL: 3600,
+		RData: &NSRecord{Host: host},
+	})
+	if glue != nil {
+		resp.AddAdditionals(DNSAnswer{
+			Name: host, Type: ARecordType, Class: INRecordClass, TTL: 3600,
+			RData: &ARecord{IP: glue},
+		})
+	}
+	return resp
+}
+
+// authoritativeAnswer answers req with the records of zone owned by the
+// question name, following the CNAME records within records, or with
+// NXDOMAIN when there is none.
+func authoritativeAnswer(req *DNSMessage, zone string, records []DNSAnswer) *DNSMessage {
+	resp := CreateResponse(req)
+	resp.Header.Flags.AA = true
+	name := req.Questions[0].Name
+	for followed := true; followed; {
+		followed = false
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			resp.AddAnswers(rr)
+			if cname, ok := rr.RData.(*CNAMERecord); ok && inZone(canonicalName(cname.Target), zone) {
+				name = cname.Target
+				followed = true
+				break
+			}
+		}
+	}
+	if len(resp.Answers) == 0 {
+		resp.Header.Flags.RCODE = NameErrorResponseCode
+		resp.AddAuthorities(DNSAnswer{
+			Name: zone, Type: SOARecordType, Class: INRecordClass, TTL: 3600,
+			RData: &SOARecord{MName: "ns." + zone, RName: "hostmaster." + zone, Minimum: 300},
+		})
+	}
+	return resp
+}
+
+func aRecord(name string, ip net.IP) DNSAnswer {
+	return DNSAnswer{Name: name, Type: ARecordType, Class: INRecordClass, TTL: 300, RData: &ARecord{IP: ip}}
+}
+
+func cnameRecord(name, target string) DNSAnswer {
+	return DNSAnswer{Name: name, Type: CNAMERecordType, Class: INRecordClass, TTL: 300, RData: &CNAMERecord{Target: target}}
+}
+
+// startFakeHierarchy starts offline name servers for the root, com, net and
+// example.com zones, all on the same port of different loopback addresses.
+// The name server of example.com lives in the net zone, so it has no glue.
+// It returns a resolver using them and the number of queries received by the
+// root server.
+func startFakeHierarchy(t *testing.T) (*RecursiveResolver, *int32) {
+	t.Helper()
+	rootQueries := new(int32)
+	root := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		atomic.AddInt32(rootQueries, 1)
+		name := canonicalName(req.Questions[0].Name)
+		switch {
+		case inZone(name, "com"):
+			return []*DNSMessage{referralTo(req, "com", "ns.com", net.IP{127, 0, 0, 2})}
+		case inZone(name, "net"):
+			return []*DNSMessage{referralTo(req, "net", "ns.net", net.IP{127, 0, 0, 4})}
+		}
+		return []*DNSMessage{authoritativeAnswer(req, "", nil)}
+	})
+	_, port, err := net.SplitHostPort(root)
+	if err != nil {
+		t.Fatalf("failed to parse fake root address: %v", err)
+	}
+
+	startFakeServerAt(t, "127.0.0.2:"+port, func(req *DNSMessage) []*DNSMessage {
+		if inZone(canonicalName(req.Questions[0].Name), "example.com") {
+			return []*DNSMessage{referralTo(req, "example.com", "ns1.example.net", nil)}
+		}
+		return []*DNSMessage{authoritativeAnswer(req, "com", nil)}
+	})
+	startFakeServerAt(t, "127.0.0.4:"+port, func(req *DNSMessage) []*DNSMessage {
+		return []*DNSMessage{authoritativeAnswer(req, "net", []DNSAnswer{
+			aRecord("ns1.example.net", net.IP{127, 0, 0, 3}),
+			aRecord("host.example.net", net.IP{192, 0, 2, 10}),
+		})}
+	})
+	startFakeServerAt(t, "127.0.0.3:"+port, func(req *DNSMessage) []*DNSMessage {
+		return []*DNSMessage{authoritativeAnswer(req, "example.com", []DNSAnswer{
+			cnameRecord("www.example.com", "host.example.net"),
+			cnameRecord("mail.example.com", "smtp.example.com"),
+			aRecord("smtp.example.com", net.IP{192, 0, 2, 20}),
+		})}
+	})
+
+	resolver, err := NewRecursiveResolver([]string{"127.0.0.1"}, time.Second)
+	if err != nil {
+		t.Fatalf("failed to create recursive resolver: %v", err)
+	}
+	resolver.port = port
+	return resolver, rootQueries
+}
+
+func TestRecursiveResolver_SendRequest(t *testing.T) {
+	resolver, _ := startFakeHierarchy(t)
+
+	tcs := []struct {
+		name            string
+		question        string
+		expectedRCODE   uint16
+		expectedAnswers []DNSAnswer
+	}{
+		{
+			name:          "CNAME across zones",
+			question:      "www.example.com",
+			expectedRCODE: NoErrorResponseCode,
+			expectedAnswers: []DNSAnswer{
+				cnameRecord("www.example.com", "host.example.net"),
+				aRecord("host.example.net", net.IP{192, 0, 2, 10}),
+			},
+		},
+		{
+			name:          "CNAME within a zone",
+			question:      "mail.example.com",
+			expectedRCODE: NoErrorResponseCode,
+			expectedAnswers: []DNSAnswer{
+				cnameRecord("mail.example.com", "smtp.example.com"),
+				aRecord("smtp.example.com", net.IP{192, 0, 2, 20}),
+			},
+		},
+		{
+			name:          "missing name",
+			question:      "missing.example.com",
+			expectedRCODE: NameErrorResponseCode,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := resolver.SendRequest(newQuery(tc.question, ARecordType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !resp.Header.Flags.RA {
+				t.Errorf("expected RA to be set")
+			}
+			if resp.Header.Flags.RCODE != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+			}
+			if len(tc.expectedAnswers) != len(resp.Answers) {
+				t.Fatalf("expected answers %+v but got %+v", tc.expectedAnswers, resp.Answers)
+			}
+			for i, answer := range resp.Answers {
+				expected := tc.expectedAnswers[i]
+				if answer.Name != expected.Name || answer.Type != expected.Type ||
+					answer.RData.String() != expected.RData.String() {
+					t.Errorf("answer %d does not match: %s", i, cmp.Diff(expected.RData.String(), answer.RData.String()))
+				}
+			}
+			if tc.expectedRCODE == NameErrorResponseCode && len(resp.Authorities) != 1 {
+				t.Errorf("expected the SOA record in the authority section but got %+v", resp.Authorities)
+			}
+		})
+	}
+}
+
+func TestRecursiveResolver_CachesDelegations(t *testing.T) {
+	resolver, rootQueries := startFakeHierarchy(t)
+
+	if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	queries := atomic.LoadInt32(rootQueries)
+	if queries == 0 {
+		t.Fatalf("expected the root server to be queried")
+	}
+
+	resp, err := resolver.SendRequest(newQuery("mail.example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Answers) != 2 {
+		t.Errorf("expected two answers but got %+v", resp.Answers)
+	}
+	if got := atomic.LoadInt32(rootQueries); got != queries {
+		t.Errorf("expected the delegation of example.com to be cached but the root got %d more queries", got-queries)
+	}
+
+	resolver.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := resolver.SendRequest(newQuery("mail.example.com", ARecordType)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(rootQueries); got == queries {
+		t.Errorf("expected expired delegations to be looked up again from the root")
+	}
+}
+
+func TestFollowAnswers(t *testing.T) {
+	sig := func(name string, rrType uint16) DNSAnswer {
+		return DNSAnswer{
+			Name: name, Type: RRSIGRecordType, Class: INRecordClass, TTL: 300,
+			RData: &RRSIGRecord{TypeCovered: rrType, Algorithm: ED25519Algorithm, SignerName: "example.com"},
+		}
+	}
+	dname := DNSAnswer{
+		Name: "example.com", Type: DNAMERecordType, Class: INRecordClass, TTL: 300,
+		RData: &DNAMERecord{Target: "example.net"},
+	}
+	resp := &DNSMessage{}
+	resp.AddAnswers(
+		dname,
+		sig("example.com", DNAMERecordType),
+		cnameRecord("www.example.com", "www.example.net"),
+		aRecord("www.example.net", net.IP{192, 0, 2, 1}),
+		sig("www.example.net", ARecordType),
+		sig("www.example.net", AAAARecordType),
+		aRecord("mail.example.net", net.IP{192, 0, 2, 2}),
+	)
+
+	result := &DNSMessage{}
+	name, found := followAnswers(result, resp, "www.example.com", ARecordType)
+	if name != "www.example.net" || !found {
+		t.Fatalf("expected to find www.example.net but got %s (found %v)", name, found)
+	}
+	var got []string
+	for _, rr := range result.Answers {
+		got = append(got, fmt.Sprintf("%s %d", rr.Name, rr.Type))
+	}
+	expected := []string{
+		"example.com 39", "example.com 46", "www.example.com 5", "www.example.net 1", "www.example.net 46",
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("answers do not match: %s", diff)
+	}
+}
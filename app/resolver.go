@@ -1,18 +1,48 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
 const readWriteTiemeout = time.Second * 2
 
+// Upstream answers the requests the server can't answer on its own. It is
+// implemented by Resolver and by the layers wrapping it.
+type Upstream interface {
+	SendRequest(msg *DNSMessage) (*DNSMessage, error)
+}
+
+// Resolver forwards requests to an upstream DNS server. It is safe for
+// concurrent use: requests share a single UDP socket and responses are
+// dispatched to their caller by query ID, after checking that they answer
+// the question that was asked.
 type Resolver struct {
 	conn          *net.UDPConn
 	serverUDPAddr *net.UDPAddr
+	timeout       time.Duration
+	// key signs the requests when it is not nil, and the responses must then
+	// be signed with it too.
+	key *TSIGKey
+
+	mu       sync.Mutex
+	inFlight map[uint16]*pendingRequest
+}
+
+// pendingRequest is a request waiting for its response.
+type pendingRequest struct {
+	questions []DNSQuestion
+	// session verifies the response of a signed request.
+	session  *tsigSession
+	response chan *DNSMessage
 }
 
 func NewResolver(serverAddr string) (*Resolver, error) {
@@ -25,60 +55,297 @@ func NewResolver(serverAddr string) (*Resolver, error) {
 		return nil, fmt.Errorf("failed to dial %v: %w", serverAddr, err)
 	}
 
-	return &Resolver{
+	r := &Resolver{
 		conn:          conn,
 		serverUDPAddr: serverUDPAddr,
-	}, nil
+		timeout:       readWriteTiemeout,
+		inFlight:      map[uint16]*pendingRequest{},
+	}
+	go r.readLoop()
+
+	return r, nil
 }
 
-func (r Resolver) Close() error {
+func (r *Resolver) Close() error {
 	return r.conn.Close()
 }
 
-func (r Resolver) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+// SetTSIGKey makes the resolver sign its requests with key and only accept
+// responses signed with it. It must be called before the resolver is used.
+func (r *Resolver) SetTSIGKey(key *TSIGKey) {
+	r.key = key
+}
+
+// SendRequest sends msg to the upstream server under a random query ID and
+// waits for the matching response. The returned response carries the ID of
+// msg.
+func (r *Resolver) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
 	log.Printf("sending resolve request to %s", r.serverUDPAddr)
-	reqBuf, err := msg.MarshalBinary()
+	req := *msg
+	pending := &pendingRequest{
+		questions: msg.Questions,
+		response:  make(chan *DNSMessage, 1),
+	}
+	id, err := r.register(pending)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unregister(id)
+	req.Header.ID = id
+
+	reqBuf, err := req.MarshalBinary()
 	if err != nil {
 		return nil, fmt.Errorf("failed to encode request: %v", err)
 	}
+	if r.key != nil {
+		session := newTSIGSession(r.key)
+		if reqBuf, err = session.sign(reqBuf); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %v", err)
+		}
+		r.mu.Lock()
+		pending.session = session
+		r.mu.Unlock()
+	}
 	if _, err := r.write(reqBuf); err != nil {
 		return nil, fmt.Errorf("failed to write request: %v", err)
 	}
 
-	resBuf := make([]byte, 512)
-	n, _, err := r.readFromUDP(resBuf)
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	var resp *DNSMessage
+	select {
+	case resp = <-pending.response:
+	case <-timer.C:
+		return nil, fmt.Errorf("no response from %s after %v", r.serverUDPAddr, r.timeout)
+	}
+	if resp.Header.Flags.TC {
+		log.Printf("truncated response from %s, retrying over TCP", r.serverUDPAddr)
+		if resp, err = exchangeTCP(r.serverUDPAddr.String(), &req, r.timeout, r.key); err != nil {
+			return nil, err
+		}
+	}
+	resp.Header.ID = msg.Header.ID
+
+	log.Printf("resolve request response received from %s: %+v", r.serverUDPAddr, resp)
+	return resp, nil
+}
+
+// exchangeTCP sends req to the server at addr over a new TCP connection and
+// returns its response. It is used when a UDP response was truncated. The
+// request is signed with key when it is not nil, and so must be the response.
+func exchangeTCP(addr string, req *DNSMessage, timeout time.Duration, key *TSIGKey) (*DNSMessage, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to dial %s over TCP: %v", addr, err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set tcp connection deadline: %v", err)
+	}
+
+	reqBuf, err := req.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	var session *tsigSession
+	if key != nil {
+		session = newTSIGSession(key)
+		if reqBuf, err = session.sign(reqBuf); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %v", err)
+		}
+	}
+	if err := writeTCPMessage(conn, reqBuf); err != nil {
+		return nil, fmt.Errorf("failed to write TCP request: %v", err)
+	}
+	resBuf, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TCP response: %v", err)
 	}
 	resp := &DNSMessage{}
-	if err := resp.UnmarshalBinary(resBuf[:n]); err != nil {
+	if err := resp.UnmarshalBinary(resBuf); err != nil {
 		return nil, err
 	}
-
-	if resp.Header.Flags.RCODE != NoErrorResponseCode {
-		return nil, fmt.Errorf("resolver failed with RCODE: %d", resp.Header.Flags.RCODE)
+	if resp.Header.ID != req.Header.ID || !sameQuestions(req.Questions, resp.Questions) {
+		return nil, fmt.Errorf("TCP response from %s does not match the request", addr)
 	}
-	if resp.Header.ANCOUNT == 0 ||
-		len(resp.Answers) == 0 ||
-		int(resp.Header.ANCOUNT) != len(resp.Answers) {
-		return nil, fmt.Errorf("resolver did not send answers")
+	if session != nil {
+		if err := session.verify(resBuf); err != nil {
+			return nil, fmt.Errorf("failed to authenticate TCP response from %s: %v", addr, err)
+		}
+		resp.removeTSIG()
 	}
 
-	log.Printf("received %d bytes: %s\n", len(resBuf[:n]), hex.EncodeToString(resBuf[:n]))
-	log.Printf("resolve request response received from %s: %+v", r.serverUDPAddr, resp)
 	return resp, nil
 }
 
-func (r Resolver) write(buf []byte) (int, error) {
-	if err := r.conn.SetWriteDeadline(time.Now().Add(readWriteTiemeout)); err != nil {
-		return 0, fmt.Errorf("failed to set udp connection write deadline: %v", err)
+// exchange sends msg to the server at addr over UDP under a random query ID
+// and waits for the matching response, retrying over TCP when it is
+// truncated. Unlike Resolver it uses a new socket for every request, which
+// suits talking to many different servers. The request is signed with key
+// when it is not nil, and responses that are not signed with it are dropped.
+func exchange(addr string, msg *DNSMessage, timeout time.Duration, key *TSIGKey) (*DNSMessage, error) {
+	req := *msg
+	id, err := randomID()
+	if err != nil {
+		return nil, err
 	}
-	return r.conn.Write(buf)
+	req.Header.ID = id
+	reqBuf, err := req.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	var session *tsigSession
+	if key != nil {
+		session = newTSIGSession(key)
+		if reqBuf, err = session.sign(reqBuf); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %v", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set udp connection deadline: %v", err)
+	}
+	if _, err := conn.Write(reqBuf); err != nil {
+		return nil, fmt.Errorf("failed to write request: %v", err)
+	}
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no response from %s: %v", addr, err)
+		}
+		resp := &DNSMessage{}
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil {
+			log.Printf("dropping unparsable response from %s: %v", addr, err)
+			continue
+		}
+		if resp.Header.ID != id || !sameQuestions(req.Questions, resp.Questions) {
+			log.Printf("dropping unexpected response %d from %s", resp.Header.ID, addr)
+			continue
+		}
+		if session != nil {
+			if err := session.verify(buf[:n]); err != nil {
+				log.Printf("dropping unauthenticated response from %s: %v", addr, err)
+				continue
+			}
+			resp.removeTSIG()
+		}
+		if resp.Header.Flags.TC {
+			return exchangeTCP(addr, &req, timeout, key)
+		}
+		return resp, nil
+	}
+}
+
+// register stores pending in the in-flight table under a random ID that is
+// not already in use.
+func (r *Resolver) register(pending *pendingRequest) (uint16, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for attempt := 0; attempt < 16; attempt++ {
+		id, err := randomID()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := r.inFlight[id]; !ok {
+			r.inFlight[id] = pending
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to find a free query ID among %d in-flight requests", len(r.inFlight))
 }
 
-func (r Resolver) readFromUDP(buf []byte) (int, *net.UDPAddr, error) {
-	if err := r.conn.SetReadDeadline(time.Now().Add(readWriteTiemeout)); err != nil {
-		return 0, nil, fmt.Errorf("failed to set udp connection read deadline: %v", err)
+func (r *Resolver) unregister(id uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inFlight, id)
+}
+
+// readLoop reads responses from the upstream server and hands them to the
+// in-flight request with the same ID and question. Any other packet is
+// dropped. It returns once the connection is closed.
+func (r *Resolver) readLoop() {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("failed to read from resolver %s: %v", r.serverUDPAddr, err)
+			continue
+		}
+		log.Printf("received %d bytes: %s\n", n, hex.EncodeToString(buf[:n]))
+
+		resp := &DNSMessage{}
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil {
+			log.Printf("dropping unparsable response from %s: %v", r.serverUDPAddr, err)
+			continue
+		}
+
+		r.mu.Lock()
+		pending, ok := r.inFlight[resp.Header.ID]
+		ok = ok && sameQuestions(pending.questions, resp.Questions)
+		var session *tsigSession
+		if ok {
+			session = pending.session
+		}
+		r.mu.Unlock()
+
+		if !ok {
+			log.Printf("dropping unexpected response %d from %s", resp.Header.ID, r.serverUDPAddr)
+			continue
+		}
+		// A spoofed response must not take the place of the signed one
+		if session != nil {
+			if err := session.verify(buf[:n]); err != nil {
+				log.Printf("dropping unauthenticated response from %s: %v", r.serverUDPAddr, err)
+				continue
+			}
+			resp.removeTSIG()
+		}
+
+		r.mu.Lock()
+		delete(r.inFlight, resp.Header.ID)
+		r.mu.Unlock()
+		pending.response <- resp
+	}
+}
+
+// sameQuestions reports whether a response answers the questions of a
+// request. Names are compared case-insensitively.
+func sameQuestions(a, b []DNSQuestion) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	return r.conn.ReadFromUDP(buf)
+	for i := range a {
+		if a[i].Type != b[i].Type || a[i].Class != b[i].Class || !strings.EqualFold(a[i].Name, b[i].Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// randomID returns a query ID from a cryptographically secure source so that
+// responses can't be easily spoofed.
+func randomID() (uint16, error) {
+	buf := make([]byte, 2)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, fmt.Errorf("failed to generate query ID: %v", err)
+	}
+	return binary.BigEndian.Uint16(buf), nil
+}
+
+func (r *Resolver) write(buf []byte) (int, error) {
+	if err := r.conn.SetWriteDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, fmt.Errorf("failed to set udp connection write deadline: %v", err)
+	}
+	return r.conn.Write(buf)
 }
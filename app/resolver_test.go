@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLiveResolver_SendRequest(t *testing.T) {
@@ -50,3 +54,264 @@ func TestLiveResolver_SendRequest(t *testing.T) {
 		}
 	}
 }
+
+// startFakeServer serves the requests received on a local UDP port with
+// handler, sending back every message it returns in order. It returns the
+// address of the server.
+func startFakeServer(t *testing.T, handler func(req *DNSMessage) []*DNSMessage) string {
+	t.Helper()
+	return startFakeServerAt(t, "127.0.0.1:0", handler)
+}
+
+// startFakeServerAt is like startFakeServer but listens on addr.
+func startFakeServerAt(t *testing.T, addr string, handler func(req *DNSMessage) []*DNSMessage) string {
+	t.Helper()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to resolve fake server address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("failed to start fake server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, source, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &DNSMessage{}
+			if err := req.UnmarshalBinary(buf[:n]); err != nil {
+				continue
+			}
+			go func() {
+				for _, resp := range handler(req) {
+					b, err := resp.MarshalBinary()
+					if err != nil {
+						continue
+					}
+					conn.WriteToUDP(b, source)
+				}
+			}()
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// answerA answers req with a single A record holding ip.
+func answerA(req *DNSMessage, ip net.IP) *DNSMessage {
+	resp := CreateResponse(req)
+	resp.AddAnswers(DNSAnswer{
+		Name:  req.Questions[0].Name,
+		Type:  ARecordType,
+		Class: INRecordClass,
+		TTL:   60,
+		RData: &ARecord{IP: ip},
+	})
+	return resp
+}
+
+func newQuery(name string, rrType uint16) *DNSMessage {
+	msg := &DNSMessage{}
+	msg.AddQuestions(DNSQuestion{Name: name, Type: rrType, Class: INRecordClass})
+	return msg
+}
+
+func TestResolver_ConcurrentRequests(t *testing.T) {
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		var i byte
+		fmt.Sscanf(req.Questions[0].Name, "host%d.example.com", &i)
+		// Answer later requests first so that responses arrive out of order
+		time.Sleep(time.Duration(20-i) * time.Millisecond)
+		return []*DNSMessage{answerA(req, net.IP{192, 0, 2, i})}
+	})
+	resolver, err := NewResolver(addr)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer resolver.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := resolver.SendRequest(newQuery(fmt.Sprintf("host%d.example.com", i), ARecordType))
+			if err != nil {
+				t.Errorf("request %d failed: %v", i, err)
+				return
+			}
+			ip := resp.Answers[0].RData.(*ARecord).IP
+			if !ip.Equal(net.IP{192, 0, 2, byte(i)}) {
+				t.Errorf("request %d received answer %s", i, ip)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResolver_RejectsMismatchedResponses(t *testing.T) {
+	tcs := []struct {
+		name        string
+		spoof       func(resp *DNSMessage)
+		sendGenuine bool
+		expectErr   bool
+	}{
+		{
+			name:        "wrong ID is ignored",
+			spoof:       func(resp *DNSMessage) { resp.Header.ID++ },
+			sendGenuine: true,
+		},
+		{
+			name:        "wrong question name is ignored",
+			spoof:       func(resp *DNSMessage) { resp.Questions[0].Name = "evil.example.com" },
+			sendGenuine: true,
+		},
+		{
+			name:        "wrong question type is ignored",
+			spoof:       func(resp *DNSMessage) { resp.Questions[0].Type = AAAARecordType },
+			sendGenuine: true,
+		},
+		{
+			name:      "only spoofed responses time out",
+			spoof:     func(resp *DNSMessage) { resp.Header.ID++ },
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+				spoofed := answerA(req, net.IP{203, 0, 113, 66})
+				spoofed.Questions = []DNSQuestion{req.Questions[0]}
+				tc.spoof(spoofed)
+				resps := []*DNSMessage{spoofed}
+				if tc.sendGenuine {
+					resps = append(resps, answerA(req, net.IP{192, 0, 2, 1}))
+				}
+				return resps
+			})
+			resolver, err := NewResolver(addr)
+			if err != nil {
+				t.Fatalf("failed to create resolver: %v", err)
+			}
+			defer resolver.Close()
+			resolver.timeout = 200 * time.Millisecond
+
+			resp, err := resolver.SendRequest(newQuery("www.example.com", ARecordType))
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error but got response %+v", resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ip := resp.Answers[0].RData.(*ARecord).IP
+			if !ip.Equal(net.IP{192, 0, 2, 1}) {
+				t.Errorf("accepted spoofed answer %s", ip)
+			}
+		})
+	}
+}
+
+// serveFakeTCP serves the requests received over TCP on addr with handler,
+// answering with the first message it returns.
+func serveFakeTCP(t *testing.T, addr string, handler func(req *DNSMessage) []*DNSMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to start fake TCP server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					buf, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					req := &DNSMessage{}
+					if err := req.UnmarshalBinary(buf); err != nil {
+						return
+					}
+					for _, resp := range handler(req) {
+						b, err := resp.MarshalBinary()
+						if err != nil {
+							return
+						}
+						if err := writeTCPMessage(conn, b); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+}
+
+func TestResolver_RelaysErrorResponses(t *testing.T) {
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		resp := CreateResponse(req)
+		resp.Header.Flags.RCODE = NameErrorResponseCode
+		resp.AddAuthorities(DNSAnswer{
+			Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 300,
+			RData: &SOARecord{MName: "ns.example.com", RName: "hostmaster.example.com", Minimum: 60},
+		})
+		return []*DNSMessage{resp}
+	})
+	resolver, err := NewResolver(addr)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer resolver.Close()
+
+	resp, err := resolver.SendRequest(newQuery("missing.example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Header.Flags.RCODE != NameErrorResponseCode {
+		t.Errorf("expected RCODE %d but got %d", NameErrorResponseCode, resp.Header.Flags.RCODE)
+	}
+	if len(resp.Authorities) != 1 {
+		t.Errorf("expected the SOA record in the authority section but got %+v", resp.Authorities)
+	}
+}
+
+func TestResolver_RetriesTruncatedResponsesOverTCP(t *testing.T) {
+	addr := startFakeServer(t, func(req *DNSMessage) []*DNSMessage {
+		resp := CreateResponse(req)
+		resp.Header.Flags.TC = true
+		return []*DNSMessage{resp}
+	})
+	serveFakeTCP(t, addr, func(req *DNSMessage) []*DNSMessage {
+		return []*DNSMessage{answerA(req, net.IP{192, 0, 2, 1})}
+	})
+	resolver, err := NewResolver(addr)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer resolver.Close()
+
+	resp, err := resolver.SendRequest(newQuery("www.example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Header.Flags.TC || len(resp.Answers) != 1 {
+		t.Errorf("expected the full TCP response but got %+v", resp)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// initialRetryInterval is how long a secondary waits before retrying the first
+// transfer of its zone, whose SOA timers are still unknown.
+const initialRetryInterval = 10 * time.Second
+
+// ErrBadTransfer is returned when a zone transfer response is malformed.
+var ErrBadTransfer = errors.New("malformed zone transfer")
+
+// Secondary keeps a copy of a zone served by a primary server up to date in a
+// zone store. It checks the serial of the primary every SOA refresh interval,
+// or every retry interval after a failure, and transfers the zone when it
+// changed. The zone stops being served once it could not be refreshed for
+// the expire interval.
+// See [RFC1034 4.3.5]
+// [RFC1034 4.3.5]: https://datatracker.ietf.org/doc/html/rfc1034#section-4.3.5
+type Secondary struct {
+	origin  string
+	primary string
+	// key signs the messages sent to the primary when it is not nil.
+	key     *TSIGKey
+	zones   *ZoneStore
+	timeout time.Duration
+
+	notify chan struct{}
+	done   chan struct{}
+}
+
+// NewSecondary creates the secondary of the zone rooted at origin, served by
+// the primary at the given address, and starts transferring it into zones.
+// Messages exchanged with the primary are signed with key when it is not nil.
+func NewSecondary(origin string, primary string, key *TSIGKey, zones *ZoneStore, timeout time.Duration) *Secondary {
+	s := &Secondary{
+		origin:  canonicalName(origin),
+		primary: primary,
+		key:     key,
+		zones:   zones,
+		timeout: timeout,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.refreshLoop()
+
+	return s
+}
+
+// Notify schedules an immediate refresh of the zone, as when the primary
+// announces a change.
+func (s *Secondary) Notify() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// isPrimary reports whether client has the IP address of the primary.
+func (s *Secondary) isPrimary(client net.Addr) bool {
+	host, _, err := net.SplitHostPort(s.primary)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(host).Equal(addrIP(client))
+}
+
+// signedBy reports whether a message signed with key, nil when unsigned,
+// may come from the primary.
+func (s *Secondary) signedBy(key *TSIGKey) bool {
+	return s.key == nil || (key != nil && key.Name == s.key.Name)
+}
+
+// Close stops refreshing the zone.
+func (s *Secondary) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
+
+// refreshLoop refreshes the zone until the secondary is closed.
+func (s *Secondary) refreshLoop() {
+	refreshed := time.Now()
+	for {
+		wait := initialRetryInterval
+		if err := s.refresh(); err != nil {
+			log.Printf("failed to refresh zone %s from %s: %v", fqdn(s.origin), s.primary, err)
+			if soa, ok := s.soa(); ok {
+				wait = soaInterval(soa.Retry)
+				if time.Since(refreshed) >= soaInterval(soa.Expire) {
+					log.Printf("zone %s expired, no longer serving it", fqdn(s.origin))
+					s.zones.Remove(s.origin)
+				}
+			}
+		} else {
+			refreshed = time.Now()
+			if soa, ok := s.soa(); ok {
+				wait = soaInterval(soa.Refresh)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// soa returns the SOA record data of the served version of the zone. It
+// reports false when the zone isn't served.
+func (s *Secondary) soa() (*SOARecord, bool) {
+	zone := s.zones.Get(s.origin)
+	if zone == nil {
+		return nil, false
+	}
+	soa, ok := zone.SOA().RData.(*SOARecord)
+	return soa, ok
+}
+
+// soaInterval converts an interval of a SOA record, in seconds, to a
+// duration of at least a second.
+func soaInterval(seconds uint32) time.Duration {
+	if seconds == 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// refresh transfers the zone when the primary has a newer version of it than
+// the one served.
+func (s *Secondary) refresh() error {
+	current := s.zones.Get(s.origin)
+	if current != nil {
+		serial, err := s.primarySerial()
+		if err != nil {
+			return err
+		}
+		if !serialGreater(serial, current.Serial()) {
+			return nil
+		}
+	}
+
+	var zone *Zone
+	var err error
+	if current != nil {
+		if zone, err = s.incrementalTransfer(current); err != nil {
+			log.Printf("incremental transfer of %s failed, falling back to a full transfer: %v", fqdn(s.origin), err)
+		}
+	}
+	if zone == nil {
+		if zone, err = s.fullTransfer(); err != nil {
+			return err
+		}
+	}
+	if current != nil && !serialGreater(zone.Serial(), current.Serial()) {
+		return nil
+	}
+	s.zones.Add(zone)
+	log.Printf("transferred zone %s serial %d from %s", fqdn(s.origin), zone.Serial(), s.primary)
+	return nil
+}
+
+// primarySerial returns the serial of the zone on the primary.
+func (s *Secondary) primarySerial() (uint32, error) {
+	req := &DNSMessage{}
+	req.AddQuestions(DNSQuestion{Name: s.origin, Type: SOARecordType, Class: INRecordClass})
+	resp, err := exchange(s.primary, req, s.timeout, s.key)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Header.Flags.RCODE != NoErrorResponseCode {
+		return 0, fmt.Errorf("primary answered the SOA query with RCODE %d", resp.Header.Flags.RCODE)
+	}
+	for _, rr := range resp.Answers {
+		if soa, ok := rr.RData.(*SOARecord); ok && canonicalName(rr.Name) == s.origin {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("primary did not answer the SOA query of %s", fqdn(s.origin))
+}
+
+// fullTransfer transfers the whole zone with AXFR.
+// See [RFC5936 2.2]
+// [RFC5936 2.2]: https://datatracker.ietf.org/doc/html/rfc5936#section-2.2
+func (s *Secondary) fullTransfer() (*Zone, error) {
+	req := &DNSMessage{}
+	req.AddQuestions(DNSQuestion{Name: s.origin, Type: AXFRRecordType, Class: INRecordClass})
+	records, err := transferRecords(s.primary, req, s.timeout, s.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("%w: zone does not end with its SOA record", ErrBadTransfer)
+	}
+	return NewZone(s.origin, records[:len(records)-1])
+}
+
+// incrementalTransfer transfers the changes made to the zone since current
+// with IXFR and returns the updated zone. Primaries may answer with the whole
+// zone instead.
+// See [RFC1995 4]
+// [RFC1995 4]: https://datatracker.ietf.org/doc/html/rfc1995#section-4
+func (s *Secondary) incrementalTransfer(current *Zone) (*Zone, error) {
+	req := &DNSMessage{}
+	req.AddQuestions(DNSQuestion{Name: s.origin, Type: IXFRRecordType, Class: INRecordClass})
+	req.AddAuthorities(current.SOA())
+	records, err := transferRecords(s.primary, req, s.timeout, s.key)
+	if err != nil {
+		return nil, err
+	}
+	return applyTransfer(current, records)
+}
+
+// transferRecords sends a transfer request to the server at addr over TCP and
+// returns the records of all the response messages. The request is signed
+// with key when it is not nil, and so must be the responses.
+func transferRecords(addr string, req *DNSMessage, timeout time.Duration, key *TSIGKey) ([]DNSAnswer, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.ID = id
+	reqBuf, err := req.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode transfer request: %v", err)
+	}
+	var session *tsigSession
+	if key != nil {
+		session = newTSIGSession(key)
+		if reqBuf, err = session.sign(reqBuf); err != nil {
+			return nil, fmt.Errorf("failed to sign transfer request: %v", err)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s over TCP: %v", addr, err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set tcp connection deadline: %v", err)
+	}
+	if err := writeTCPMessage(conn, reqBuf); err != nil {
+		return nil, fmt.Errorf("failed to write transfer request: %v", err)
+	}
+
+	var records []DNSAnswer
+	for len(records) == 0 || !transferComplete(records) {
+		// Large zones take many messages, each of them must arrive in time
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, fmt.Errorf("failed to set tcp connection deadline: %v", err)
+		}
+		buf, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read transfer response: %v", err)
+		}
+		if session != nil {
+			if err := session.verify(buf); err != nil {
+				return nil, fmt.Errorf("failed to authenticate transfer response from %s: %v", addr, err)
+			}
+		}
+		resp := &DNSMessage{}
+		if err := resp.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		resp.removeTSIG()
+		if resp.Header.ID != id {
+			return nil, fmt.Errorf("%w: unexpected message ID %d", ErrBadTransfer, resp.Header.ID)
+		}
+		if resp.Header.Flags.RCODE != NoErrorResponseCode {
+			return nil, fmt.Errorf("transfer refused by %s with RCODE %d", addr, resp.Header.Flags.RCODE)
+		}
+		if len(records) == 0 && (len(resp.Answers) == 0 || resp.Answers[0].Type != SOARecordType) {
+			return nil, fmt.Errorf("%w: response does not start with the SOA record", ErrBadTransfer)
+		}
+		records = append(records, resp.Answers...)
+	}
+	// The last message must be signed to cover the unsigned ones before it
+	if session != nil && len(session.unsigned) > 0 {
+		return nil, fmt.Errorf("failed to authenticate transfer response from %s: %w", addr, ErrUnsigned)
+	}
+	return records, nil
+}
+
+// transferComplete reports whether records, starting with the SOA record of
+// the new version of the zone, hold a whole transfer: the SOA record alone,
+// the zone ending with the SOA record, or a sequence of differences ending
+// with it. Each difference starts with the old and the new SOA records, so
+// the last record closes the transfer when an odd number of SOA records
+// follow the first one.
+func transferComplete(records []DNSAnswer) bool {
+	if len(records) == 1 {
+		return true
+	}
+	last := records[len(records)-1]
+	if last.Type != SOARecordType || soaSerial(last) != soaSerial(records[0]) {
+		return false
+	}
+	if records[1].Type != SOARecordType {
+		return true
+	}
+	var soas int
+	for _, rr := range records[1:] {
+		if rr.Type == SOARecordType {
+			soas++
+		}
+	}
+	return soas%2 == 1
+}
+
+// applyTransfer returns the zone resulting from the response records of an
+// IXFR request made for current, which are either the differences between
+// successive versions or the whole new zone.
+// See [RFC1995 4]
+// [RFC1995 4]: https://datatracker.ietf.org/doc/html/rfc1995#section-4
+func applyTransfer(current *Zone, records []DNSAnswer) (*Zone, error) {
+	switch {
+	case len(records) == 1:
+		// Already up to date
+		return current, nil
+	case len(records) == 2 || records[1].Type != SOARecordType:
+		return NewZone(current.Origin, records[:len(records)-1])
+	}
+
+	soa := current.SOA()
+	zone := append([]DNSAnswer{}, current.Records()[1:]...)
+	i := 1
+	for i < len(records)-1 {
+		if soaSerial(records[i]) != soaSerial(soa) {
+			return nil, fmt.Errorf("%w: difference from serial %d does not apply to serial %d",
+				ErrBadTransfer, soaSerial(records[i]), soaSerial(soa))
+		}
+		for i++; i < len(records) && records[i].Type != SOARecordType; i++ {
+			zone = removeRecord(zone, records[i])
+		}
+		if i == len(records)-1 {
+			return nil, fmt.Errorf("%w: difference without new SOA record", ErrBadTransfer)
+		}
+		soa = records[i]
+		for i++; i < len(records) && records[i].Type != SOARecordType; i++ {
+			zone = append(zone, records[i])
+		}
+	}
+	if soaSerial(soa) != soaSerial(records[0]) {
+		return nil, fmt.Errorf("%w: differences end at serial %d instead of %d", ErrBadTransfer, soaSerial(soa), soaSerial(records[0]))
+	}
+	return NewZone(current.Origin, append([]DNSAnswer{soa}, zone...))
+}
+
+// removeRecord returns records without the record equal to rr.
+func removeRecord(records []DNSAnswer, rr DNSAnswer) []DNSAnswer {
+	for i, other := range records {
+		if sameRecord(other, rr) {
+			return append(records[:i], records[i+1:]...)
+		}
+	}
+	return records
+}
+
+// sameRecord reports whether a and b have the same owner name, type, class
+// and data, whatever their TTL.
+func sameRecord(a, b DNSAnswer) bool {
+	return canonicalName(a.Name) == canonicalName(b.Name) && a.Type == b.Type &&
+		a.Class == b.Class && recordData(a) == recordData(b)
+}
+
+// recordData returns the presentation format of the data of rr, which
+// compares equal for equal data.
+func recordData(rr DNSAnswer) string {
+	if rr.RData == nil {
+		return string(rr.Data)
+	}
+	return rr.RData.String()
+}
+
+// soaSerial returns the serial of the SOA record rr.
+func soaSerial(rr DNSAnswer) uint32 {
+	if soa, ok := rr.RData.(*SOARecord); ok {
+		return soa.Serial
+	}
+	return 0
+}
+
+// serialGreater reports whether the serial number a is greater than b in
+// serial number arithmetic, where serials wrap around.
+// See [RFC1982 3.2]
+// [RFC1982 3.2]: https://datatracker.ietf.org/doc/html/rfc1982#section-3.2
+func serialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
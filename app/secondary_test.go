@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// versionedZone returns the content of a zone with the given SOA serial and
+// timers, followed by records.
+func versionedZone(serial uint32, timers string, records string) string {
+	return fmt.Sprintf("$TTL 3600\n@ SOA ns1 hostmaster %d %s\n  NS ns1\nns1 A 192.0.2.1\n%s", serial, timers, records)
+}
+
+// startPrimary serves the zones of handler over UDP and TCP on the same port
+// and returns its address and a function stopping it.
+func startPrimary(t *testing.T, handler *Handler) (string, func()) {
+	t.Helper()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("failed to listen over UDP: %v", err)
+	}
+	listener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		t.Fatalf("failed to listen over TCP: %v", err)
+	}
+	go serveUDP(udpConn, handler, 1, 1)
+	go serveTCP(listener, handler)
+
+	stop := func() {
+		udpConn.Close()
+		listener.Close()
+	}
+	t.Cleanup(stop)
+	return udpConn.LocalAddr().String(), stop
+}
+
+// waitForZone waits until zones serves the zone rooted at origin with the
+// given serial, or stops serving it when expected is false.
+func waitForZone(t *testing.T, zones *ZoneStore, origin string, serial uint32, expected bool) {
+	t.Helper()
+	matches := func() bool {
+		zone := zones.Get(origin)
+		if !expected {
+			return zone == nil
+		}
+		return zone != nil && zone.Serial() == serial
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !matches() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !matches() {
+		t.Fatalf("expected zone %s with serial %d to be served: %v", origin, serial, expected)
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	primaryZones := NewZoneStore()
+	primaryZones.Add(newTestZone(t, "example.com", versionedZone(1, "3600 600 86400 300", "")))
+	acls, err := parseACLs([]string{"example.com=127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatalf("failed to parse ACLs: %v", err)
+	}
+	addr, _ := startPrimary(t, &Handler{zones: primaryZones, transferACLs: acls})
+
+	zones := NewZoneStore()
+	secondary := NewSecondary("example.com", addr, nil, zones, time.Second)
+	defer secondary.Close()
+	waitForZone(t, zones, "example.com", 1, true)
+
+	primaryZones.Add(newTestZone(t, "example.com", versionedZone(2, "3600 600 86400 300", "www A 192.0.2.2\n")))
+	secondary.Notify()
+	waitForZone(t, zones, "example.com", 2, true)
+
+	resp := zones.Get("example.com").Lookup(DNSQuestion{Name: "www.example.com", Type: ARecordType, Class: INRecordClass})
+	if diff := cmp.Diff([]string{"www.example.com 1 192.0.2.2"}, recordStrings(resp.Answers)); diff != "" {
+		t.Errorf("answers do not match: %s", diff)
+	}
+}
+
+func TestSecondary_Expire(t *testing.T) {
+	primaryZones := NewZoneStore()
+	primaryZones.Add(newTestZone(t, "example.com", versionedZone(1, "1 1 2 300", "")))
+	acls, err := parseACLs([]string{"example.com=127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatalf("failed to parse ACLs: %v", err)
+	}
+	addr, stop := startPrimary(t, &Handler{zones: primaryZones, transferACLs: acls})
+
+	zones := NewZoneStore()
+	secondary := NewSecondary("example.com", addr, nil, zones, 100*time.Millisecond)
+	defer secondary.Close()
+	waitForZone(t, zones, "example.com", 1, true)
+
+	stop()
+	waitForZone(t, zones, "example.com", 0, false)
+}
+
+func TestApplyTransfer(t *testing.T) {
+	current := newTestZone(t, "example.com", versionedZone(1, "3600 600 86400 300", "www A 192.0.2.2\n"))
+	soa := func(serial uint32) DNSAnswer {
+		rr := current.SOA()
+		data := *rr.RData.(*SOARecord)
+		data.Serial = serial
+		rr.RData = &data
+		return rr
+	}
+	www := func(ip byte) DNSAnswer {
+		return DNSAnswer{Name: "www.example.com", Type: ARecordType, Class: INRecordClass, TTL: 60, RData: &ARecord{IP: net.IP{192, 0, 2, ip}}}
+	}
+
+	tcs := []struct {
+		name            string
+		records         []DNSAnswer
+		expectedSerial  uint32
+		expectedAnswers []string
+		expectedErr     error
+	}{
+		{
+			name:            "up to date",
+			records:         []DNSAnswer{soa(1)},
+			expectedSerial:  1,
+			expectedAnswers: []string{"www.example.com 1 192.0.2.2"},
+		},
+		{
+			name:            "whole zone",
+			records:         []DNSAnswer{soa(3), www(4), soa(3)},
+			expectedSerial:  3,
+			expectedAnswers: []string{"www.example.com 1 192.0.2.4"},
+		},
+		{
+			name: "differences",
+			records: []DNSAnswer{
+				soa(3),
+				soa(1), www(2), soa(2), www(3),
+				soa(2), soa(3), www(4),
+				soa(3),
+			},
+			expectedSerial:  3,
+			expectedAnswers: []string{"www.example.com 1 192.0.2.3", "www.example.com 1 192.0.2.4"},
+		},
+		{
+			name:        "differences from another version",
+			records:     []DNSAnswer{soa(3), soa(2), soa(3), www(4), soa(3)},
+			expectedErr: ErrBadTransfer,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if !transferComplete(tc.records) {
+				t.Errorf("expected the records to be a complete transfer")
+			}
+			zone, err := applyTransfer(current, tc.records)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v but got %v", tc.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if zone.Serial() != tc.expectedSerial {
+				t.Errorf("expected serial %d but got %d", tc.expectedSerial, zone.Serial())
+			}
+			resp := zone.Lookup(DNSQuestion{Name: "www.example.com", Type: ARecordType, Class: INRecordClass})
+			if diff := cmp.Diff(tc.expectedAnswers, recordStrings(resp.Answers)); diff != "" {
+				t.Errorf("answers do not match: %s", diff)
+			}
+		})
+	}
+}
+
+func TestTransferComplete(t *testing.T) {
+	soa := DNSAnswer{Name: "example.com", Type: SOARecordType, Class: INRecordClass, RData: &SOARecord{Serial: 2}}
+	old := DNSAnswer{Name: "example.com", Type: SOARecordType, Class: INRecordClass, RData: &SOARecord{Serial: 1}}
+	a := DNSAnswer{Name: "www.example.com", Type: ARecordType, Class: INRecordClass, RData: &ARecord{IP: net.IP{192, 0, 2, 1}}}
+
+	tcs := []struct {
+		name     string
+		records  []DNSAnswer
+		expected bool
+	}{
+		{name: "zone without its closing SOA", records: []DNSAnswer{soa, a}, expected: false},
+		{name: "zone", records: []DNSAnswer{soa, a, soa}, expected: true},
+		{name: "difference up to its additions", records: []DNSAnswer{soa, old, a, soa}, expected: false},
+		{name: "difference", records: []DNSAnswer{soa, old, a, soa, a, soa}, expected: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := transferComplete(tc.records); got != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSerialGreater(t *testing.T) {
+	tcs := []struct {
+		a, b     uint32
+		expected bool
+	}{
+		{a: 2, b: 1, expected: true},
+		{a: 1, b: 2, expected: false},
+		{a: 1, b: 1, expected: false},
+		{a: 0, b: 0xffffffff, expected: true},
+		{a: 0xffffffff, b: 0, expected: false},
+		{a: 0x7fffffff, b: 0, expected: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(fmt.Sprintf("%d>%d", tc.a, tc.b), func(t *testing.T) {
+			if got := serialGreater(tc.a, tc.b); got != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTCPMessageSize is the largest message the 2 bytes length prefix can frame.
+	maxTCPMessageSize = 0xFFFF
+	// tcpIdleTimeout is how long a connection is kept open waiting for a query.
+	// See [RFC7766 6.2.3]
+	// [RFC7766 6.2.3]: https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.3
+	tcpIdleTimeout = 10 * time.Second
+	// tcpMaxInFlight bounds the number of pipelined queries processed at the
+	// same time for a single connection.
+	tcpMaxInFlight = 16
+)
+
+func serveTCP(listener net.Listener, handler *Handler) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("failed to accept TCP connection: %v", err)
+			continue
+		}
+		go handleTCPConn(conn, handler)
+	}
+}
+
+// handleTCPConn serves the queries received on conn until the client closes
+// it or stays idle for tcpIdleTimeout. Pipelined queries are processed
+// concurrently and their responses are sent as soon as they are ready, which
+// may be out of order as allowed by [RFC7766 6.2.1.1].
+//
+// [RFC7766 6.2.1.1]: https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.1.1
+func handleTCPConn(conn net.Conn, handler *Handler) {
+	var wg sync.WaitGroup
+	var writeMu sync.Mutex
+	inFlight := make(chan struct{}, tcpMaxInFlight)
+	defer conn.Close()
+	defer wg.Wait()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+			log.Printf("failed to set tcp connection read deadline: %v", err)
+			return
+		}
+		data, err := readTCPMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("closing TCP connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			responses := handler.handleRequest(data, conn.RemoteAddr(), false)
+			if responses == nil {
+				return
+			}
+			// Messages of a zone transfer must not be interleaved with others
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			for _, response := range responses {
+				if err := conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+					log.Printf("failed to set tcp connection write deadline: %v", err)
+					return
+				}
+				if err := writeTCPMessage(conn, response); err != nil {
+					log.Printf("failed to send TCP response to %s: %v", conn.RemoteAddr(), err)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// readTCPMessage reads a message prefixed by its 2 bytes length.
+// See [RFC1035 4.2.2]
+//
+// [RFC1035 4.2.2]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read %d bytes message: %w", length, err)
+	}
+
+	return buf, nil
+}
+
+// writeTCPMessage writes msg prefixed by its 2 bytes length in a single write.
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxTCPMessageSize {
+		return fmt.Errorf("message too long for TCP: %d bytes", len(msg))
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestTCPMessage_RoundTrip(t *testing.T) {
+	var buff bytes.Buffer
+	msg := []byte{0x04, 0xD2, 0x01, 0x00}
+
+	if err := writeTCPMessage(&buff, msg); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if !bytes.Equal(buff.Bytes()[:2], []byte{0x00, 0x04}) {
+		t.Errorf("expected length prefix 0004 but got %x", buff.Bytes()[:2])
+	}
+	result, err := readTCPMessage(&buff)
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if !bytes.Equal(msg, result) {
+		t.Errorf("expected %x but got %x", msg, result)
+	}
+}
+
+func TestHandleTCPConn_Pipelining(t *testing.T) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleTCPConn(server, &Handler{})
+		close(done)
+	}()
+
+	// Server status queries are answered without reaching the resolver
+	ids := map[uint16]bool{1: true, 2: true}
+	for id := range ids {
+		req := DNSMessage{
+			Header: DNSHeader{
+				ID:    id,
+				Flags: DNSHeaderFlags{OPCODE: ServerStatusOpCode},
+			},
+		}
+		buf, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to marshal request: %v", err)
+		}
+		if err := writeTCPMessage(client, buf); err != nil {
+			t.Fatalf("failed to write request: %v", err)
+		}
+	}
+
+	for range ids {
+		buf, err := readTCPMessage(client)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		var resp DNSMessage
+		if err := resp.UnmarshalBinary(buf); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		if !ids[resp.Header.ID] {
+			t.Errorf("unexpected response ID %d", resp.Header.ID)
+		}
+		delete(ids, resp.Header.ID)
+		if resp.Header.Flags.RCODE != NotImplementedResponseCode {
+			t.Errorf("expected RCODE %d but got %d", NotImplementedResponseCode, resp.Header.Flags.RCODE)
+		}
+	}
+
+	client.Close()
+	<-done
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// transferMessageSize is the size above which the records of a zone
+// transfer are sent in another message.
+const transferMessageSize = 16 << 10
+
+// isTransferRequest reports whether req asks for a zone transfer.
+func isTransferRequest(req *DNSMessage) bool {
+	if req.Header.Flags.OPCODE != StandardQueryOpCode || req.Header.Flags.QR || len(req.Questions) != 1 {
+		return false
+	}
+	return req.Questions[0].Type == AXFRRecordType || req.Questions[0].Type == IXFRRecordType
+}
+
+// transfer answers an AXFR request with the whole zone, split into as many
+// messages as needed. Transfers are only served over TCP to the clients
+// allowed for the zone, key being the TSIG key the request was signed with.
+// See [RFC5936 2.2]
+// [RFC5936 2.2]: https://datatracker.ietf.org/doc/html/rfc5936#section-2.2
+//
+// IXFR requests are answered with the SOA record alone when the client is up
+// to date or asked over UDP, and with the whole zone otherwise as no history
+// of the changes is kept.
+// See [RFC1995 4]
+// [RFC1995 4]: https://datatracker.ietf.org/doc/html/rfc1995#section-4
+func (h *Handler) transfer(req *DNSMessage, client net.Addr, key *TSIGKey, udp bool) [][]byte {
+	q := req.Questions[0]
+	refuse := func(rcode uint16) [][]byte {
+		resp := CreateResponse(req)
+		resp.Header.Flags.RCODE = rcode
+		response, err := resp.MarshalBinary()
+		if err != nil {
+			log.Printf("failed to marshal transfer error response: %v", err)
+			return nil
+		}
+		return [][]byte{response}
+	}
+
+	// See [RFC5936 4.2]
+	// [RFC5936 4.2]: https://datatracker.ietf.org/doc/html/rfc5936#section-4.2
+	if udp && q.Type == AXFRRecordType {
+		return refuse(NotImplementedResponseCode)
+	}
+	zone := h.zones.Get(q.Name)
+	if zone == nil {
+		return refuse(RefusedResponseCode)
+	}
+	if !h.transferACLs[zone.Origin].allows(client, key) {
+		log.Printf("refusing transfer of %s to %s", fqdn(zone.Origin), client)
+		return refuse(RefusedResponseCode)
+	}
+
+	var messages []*DNSMessage
+	if q.Type == IXFRRecordType && (udp || !clientOutdated(req, zone)) {
+		resp := CreateResponse(req)
+		resp.Header.Flags.AA = true
+		resp.AddAnswers(zone.SOA())
+		messages = append(messages, resp)
+	} else {
+		log.Printf("transferring %s to %s", fqdn(zone.Origin), client)
+		var err error
+		if messages, err = transferMessages(req, zone); err != nil {
+			log.Printf("failed to transfer %s: %v", fqdn(zone.Origin), err)
+			return refuse(ServerFailureResponseCode)
+		}
+	}
+	var responses [][]byte
+	for _, msg := range messages {
+		response, err := msg.MarshalBinary()
+		if err != nil {
+			log.Printf("failed to marshal transfer response: %v", err)
+			return nil
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// clientOutdated reports whether the SOA record an IXFR request carries in its
+// authority section is older than the one of zone.
+func clientOutdated(req *DNSMessage, zone *Zone) bool {
+	for _, rr := range req.Authorities {
+		if soa, ok := rr.RData.(*SOARecord); ok {
+			return serialGreater(zone.Serial(), soa.Serial)
+		}
+	}
+	return true
+}
+
+// transferMessages splits the records of zone, starting and ending with its
+// SOA record, into the messages answering req. Only the first message holds
+// the question.
+func transferMessages(req *DNSMessage, zone *Zone) ([]*DNSMessage, error) {
+	records := append(append([]DNSAnswer{}, zone.Records()...), zone.SOA())
+
+	current := CreateResponse(req)
+	current.Header.Flags.AA = true
+	messages := []*DNSMessage{current}
+	var size int
+	for _, rr := range records {
+		// The uncompressed size is an upper bound of the encoded size
+		encoded, err := rr.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode record %s: %v", fqdn(rr.Name), err)
+		}
+		if size > 0 && size+len(encoded) > transferMessageSize {
+			current = CreateResponse(&DNSMessage{Header: req.Header})
+			current.Header.Flags.AA = true
+			messages = append(messages, current)
+			size = 0
+		}
+		current.AddAnswers(rr)
+		size += len(encoded)
+	}
+	return messages, nil
+}
+
+// acl lists the clients allowed to do an operation on a zone: the networks
+// they send from and the TSIG keys they sign with.
+type acl struct {
+	networks []*net.IPNet
+	keys     []string
+}
+
+// parseACLs reads origin=clients values, where clients is a comma separated
+// list of IP addresses, networks and key:name entries naming one of keys, into
+// the ACL of each origin.
+func parseACLs(values []string, keys map[string]*TSIGKey) (map[string]*acl, error) {
+	acls := map[string]*acl{}
+	for _, value := range values {
+		origin, clients, _ := strings.Cut(value, "=")
+		origin = canonicalName(origin)
+		if acls[origin] == nil {
+			acls[origin] = &acl{}
+		}
+		for _, client := range strings.Split(clients, ",") {
+			client = strings.TrimSpace(client)
+			if strings.HasPrefix(client, "key:") {
+				name := strings.TrimPrefix(client, "key:")
+				if keys[canonicalName(name)] == nil {
+					return nil, fmt.Errorf("unknown key %q for %s", name, fqdn(origin))
+				}
+				acls[origin].keys = append(acls[origin].keys, canonicalName(name))
+				continue
+			}
+			if !strings.Contains(client, "/") {
+				if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+					client += "/32"
+				} else {
+					client += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q for %s: %v", client, fqdn(origin), err)
+			}
+			acls[origin].networks = append(acls[origin].networks, network)
+		}
+	}
+	return acls, nil
+}
+
+// allows reports whether the IP address of client belongs to one of the
+// networks of the ACL, or its request was signed with one of its keys. key is
+// nil for unsigned requests.
+func (a *acl) allows(client net.Addr, key *TSIGKey) bool {
+	if a == nil {
+		return false
+	}
+	if key != nil {
+		for _, name := range a.keys {
+			if name == key.Name {
+				return true
+			}
+		}
+	}
+	ip := addrIP(client)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a TCP or UDP client, or nil.
+func addrIP(client net.Addr) net.IP {
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
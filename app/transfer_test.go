@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeZone returns a zone with enough records to need several transfer
+// messages.
+func largeZone(t *testing.T) *Zone {
+	t.Helper()
+	var content strings.Builder
+	content.WriteString("$TTL 3600\n@ SOA ns1 hostmaster 1 7200 900 604800 300\n  NS ns1\nns1 A 192.0.2.1\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&content, "host%d TXT \"%s\"\n", i, strings.Repeat("x", 100))
+	}
+	return newTestZone(t, "example.com", content.String())
+}
+
+// startTransferServer serves the zones of handler over TCP and returns a
+// connection to it.
+func startTransferServer(t *testing.T, handler *Handler) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveTCP(listener, handler)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	return conn
+}
+
+// exchangeTransfer sends an AXFR request for origin on conn and reads the
+// responses until the closing SOA record or an error response.
+func exchangeTransfer(t *testing.T, conn net.Conn, origin string) []*DNSMessage {
+	t.Helper()
+	req := newQuery(origin, AXFRRecordType)
+	req.Header.ID = 42
+	buf, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	if err := writeTCPMessage(conn, buf); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	var messages []*DNSMessage
+	var soas int
+	for soas < 2 {
+		buf, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		msg := &DNSMessage{}
+		if err := msg.UnmarshalBinary(buf); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		messages = append(messages, msg)
+		if msg.Header.Flags.RCODE != NoErrorResponseCode {
+			return messages
+		}
+		for _, rr := range msg.Answers {
+			if rr.Type == SOARecordType {
+				soas++
+			}
+		}
+	}
+	return messages
+}
+
+func TestHandler_Transfer(t *testing.T) {
+	zone := largeZone(t)
+	zones := NewZoneStore()
+	zones.Add(zone)
+	acls, err := parseACLs([]string{"example.com=192.0.2.0/24,127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatalf("failed to parse ACLs: %v", err)
+	}
+	conn := startTransferServer(t, &Handler{zones: zones, transferACLs: acls})
+
+	messages := exchangeTransfer(t, conn, "example.com")
+	if len(messages) < 2 {
+		t.Fatalf("expected the zone to be split into several messages but got %d", len(messages))
+	}
+	var records []DNSAnswer
+	for i, msg := range messages {
+		if msg.Header.ID != 42 || !msg.Header.Flags.AA {
+			t.Errorf("message %d has unexpected header %+v", i, msg.Header)
+		}
+		if (i == 0) != (len(msg.Questions) == 1) {
+			t.Errorf("expected only the first message to hold the question but message %d has %d", i, len(msg.Questions))
+		}
+		records = append(records, msg.Answers...)
+	}
+	if len(records) != len(zone.Records())+1 {
+		t.Fatalf("expected %d records but got %d", len(zone.Records())+1, len(records))
+	}
+	if records[0].Type != SOARecordType || records[len(records)-1].Type != SOARecordType {
+		t.Errorf("expected the transfer to start and end with the SOA record")
+	}
+}
+
+func TestHandler_TransferRefused(t *testing.T) {
+	zones := NewZoneStore()
+	zones.Add(newTestZone(t, "example.com", lookupZone))
+	acls, err := parseACLs([]string{"example.com=192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatalf("failed to parse ACLs: %v", err)
+	}
+	handler := &Handler{zones: zones, transferACLs: acls}
+
+	tcs := []struct {
+		name          string
+		origin        string
+		client        net.Addr
+		udp           bool
+		expectedRCODE uint16
+	}{
+		{
+			name:          "client not allowed",
+			origin:        "example.com",
+			client:        &net.TCPAddr{IP: net.IP{198, 51, 100, 1}},
+			expectedRCODE: RefusedResponseCode,
+		},
+		{
+			name:          "zone not served",
+			origin:        "example.net",
+			client:        &net.TCPAddr{IP: net.IP{192, 0, 2, 1}},
+			expectedRCODE: RefusedResponseCode,
+		},
+		{
+			name:          "over UDP",
+			origin:        "example.com",
+			client:        &net.UDPAddr{IP: net.IP{192, 0, 2, 1}},
+			udp:           true,
+			expectedRCODE: NotImplementedResponseCode,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			buf, err := newQuery(tc.origin, AXFRRecordType).MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			responses := handler.handleRequest(buf, tc.client, tc.udp)
+			if len(responses) != 1 {
+				t.Fatalf("expected a single response but got %d", len(responses))
+			}
+			var resp DNSMessage
+			if err := resp.UnmarshalBinary(responses[0]); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if resp.Header.Flags.RCODE != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+			}
+			if len(resp.Answers) != 0 {
+				t.Errorf("expected no records but got %d", len(resp.Answers))
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// TSIG algorithms
+	// See [RFC8945 6]
+	// [RFC8945 6]: https://datatracker.ietf.org/doc/html/rfc8945#section-6
+	HMACSHA256 = "hmac-sha256"
+	HMACSHA512 = "hmac-sha512"
+
+	// tsigFudge is the number of seconds the clocks of the signer and of the
+	// verifier may differ by.
+	tsigFudge = 300
+	// maxUnsignedMessages is the number of consecutive messages of a response
+	// that may be left unsigned.
+	// See [RFC8945 5.3.1]
+	// [RFC8945 5.3.1]: https://datatracker.ietf.org/doc/html/rfc8945#section-5.3.1
+	maxUnsignedMessages = 99
+)
+
+var (
+	// ErrBadKey is returned when a message is signed with an unknown key or
+	// algorithm.
+	ErrBadKey = errors.New("unknown TSIG key")
+	// ErrBadSignature is returned when the MAC of a message is wrong.
+	ErrBadSignature = errors.New("bad TSIG signature")
+	// ErrBadTime is returned when a message was signed too long ago or in the
+	// future.
+	ErrBadTime = errors.New("TSIG signature time out of range")
+	// ErrUnsigned is returned when a message that must be signed is not.
+	ErrUnsigned = errors.New("message not signed")
+)
+
+// TSIGKey is a secret shared with another server to authenticate the messages
+// exchanged with it.
+type TSIGKey struct {
+	// Name is the name of the key, lowercased and without trailing dot.
+	Name string
+	// Algorithm is one of HMACSHA256 and HMACSHA512.
+	Algorithm string
+	Secret    []byte
+}
+
+// newMAC returns the HMAC computing the signatures made with the key.
+func (k *TSIGKey) newMAC() hash.Hash {
+	if k.Algorithm == HMACSHA512 {
+		return hmac.New(sha512.New, k.Secret)
+	}
+	return hmac.New(sha256.New, k.Secret)
+}
+
+// recordSize returns the size of the TSIG records signing messages with the
+// key.
+func (k *TSIGKey) recordSize() int {
+	rr := DNSAnswer{
+		Name:  k.Name,
+		Type:  TSIGRecordType,
+		Class: ANYRecordClass,
+		RData: &TSIGRecord{Algorithm: k.Algorithm, MAC: make([]byte, k.newMAC().Size()), OtherData: make([]byte, 6)},
+	}
+	buf, err := rr.MarshalBinary()
+	if err != nil {
+		return 0
+	}
+	return len(buf)
+}
+
+// ParseTSIGKeys reads TSIG keys, one per line, made of the name of the key,
+// its algorithm and its base64 encoded secret:
+//
+//	# shared with the secondaries
+//	transfer-key hmac-sha256 c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1zZWNvbmRhcmllcw==
+//
+// Empty lines and lines starting with # are ignored.
+func ParseTSIGKeys(r io.Reader) (map[string]*TSIGKey, error) {
+	keys := map[string]*TSIGKey{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected a key name, algorithm and secret but got %q", line, text)
+		}
+
+		key := &TSIGKey{Name: canonicalName(fields[0]), Algorithm: canonicalName(fields[1])}
+		if keys[key.Name] != nil {
+			return nil, fmt.Errorf("line %d: duplicate key %s", line, fields[0])
+		}
+		if key.Algorithm != HMACSHA256 && key.Algorithm != HMACSHA512 {
+			return nil, fmt.Errorf("line %d: unsupported algorithm %s", line, fields[1])
+		}
+		secret, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid secret: %v", line, err)
+		}
+		key.Secret = secret
+		keys[key.Name] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read TSIG keys: %v", err)
+	}
+	return keys, nil
+}
+
+// LoadTSIGKeys reads the TSIG keys of the file at path.
+func LoadTSIGKeys(path string) (map[string]*TSIGKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TSIG keys: %v", err)
+	}
+	defer f.Close()
+	keys, err := ParseTSIGKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TSIG keys %s: %v", path, err)
+	}
+	return keys, nil
+}
+
+// keyNamed returns the key of keys with the given name, or nil when name is
+// empty.
+func keyNamed(keys map[string]*TSIGKey, name string) (*TSIGKey, error) {
+	if name == "" {
+		return nil, nil
+	}
+	key := keys[canonicalName(name)]
+	if key == nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadKey, name)
+	}
+	return key, nil
+}
+
+// tsigSession signs or verifies the messages of an exchange authenticated with
+// a TSIG key: a request and its responses, of which there are several in zone
+// transfers. The MAC of each response covers the MAC of the previous message
+// so that messages can't be removed, reordered or replayed.
+// See [RFC8945 5.3]
+// [RFC8945 5.3]: https://datatracker.ietf.org/doc/html/rfc8945#section-5.3
+type tsigSession struct {
+	key *TSIGKey
+	now func() time.Time
+
+	// messages counts the messages signed or verified so far.
+	messages int
+	// mac is the MAC of the last signed message.
+	mac []byte
+	// unsigned holds the messages received without TSIG record since the last
+	// signed one, whose MAC must cover them.
+	unsigned [][]byte
+}
+
+func newTSIGSession(key *TSIGKey) *tsigSession {
+	return &tsigSession{key: key, now: time.Now}
+}
+
+// sign appends to the encoded message msg a TSIG record signing it.
+func (s *tsigSession) sign(msg []byte) ([]byte, error) {
+	return s.signWith(msg, NoErrorResponseCode, nil, uint64(s.now().Unix()))
+}
+
+// signWith is like sign but sets the error, other data and time fields of
+// the TSIG record.
+func (s *tsigSession) signWith(msg []byte, tsigErr uint16, otherData []byte, timeSigned uint64) ([]byte, error) {
+	if len(msg) < headerLength {
+		return nil, fmt.Errorf("%w: message shorter than its header", ErrTruncated)
+	}
+	tsig := &TSIGRecord{
+		Algorithm:  s.key.Algorithm,
+		TimeSigned: timeSigned,
+		Fudge:      tsigFudge,
+		OriginalID: binary.BigEndian.Uint16(msg),
+		Error:      tsigErr,
+		OtherData:  otherData,
+	}
+	tsig.MAC = s.digest(tsig, msg)
+	s.mac = tsig.MAC
+	s.messages++
+	return appendTSIG(msg, s.key.Name, tsig)
+}
+
+// verify checks the TSIG record of the encoded message data. Only the
+// messages of a response following its first one may be unsigned, the next
+// signed message covers them.
+func (s *tsigSession) verify(data []byte) error {
+	unsigned, rr, err := splitTSIG(data)
+	if err != nil {
+		return err
+	}
+	if rr == nil {
+		if s.messages < 2 || len(s.unsigned) >= maxUnsignedMessages {
+			return ErrUnsigned
+		}
+		s.unsigned = append(s.unsigned, data)
+		return nil
+	}
+
+	tsig := rr.RData.(*TSIGRecord)
+	if canonicalName(rr.Name) != s.key.Name || canonicalName(tsig.Algorithm) != s.key.Algorithm {
+		return fmt.Errorf("%w: %s", ErrBadKey, fqdn(rr.Name))
+	}
+	if tsig.Error != NoErrorResponseCode && len(tsig.MAC) == 0 {
+		return fmt.Errorf("signature rejected with TSIG error %d", tsig.Error)
+	}
+	// Truncated MACs are not supported
+	expected := s.digest(tsig, append(s.unsigned, unsigned)...)
+	if !hmac.Equal(expected, tsig.MAC) {
+		return ErrBadSignature
+	}
+	s.mac = tsig.MAC
+	s.unsigned = nil
+	s.messages++
+
+	if tsig.Error != NoErrorResponseCode {
+		return fmt.Errorf("signature rejected with TSIG error %d", tsig.Error)
+	}
+	now := uint64(s.now().Unix())
+	if now > tsig.TimeSigned+uint64(tsig.Fudge) || tsig.TimeSigned > now+uint64(tsig.Fudge) {
+		return ErrBadTime
+	}
+	return nil
+}
+
+// digest returns the MAC of messages, encoded without TSIG record and with
+// their original ID, signed by tsig. The MAC covers the MAC of the previous
+// message, except for requests, and all the variables of tsig for the first
+// two messages of the exchange but only its timers afterwards.
+// See [RFC8945 4.3]
+// [RFC8945 4.3]: https://datatracker.ietf.org/doc/html/rfc8945#section-4.3
+func (s *tsigSession) digest(tsig *TSIGRecord, messages ...[]byte) []byte {
+	mac := s.key.newMAC()
+	if s.messages > 0 {
+		binary.Write(mac, binary.BigEndian, uint16(len(s.mac)))
+		mac.Write(s.mac)
+	}
+	for _, msg := range messages {
+		mac.Write(msg)
+	}
+
+	var variables bytes.Buffer
+	if s.messages < 2 {
+		writeDomain(&variables, s.key.Name, nil)
+		binary.Write(&variables, binary.BigEndian, uint16(ANYRecordClass))
+		binary.Write(&variables, binary.BigEndian, uint32(0))
+		writeDomain(&variables, s.key.Algorithm, nil)
+	}
+	binary.Write(&variables, binary.BigEndian, uint16(tsig.TimeSigned>>32))
+	binary.Write(&variables, binary.BigEndian, uint32(tsig.TimeSigned))
+	binary.Write(&variables, binary.BigEndian, tsig.Fudge)
+	if s.messages < 2 {
+		binary.Write(&variables, binary.BigEndian, tsig.Error)
+		binary.Write(&variables, binary.BigEndian, uint16(len(tsig.OtherData)))
+		variables.Write(tsig.OtherData)
+	}
+	mac.Write(variables.Bytes())
+	return mac.Sum(nil)
+}
+
+// appendTSIG returns the encoded message msg with the TSIG record of the key
+// named name appended to its additional section.
+func appendTSIG(msg []byte, name string, tsig *TSIGRecord) ([]byte, error) {
+	rr := DNSAnswer{Name: name, Type: TSIGRecordType, Class: ANYRecordClass, RData: tsig}
+	buff := bytes.NewBuffer(append([]byte{}, msg...))
+	if err := rr.marshal(buff, nil); err != nil {
+		return nil, err
+	}
+	signed := buff.Bytes()
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed, nil
+}
+
+// splitTSIG returns the TSIG record of the encoded message data, which must
+// be its last record, and the message as it was before being signed: without
+// the TSIG record and with its original ID. The record is nil when the
+// message isn't signed.
+func splitTSIG(data []byte) ([]byte, *DNSAnswer, error) {
+	r := bytes.NewReader(data)
+	var header DNSHeader
+	if err := readHeader(r, &header); err != nil {
+		return nil, nil, err
+	}
+	if header.ARCOUNT == 0 {
+		return data, nil, nil
+	}
+	pos := headerLength
+	_, n, err := readQuestions(r, pos, header.QDCOUNT)
+	if err != nil {
+		return nil, nil, err
+	}
+	pos += n
+	for _, count := range []uint16{header.ANCOUNT, header.NSCOUNT, header.ARCOUNT - 1} {
+		_, n, err := readAnswers(r, data, pos, count)
+		if err != nil {
+			return nil, nil, err
+		}
+		pos += n
+	}
+	rr, _, err := readAnswer(r, data, pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	tsig, ok := rr.RData.(*TSIGRecord)
+	if !ok {
+		return data, nil, nil
+	}
+
+	unsigned := append([]byte{}, data[:pos]...)
+	binary.BigEndian.PutUint16(unsigned, tsig.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:], header.ARCOUNT-1)
+	return unsigned, &rr, nil
+}
+
+// TSIG returns the TSIG record signing the message, or nil.
+func (msg *DNSMessage) TSIG() *DNSAnswer {
+	if len(msg.Additionals) == 0 {
+		return nil
+	}
+	rr := &msg.Additionals[len(msg.Additionals)-1]
+	if rr.Type != TSIGRecordType {
+		return nil
+	}
+	return rr
+}
+
+// misplacedTSIG reports whether msg holds a TSIG record anywhere else than at
+// the end of its additional section.
+func (msg *DNSMessage) misplacedTSIG() bool {
+	sections := [][]DNSAnswer{msg.Answers, msg.Authorities, msg.Additionals}
+	for i, records := range sections {
+		for j, rr := range records {
+			last := i == len(sections)-1 && j == len(records)-1
+			if rr.Type == TSIGRecordType && !last {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeTSIG removes the TSIG record signing the message, once checked.
+func (msg *DNSMessage) removeTSIG() {
+	if msg.TSIG() != nil {
+		msg.Additionals = msg.Additionals[:len(msg.Additionals)-1]
+		msg.Header.ARCOUNT--
+	}
+}
+
+// verifyRequest checks the TSIG record tsig, owned by the key name, of the
+// encoded request data and returns the session signing the responses. The
+// session is also returned along ErrBadTime, whose response must be signed.
+// See [RFC8945 5.2]
+// [RFC8945 5.2]: https://datatracker.ietf.org/doc/html/rfc8945#section-5.2
+func (h *Handler) verifyRequest(data []byte, name string, tsig *TSIGRecord) (*tsigSession, error) {
+	key := h.keys[canonicalName(name)]
+	if key == nil || canonicalName(tsig.Algorithm) != key.Algorithm {
+		return nil, ErrBadKey
+	}
+	session := newTSIGSession(key)
+	if err := session.verify(data); err != nil {
+		if errors.Is(err, ErrBadTime) {
+			return session, err
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// tsigErrorResponse returns the NOTAUTH response to req, whose TSIG record
+// requestTSIG, owned by the key name, failed verification with err. Only BADTIME responses are signed, with the
+// time of the server in the other data of their TSIG record.
+// See [RFC8945 5.2]
+// [RFC8945 5.2]: https://datatracker.ietf.org/doc/html/rfc8945#section-5.2
+func (h *Handler) tsigErrorResponse(req *DNSMessage, name string, requestTSIG *TSIGRecord, session *tsigSession, err error) [][]byte {
+	if req.Header.Flags.QR {
+		return nil
+	}
+	tsigErr := uint16(BadSignatureResponseCode)
+	switch {
+	case errors.Is(err, ErrBadKey):
+		tsigErr = BadKeyResponseCode
+	case errors.Is(err, ErrBadTime):
+		tsigErr = BadTimeResponseCode
+	}
+
+	resp := CreateResponse(req)
+	resp.Header.Flags.RCODE = NotAuthResponseCode
+	response, err := resp.MarshalBinary()
+	if err != nil {
+		log.Printf("failed to marshal TSIG error response: %v", err)
+		return nil
+	}
+	if session != nil && tsigErr == BadTimeResponseCode {
+		now := make([]byte, 8)
+		binary.BigEndian.PutUint64(now, uint64(session.now().Unix()))
+		response, err = session.signWith(response, tsigErr, now[2:], requestTSIG.TimeSigned)
+	} else {
+		response, err = appendTSIG(response, name, &TSIGRecord{
+			Algorithm:  requestTSIG.Algorithm,
+			TimeSigned: uint64(time.Now().Unix()),
+			Fudge:      tsigFudge,
+			OriginalID: req.Header.ID,
+			Error:      tsigErr,
+		})
+	}
+	if err != nil {
+		log.Printf("failed to sign TSIG error response: %v", err)
+		return nil
+	}
+	return [][]byte{response}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testKeys returns the TSIG keys shared by the tests and the server they talk
+// to.
+func testKeys(t *testing.T) map[string]*TSIGKey {
+	t.Helper()
+	keys, err := ParseTSIGKeys(strings.NewReader(`
+		# shared with the secondaries
+		transfer-key. hmac-sha256 c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1zZWNvbmRhcmllcw==
+		update-key    hmac-sha512 dXBkYXRlLXNlY3JldA==
+	`))
+	if err != nil {
+		t.Fatalf("failed to parse keys: %v", err)
+	}
+	return keys
+}
+
+func TestParseTSIGKeys(t *testing.T) {
+	keys := testKeys(t)
+	expected := map[string]*TSIGKey{
+		"transfer-key": {Name: "transfer-key", Algorithm: HMACSHA256, Secret: []byte("secret-shared-with-the-secondaries")},
+		"update-key":   {Name: "update-key", Algorithm: HMACSHA512, Secret: []byte("update-secret")},
+	}
+	if diff := cmp.Diff(expected, keys); diff != "" {
+		t.Errorf("keys do not match: %s", diff)
+	}
+
+	tcs := []struct {
+		name    string
+		content string
+	}{
+		{name: "missing secret", content: "key hmac-sha256"},
+		{name: "unsupported algorithm", content: "key hmac-md5.sig-alg.reg.int c2VjcmV0"},
+		{name: "invalid secret", content: "key hmac-sha256 not-base64!"},
+		{name: "duplicate key", content: "key hmac-sha256 c2VjcmV0\nKey. hmac-sha512 c2VjcmV0"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseTSIGKeys(strings.NewReader(tc.content)); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+// signedQuery returns the encoded query for name and rrType signed by session.
+func signedQuery(t *testing.T, session *tsigSession, name string, rrType uint16) []byte {
+	t.Helper()
+	req := newQuery(name, rrType)
+	req.Header.ID = 42
+	buf, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+	signed, err := session.sign(buf)
+	if err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	return signed
+}
+
+func TestTSIGSession(t *testing.T) {
+	keys := testKeys(t)
+	key := keys["transfer-key"]
+	now := time.Unix(1700000000, 0)
+
+	tcs := []struct {
+		name string
+		// verifier is the key verifying the messages.
+		verifier *TSIGKey
+		// skew is how far the clock of the verifier is from the signer's.
+		skew time.Duration
+		// tamper modifies the signed request.
+		tamper        func(buf []byte)
+		expectedError error
+	}{
+		{name: "valid signature", verifier: key},
+		{name: "clocks within the fudge", verifier: key, skew: -tsigFudge * time.Second},
+		{name: "other key", verifier: keys["update-key"], expectedError: ErrBadKey},
+		{
+			name:          "other secret",
+			verifier:      &TSIGKey{Name: key.Name, Algorithm: key.Algorithm, Secret: []byte("guess")},
+			expectedError: ErrBadSignature,
+		},
+		{name: "modified message", verifier: key, tamper: func(buf []byte) { buf[2] ^= 0x01 }, expectedError: ErrBadSignature},
+		{name: "modified ID", verifier: key, tamper: func(buf []byte) { buf[0] ^= 0x01 }},
+		{name: "clocks too far apart", verifier: key, skew: (tsigFudge + 1) * time.Second, expectedError: ErrBadTime},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			signer := newTSIGSession(key)
+			signer.now = func() time.Time { return now }
+			verifier := newTSIGSession(tc.verifier)
+			verifier.now = func() time.Time { return now.Add(tc.skew) }
+
+			buf := signedQuery(t, signer, "example.com", ARecordType)
+			if tc.tamper != nil {
+				tc.tamper(buf)
+			}
+			if err := verifier.verify(buf); !errors.Is(err, tc.expectedError) {
+				t.Errorf("expected error %v but got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestTSIGSession_MultipleMessages(t *testing.T) {
+	key := testKeys(t)["transfer-key"]
+	client := newTSIGSession(key)
+	server := newTSIGSession(key)
+
+	if err := server.verify(signedQuery(t, client, "example.com", AXFRRecordType)); err != nil {
+		t.Fatalf("failed to verify request: %v", err)
+	}
+	var responses [][]byte
+	for i := 0; i < 4; i++ {
+		resp := newQuery("example.com", AXFRRecordType)
+		resp.Header.ID = 42
+		resp.Header.Flags.QR = true
+		buf, err := resp.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to marshal response: %v", err)
+		}
+		if buf, err = server.sign(buf); err != nil {
+			t.Fatalf("failed to sign response: %v", err)
+		}
+		responses = append(responses, buf)
+	}
+
+	for i, buf := range responses {
+		if err := client.verify(buf); err != nil {
+			t.Fatalf("failed to verify response %d: %v", i, err)
+		}
+	}
+
+	// A response can't be replayed in another position
+	replay := newTSIGSession(key)
+	if err := replay.verify(signedQuery(t, newTSIGSession(key), "example.com", AXFRRecordType)); err != nil {
+		t.Fatalf("failed to verify request: %v", err)
+	}
+	if err := replay.verify(responses[3]); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("expected error %v but got %v", ErrBadSignature, err)
+	}
+	// The first response must be signed
+	unsigned, _, err := splitTSIG(responses[0])
+	if err != nil {
+		t.Fatalf("failed to split response: %v", err)
+	}
+	first := newTSIGSession(key)
+	if err := first.verify(signedQuery(t, newTSIGSession(key), "example.com", AXFRRecordType)); err != nil {
+		t.Fatalf("failed to verify request: %v", err)
+	}
+	if err := first.verify(unsigned); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("expected error %v but got %v", ErrUnsigned, err)
+	}
+}
+
+func TestHandler_TSIG(t *testing.T) {
+	keys := testKeys(t)
+	zones := NewZoneStore()
+	zones.Add(newTestZone(t, "example.com", lookupZone))
+	acls, err := parseACLs([]string{"example.com=key:transfer-key"}, keys)
+	if err != nil {
+		t.Fatalf("failed to parse ACLs: %v", err)
+	}
+	handler := &Handler{zones: zones, transferACLs: acls, keys: keys}
+	client := &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 5353}
+
+	tcs := []struct {
+		name             string
+		key              *TSIGKey
+		skew             time.Duration
+		expectedRCODE    uint16
+		expectedTSIGErr  uint16
+		expectedVerified bool
+	}{
+		{
+			name:             "allowed key",
+			key:              keys["transfer-key"],
+			expectedRCODE:    NoErrorResponseCode,
+			expectedVerified: true,
+		},
+		{
+			name:             "key not allowed",
+			key:              keys["update-key"],
+			expectedRCODE:    RefusedResponseCode,
+			expectedVerified: true,
+		},
+		{
+			name:            "unknown key",
+			key:             &TSIGKey{Name: "other-key", Algorithm: HMACSHA256, Secret: []byte("secret")},
+			expectedRCODE:   NotAuthResponseCode,
+			expectedTSIGErr: BadKeyResponseCode,
+		},
+		{
+			name:            "wrong secret",
+			key:             &TSIGKey{Name: "transfer-key", Algorithm: HMACSHA256, Secret: []byte("guess")},
+			expectedRCODE:   NotAuthResponseCode,
+			expectedTSIGErr: BadSignatureResponseCode,
+		},
+		{
+			name:             "clocks too far apart",
+			key:              keys["transfer-key"],
+			skew:             time.Hour,
+			expectedRCODE:    NotAuthResponseCode,
+			expectedTSIGErr:  BadTimeResponseCode,
+			expectedVerified: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			session := newTSIGSession(tc.key)
+			session.now = func() time.Time { return time.Now().Add(tc.skew) }
+			responses := handler.handleRequest(signedQuery(t, session, "example.com", AXFRRecordType), client, false)
+			if len(responses) == 0 {
+				t.Fatalf("expected a response")
+			}
+
+			for i, buf := range responses {
+				var resp DNSMessage
+				if err := resp.UnmarshalBinary(buf); err != nil {
+					t.Fatalf("failed to unmarshal response %d: %v", i, err)
+				}
+				if resp.Header.Flags.RCODE != tc.expectedRCODE {
+					t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+				}
+				rr := resp.TSIG()
+				if rr == nil {
+					t.Fatalf("expected response %d to be signed", i)
+				}
+				if tsigErr := rr.RData.(*TSIGRecord).Error; tsigErr != tc.expectedTSIGErr {
+					t.Errorf("expected TSIG error %d but got %d", tc.expectedTSIGErr, tsigErr)
+				}
+				if !tc.expectedVerified {
+					continue
+				}
+				// The verifier shares the clock of the server
+				session.now = time.Now
+				err := session.verify(buf)
+				if tc.expectedTSIGErr == NoErrorResponseCode && err != nil {
+					t.Errorf("failed to verify response %d: %v", i, err)
+				}
+				if tc.expectedTSIGErr != NoErrorResponseCode && (err == nil || errors.Is(err, ErrBadSignature)) {
+					t.Errorf("expected the signed TSIG error but got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_MalformedTSIG(t *testing.T) {
+	keys := testKeys(t)
+	zones := NewZoneStore()
+	zones.Add(newTestZone(t, "example.com", lookupZone))
+	handler := &Handler{zones: zones, keys: keys}
+	client := &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 5353}
+
+	emptyTSIG := func(name string) DNSAnswer {
+		return DNSAnswer{Name: name, Type: TSIGRecordType, Class: ANYRecordClass, Data: []byte{}}
+	}
+	tsig := DNSAnswer{
+		Name: "transfer-key", Type: TSIGRecordType, Class: ANYRecordClass,
+		RData: &TSIGRecord{Algorithm: HMACSHA256, TimeSigned: uint64(time.Now().Unix()), Fudge: tsigFudge, MAC: []byte{1}},
+	}
+	glue := DNSAnswer{Name: "ns.example.com", Type: ARecordType, Class: INRecordClass, TTL: 60, RData: &ARecord{IP: net.IP{192, 0, 2, 53}}}
+
+	tcs := []struct {
+		name        string
+		answers     []DNSAnswer
+		additionals []DNSAnswer
+	}{
+		{name: "empty rdata with a known key", additionals: []DNSAnswer{emptyTSIG("transfer-key")}},
+		{name: "empty rdata with an unknown key", additionals: []DNSAnswer{emptyTSIG("unknown-key")}},
+		{name: "TSIG before the last record", additionals: []DNSAnswer{tsig, glue}},
+		{name: "TSIG in the answer section", answers: []DNSAnswer{tsig}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := newQuery("www.example.com", ARecordType)
+			req.Header.ID = 1234
+			req.AddAnswers(tc.answers...)
+			req.AddAdditionals(tc.additionals...)
+			buf, err := req.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+
+			responses := handler.handleRequest(buf, client, true)
+			if len(responses) != 1 {
+				t.Fatalf("expected a single response but got %d", len(responses))
+			}
+			var resp DNSMessage
+			if err := resp.UnmarshalBinary(responses[0]); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if resp.Header.ID != 1234 || resp.RCODE() != FormatErrorResponseCode {
+				t.Errorf("expected FORMERR for request 1234 but got RCODE %d for request %d", resp.RCODE(), resp.Header.ID)
+			}
+		})
+	}
+}
+
+func TestTransferRecords_TSIG(t *testing.T) {
+	keys := testKeys(t)
+	zone := largeZone(t)
+	zones := NewZoneStore()
+	zones.Add(zone)
+	acls, err := parseACLs([]string{"example.com=key:transfer-key"}, keys)
+	if err != nil {
+		t.Fatalf("failed to parse ACLs: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go serveTCP(listener, &Handler{zones: zones, transferACLs: acls, keys: keys})
+
+	req := newQuery("example.com", AXFRRecordType)
+	records, err := transferRecords(listener.Addr().String(), req, 5*time.Second, keys["transfer-key"])
+	if err != nil {
+		t.Fatalf("failed to transfer zone: %v", err)
+	}
+	if len(records) != len(zone.Records())+1 {
+		t.Errorf("expected %d records but got %d", len(zone.Records())+1, len(records))
+	}
+	for _, rr := range records {
+		if rr.Type == TSIGRecordType {
+			t.Fatalf("expected the TSIG records to be removed")
+		}
+	}
+
+	if _, err := transferRecords(listener.Addr().String(), req, 5*time.Second, keys["update-key"]); err == nil {
+		t.Errorf("expected the transfer with a key not allowed to fail")
+	}
+}
+
+func TestResolver_TSIG(t *testing.T) {
+	keys := testKeys(t)
+	zones := NewZoneStore()
+	zones.Add(newTestZone(t, "example.com", lookupZone))
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go serveUDP(conn, &Handler{zones: zones, keys: keys}, 1, 1)
+
+	resolver, err := NewResolver(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	defer resolver.Close()
+	resolver.SetTSIGKey(keys["update-key"])
+
+	resp, err := resolver.SendRequest(newQuery("www.example.com", ARecordType))
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	if resp.TSIG() != nil {
+		t.Errorf("expected the TSIG record to be removed")
+	}
+	expected := []string{"www.example.com 1 192.0.2.2", "www.example.com 1 192.0.2.3"}
+	if diff := cmp.Diff(expected, recordStrings(resp.Answers)); diff != "" {
+		t.Errorf("answers do not match: %s", diff)
+	}
+
+	// Responses signed with another key are dropped
+	resolver.key = &TSIGKey{Name: "update-key", Algorithm: HMACSHA512, Secret: []byte("guess")}
+	resolver.timeout = 200 * time.Millisecond
+	if _, err := resolver.SendRequest(newQuery("www.example.com", ARecordType)); err == nil {
+		t.Errorf("expected the unauthenticated response to be dropped")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+)
+
+// udpRequest is a datagram waiting to be processed by a worker. data is owned
+// by the request so that the read buffer can be reused right away.
+type udpRequest struct {
+	data   []byte
+	source *net.UDPAddr
+}
+
+// serveUDP reads requests from udpConn and dispatches them to a pool of
+// workers. When every worker is busy and the queue is full, reading stops
+// until a worker is available so that the kernel socket buffer absorbs the
+// load instead of the heap.
+func serveUDP(udpConn *net.UDPConn, handler *Handler, workers int, queueSize int) {
+	requests := make(chan udpRequest, queueSize)
+	defer close(requests)
+	for i := 0; i < workers; i++ {
+		go udpWorker(udpConn, handler, requests)
+	}
+
+	buf := make([]byte, maxUDPSize)
+
+	for {
+		size, source, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error receiving data: %v", err)
+			continue
+		}
+
+		req := udpRequest{
+			data:   make([]byte, size),
+			source: source,
+		}
+		copy(req.data, buf[:size])
+
+		select {
+		case requests <- req:
+		default:
+			log.Printf("all %d workers busy, waiting before reading more requests", workers)
+			requests <- req
+		}
+	}
+}
+
+func udpWorker(udpConn *net.UDPConn, handler *Handler, requests <-chan udpRequest) {
+	for req := range requests {
+		log.Printf("processing request from %s: %s", req.source, hex.EncodeToString(req.data))
+
+		for _, response := range handler.handleRequest(req.data, req.source, true) {
+			_, err := udpConn.WriteToUDP(response, req.source)
+			if err != nil {
+				log.Println("Failed to send response:", err)
+			}
+		}
+		log.Printf("request processed %s", req.source)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeUDP(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveUDP(serverConn, &Handler{}, 2, 1)
+		close(done)
+	}()
+
+	client, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer client.Close()
+
+	// Server status queries are answered without reaching the resolver
+	ids := map[uint16]bool{1: true, 2: true, 3: true}
+	for id := range ids {
+		req := DNSMessage{
+			Header: DNSHeader{
+				ID:    id,
+				Flags: DNSHeaderFlags{OPCODE: ServerStatusOpCode},
+			},
+		}
+		buf, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to marshal request: %v", err)
+		}
+		if _, err := client.Write(buf); err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+	}
+
+	if err := client.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("failed to set read deadline: %v", err)
+	}
+	buf := make([]byte, minUDPSize)
+	for range []int{1, 2, 3} {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		var resp DNSMessage
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		if !ids[resp.Header.ID] {
+			t.Errorf("unexpected response ID %d", resp.Header.ID)
+		}
+		delete(ids, resp.Header.ID)
+	}
+
+	serverConn.Close()
+	<-done
+}
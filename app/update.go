@@ -0,0 +1,308 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// update answers an UPDATE request from client, which adds and deletes
+// records of the zone named in its zone section (the question section) when
+// the prerequisites in its prerequisite section (the answer section) hold.
+// The changes listed in its update section (the authority section) are all
+// applied at once, to a new version of the zone with an incremented serial.
+// Updated zones live in memory only and are lost on restart.
+// See [RFC2136 3]
+// [RFC2136 3]: https://datatracker.ietf.org/doc/html/rfc2136#section-3
+func (h *Handler) update(req *DNSMessage, client net.Addr, key *TSIGKey) [][]byte {
+	if req.Header.Flags.QR {
+		return nil
+	}
+
+	resp := CreateResponse(req)
+	resp.Header.Flags.RCODE = h.applyUpdate(req, client, key)
+	response, err := resp.MarshalBinary()
+	if err != nil {
+		log.Printf("failed to marshal update response: %v", err)
+		return nil
+	}
+	return [][]byte{response}
+}
+
+// applyUpdate applies req from client, signed with key when it is not nil, to
+// the zone store and returns the RCODE of the response.
+func (h *Handler) applyUpdate(req *DNSMessage, client net.Addr, key *TSIGKey) uint16 {
+	// See [RFC2136 3.1]
+	// [RFC2136 3.1]: https://datatracker.ietf.org/doc/html/rfc2136#section-3.1
+	if len(req.Questions) != 1 || req.Questions[0].Type != SOARecordType {
+		return FormatErrorResponseCode
+	}
+	origin := canonicalName(req.Questions[0].Name)
+
+	// Updates are serialized so that none is lost between reading the zone
+	// and storing its new version
+	h.updateMu.Lock()
+	defer h.updateMu.Unlock()
+	zone := h.zones.Get(origin)
+	if zone == nil || h.secondaries[origin] != nil {
+		return NotAuthResponseCode
+	}
+	if !h.updateACLs[origin].allows(client, key) {
+		log.Printf("refusing update of zone %s from %s", fqdn(origin), client)
+		return RefusedResponseCode
+	}
+	if rcode := checkPrerequisites(zone, req.Answers); rcode != NoErrorResponseCode {
+		return rcode
+	}
+	if rcode := checkUpdates(zone, req.Authorities); rcode != NoErrorResponseCode {
+		return rcode
+	}
+
+	records := applyUpdates(zone, req.Authorities)
+	if !changedRecords(zone.Records(), records) {
+		return NoErrorResponseCode
+	}
+	// See [RFC2136 3.6]
+	// [RFC2136 3.6]: https://datatracker.ietf.org/doc/html/rfc2136#section-3.6
+	if !serialGreater(soaSerial(records[0]), zone.Serial()) {
+		soa := *records[0].RData.(*SOARecord)
+		soa.Serial = zone.Serial() + 1
+		records[0].RData = &soa
+	}
+	updated, err := NewZone(origin, records)
+	if err != nil {
+		log.Printf("failed to update zone %s: %v", fqdn(origin), err)
+		return ServerFailureResponseCode
+	}
+	h.zones.Add(updated)
+	log.Printf("zone %s updated by %s to serial %d", fqdn(origin), client, updated.Serial())
+	return NoErrorResponseCode
+}
+
+// checkPrerequisites returns the RCODE of the first prerequisite that doesn't
+// hold in zone, or NOERROR when they all hold.
+// See [RFC2136 3.2]
+// [RFC2136 3.2]: https://datatracker.ietf.org/doc/html/rfc2136#section-3.2
+func checkPrerequisites(zone *Zone, prerequisites []DNSAnswer) uint16 {
+	type rrsetKey struct {
+		name   string
+		rrType uint16
+	}
+	var keys []rrsetKey
+	rrsets := map[rrsetKey][]DNSAnswer{}
+
+	for _, rr := range prerequisites {
+		name := canonicalName(rr.Name)
+		if rr.TTL != 0 {
+			return FormatErrorResponseCode
+		}
+		if !inZone(name, zone.Origin) {
+			return NotZoneResponseCode
+		}
+		switch rr.Class {
+		case ANYRecordClass:
+			if hasData(rr) {
+				return FormatErrorResponseCode
+			}
+			if rr.Type == ANYRecordType {
+				if len(zone.nodes[name]) == 0 {
+					return NameErrorResponseCode
+				}
+			} else if len(zone.rrset(name, rr.Type)) == 0 {
+				return NXRRSetResponseCode
+			}
+		case NONERecordClass:
+			if hasData(rr) {
+				return FormatErrorResponseCode
+			}
+			if rr.Type == ANYRecordType {
+				if len(zone.nodes[name]) > 0 {
+					return YXDomainResponseCode
+				}
+			} else if len(zone.rrset(name, rr.Type)) > 0 {
+				return YXRRSetResponseCode
+			}
+		case zone.SOA().Class:
+			// The RRset must be exactly the one of the prerequisites
+			key := rrsetKey{name: name, rrType: rr.Type}
+			if _, ok := rrsets[key]; !ok {
+				keys = append(keys, key)
+			}
+			rrsets[key] = append(rrsets[key], rr)
+		default:
+			return FormatErrorResponseCode
+		}
+	}
+
+	for _, key := range keys {
+		if !sameRRSet(zone.rrset(key.name, key.rrType), rrsets[key]) {
+			return NXRRSetResponseCode
+		}
+	}
+	return NoErrorResponseCode
+}
+
+// checkUpdates returns the RCODE of the first malformed update, or NOERROR
+// when they can all be applied to zone.
+// See [RFC2136 3.4.1]
+// [RFC2136 3.4.1]: https://datatracker.ietf.org/doc/html/rfc2136#section-3.4.1
+func checkUpdates(zone *Zone, updates []DNSAnswer) uint16 {
+	for _, rr := range updates {
+		if !inZone(canonicalName(rr.Name), zone.Origin) {
+			return NotZoneResponseCode
+		}
+		switch rr.Class {
+		case zone.SOA().Class:
+			if isMetaType(rr.Type) || (rr.RData == nil && newRData(rr.Type) != nil) {
+				return FormatErrorResponseCode
+			}
+		case ANYRecordClass:
+			if rr.TTL != 0 || hasData(rr) || (isMetaType(rr.Type) && rr.Type != ANYRecordType) {
+				return FormatErrorResponseCode
+			}
+		case NONERecordClass:
+			if rr.TTL != 0 || isMetaType(rr.Type) {
+				return FormatErrorResponseCode
+			}
+		default:
+			return FormatErrorResponseCode
+		}
+	}
+	return NoErrorResponseCode
+}
+
+// applyUpdates returns the records of zone once updates are applied, with
+// the SOA record first. The SOA record and the last NS record of the origin
+// are never deleted.
+// See [RFC2136 3.4.2]
+// [RFC2136 3.4.2]: https://datatracker.ietf.org/doc/html/rfc2136#section-3.4.2
+func applyUpdates(zone *Zone, updates []DNSAnswer) []DNSAnswer {
+	records := append([]DNSAnswer{}, zone.Records()...)
+	for _, rr := range updates {
+		name := canonicalName(rr.Name)
+		apex := name == zone.Origin
+		switch rr.Class {
+		case ANYRecordClass:
+			// Delete an RRset, or all the RRsets of a name
+			kept := records[:0]
+			for _, other := range records {
+				if canonicalName(other.Name) != name ||
+					(apex && (other.Type == SOARecordType || other.Type == NSRecordType)) ||
+					(rr.Type != ANYRecordType && other.Type != rr.Type) {
+					kept = append(kept, other)
+				}
+			}
+			records = kept
+		case NONERecordClass:
+			// Delete a record
+			if rr.Type == SOARecordType {
+				continue
+			}
+			if apex && rr.Type == NSRecordType && len(rrsetOf(records, name, NSRecordType)) <= 1 {
+				continue
+			}
+			rr.Class = zone.SOA().Class
+			records = removeRecord(records, rr)
+		default:
+			records = addRecord(zone.Origin, records, rr)
+		}
+	}
+	return records
+}
+
+// addRecord returns records with rr added, or replacing the SOA record or the
+// CNAME record of its owner. Records that can't coexist with the CNAME record
+// of their owner, or the other way around, are ignored.
+func addRecord(origin string, records []DNSAnswer, rr DNSAnswer) []DNSAnswer {
+	name := canonicalName(rr.Name)
+	if rr.Type == SOARecordType {
+		if name == origin && serialGreater(soaSerial(rr), soaSerial(records[0])) {
+			records[0] = rr
+		}
+		return records
+	}
+
+	for i, other := range records {
+		if canonicalName(other.Name) != name {
+			continue
+		}
+		switch {
+		case rr.Type == CNAMERecordType && other.Type == CNAMERecordType:
+			records[i] = rr
+			return records
+		case cnameConflict(rr.Type, other.Type):
+			return records
+		case sameRecord(rr, other):
+			// Only the TTL changes
+			records[i] = rr
+			return records
+		}
+	}
+	return append(records, rr)
+}
+
+// changedRecords reports whether the records after an update differ from the
+// records before, including their TTL.
+func changedRecords(before, after []DNSAnswer) bool {
+	if len(before) != len(after) {
+		return true
+	}
+	for i := range before {
+		if before[i].TTL != after[i].TTL || !sameRecord(before[i], after[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrset returns the records of name with type rrType.
+func (z *Zone) rrset(name string, rrType uint16) []DNSAnswer {
+	return rrsetOf(z.nodes[name], name, rrType)
+}
+
+// rrsetOf returns the records of records owned by name with type rrType.
+func rrsetOf(records []DNSAnswer, name string, rrType uint16) []DNSAnswer {
+	var rrset []DNSAnswer
+	for _, rr := range records {
+		if rr.Type == rrType && canonicalName(rr.Name) == name {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset
+}
+
+// sameRRSet reports whether a and b hold the same records, whatever their
+// order and TTL.
+func sameRRSet(a, b []DNSAnswer) bool {
+	contains := func(records []DNSAnswer, rr DNSAnswer) bool {
+		for _, other := range records {
+			if sameRecord(other, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasData reports whether rr has RDATA.
+func hasData(rr DNSAnswer) bool {
+	return rr.RData != nil || len(rr.Data) > 0
+}
+
+// isMetaType reports whether rrType is a QTYPE or a meta type, which can't be
+// stored in a zone.
+// See [RFC6895 3.1]
+// [RFC6895 3.1]: https://datatracker.ietf.org/doc/html/rfc6895#section-3.1
+func isMetaType(rrType uint16) bool {
+	return rrType == OPTRecordType || (rrType >= 128 && rrType <= 255)
+}
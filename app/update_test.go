@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// updateRecord returns a record of an UPDATE request with the given class and
+// data, which may be nil.
+func updateRecord(name string, rrType uint16, class uint16, ttl uint32, rdata RData) DNSAnswer {
+	return DNSAnswer{Name: name, Type: rrType, Class: class, TTL: ttl, RData: rdata}
+}
+
+func TestHandler_Update(t *testing.T) {
+	ip := func(last byte) RData { return &ARecord{IP: net.IP{192, 0, 2, last}} }
+	client := &net.UDPAddr{IP: net.IP{192, 0, 2, 10}, Port: 5353}
+
+	tcs := []struct {
+		name            string
+		origin          string
+		client          net.Addr
+		prerequisites   []DNSAnswer
+		updates         []DNSAnswer
+		expectedRCODE   uint16
+		expectedSerial  uint32
+		question        DNSQuestion
+		expectedAnswers []string
+	}{
+		{
+			name:            "add a record",
+			updates:         []DNSAnswer{updateRecord("new.example.com", ARecordType, INRecordClass, 60, ip(9))},
+			expectedSerial:  2,
+			question:        DNSQuestion{Name: "new.example.com", Type: ARecordType},
+			expectedAnswers: []string{"new.example.com 1 192.0.2.9"},
+		},
+		{
+			name:            "delete a record",
+			updates:         []DNSAnswer{updateRecord("www.example.com", ARecordType, NONERecordClass, 0, ip(2))},
+			expectedSerial:  2,
+			question:        DNSQuestion{Name: "www.example.com", Type: ARecordType},
+			expectedAnswers: []string{"www.example.com 1 192.0.2.3"},
+		},
+		{
+			name: "replace an RRset",
+			updates: []DNSAnswer{
+				updateRecord("www.example.com", ARecordType, ANYRecordClass, 0, nil),
+				updateRecord("www.example.com", ARecordType, INRecordClass, 60, ip(8)),
+			},
+			expectedSerial:  2,
+			question:        DNSQuestion{Name: "www.example.com", Type: ARecordType},
+			expectedAnswers: []string{"www.example.com 1 192.0.2.8"},
+		},
+		{
+			name:            "delete all the RRsets of the origin",
+			updates:         []DNSAnswer{updateRecord("example.com", ANYRecordType, ANYRecordClass, 0, nil)},
+			expectedSerial:  1,
+			question:        DNSQuestion{Name: "example.com", Type: NSRecordType},
+			expectedAnswers: []string{"example.com 2 ns1.example.com."},
+		},
+		{
+			name:            "record conflicting with a CNAME",
+			updates:         []DNSAnswer{updateRecord("alias.example.com", ARecordType, INRecordClass, 60, ip(9))},
+			expectedSerial:  1,
+			question:        DNSQuestion{Name: "alias.example.com", Type: CNAMERecordType},
+			expectedAnswers: []string{"alias.example.com 5 www.example.com."},
+		},
+		{
+			name: "prerequisites hold",
+			prerequisites: []DNSAnswer{
+				updateRecord("www.example.com", ARecordType, INRecordClass, 0, ip(2)),
+				updateRecord("www.example.com", ARecordType, INRecordClass, 0, ip(3)),
+				updateRecord("new.example.com", ANYRecordType, NONERecordClass, 0, nil),
+			},
+			updates:         []DNSAnswer{updateRecord("new.example.com", ARecordType, INRecordClass, 60, ip(9))},
+			expectedSerial:  2,
+			question:        DNSQuestion{Name: "new.example.com", Type: ARecordType},
+			expectedAnswers: []string{"new.example.com 1 192.0.2.9"},
+		},
+		{
+			name:           "name in use",
+			prerequisites:  []DNSAnswer{updateRecord("www.example.com", ANYRecordType, NONERecordClass, 0, nil)},
+			updates:        []DNSAnswer{updateRecord("www.example.com", ARecordType, INRecordClass, 60, ip(9))},
+			expectedRCODE:  YXDomainResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "name not in use",
+			prerequisites:  []DNSAnswer{updateRecord("new.example.com", ANYRecordType, ANYRecordClass, 0, nil)},
+			expectedRCODE:  NameErrorResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "RRset exists",
+			prerequisites:  []DNSAnswer{updateRecord("www.example.com", ARecordType, NONERecordClass, 0, nil)},
+			expectedRCODE:  YXRRSetResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "RRset does not exist",
+			prerequisites:  []DNSAnswer{updateRecord("www.example.com", AAAARecordType, ANYRecordClass, 0, nil)},
+			expectedRCODE:  NXRRSetResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "RRset differs",
+			prerequisites:  []DNSAnswer{updateRecord("www.example.com", ARecordType, INRecordClass, 0, ip(2))},
+			updates:        []DNSAnswer{updateRecord("new.example.com", ARecordType, INRecordClass, 60, ip(9))},
+			expectedRCODE:  NXRRSetResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "record outside of the zone",
+			updates:        []DNSAnswer{updateRecord("www.example.net", ARecordType, INRecordClass, 60, ip(9))},
+			expectedRCODE:  NotZoneResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "zone not served",
+			origin:         "example.net",
+			updates:        []DNSAnswer{updateRecord("www.example.net", ARecordType, INRecordClass, 60, ip(9))},
+			expectedRCODE:  NotAuthResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "client not allowed",
+			client:         &net.UDPAddr{IP: net.IP{198, 51, 100, 1}, Port: 5353},
+			updates:        []DNSAnswer{updateRecord("new.example.com", ARecordType, INRecordClass, 60, ip(9))},
+			expectedRCODE:  RefusedResponseCode,
+			expectedSerial: 1,
+		},
+		{
+			name:           "malformed deletion",
+			updates:        []DNSAnswer{updateRecord("www.example.com", ARecordType, ANYRecordClass, 60, nil)},
+			expectedRCODE:  FormatErrorResponseCode,
+			expectedSerial: 1,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			zones := NewZoneStore()
+			zones.Add(newTestZone(t, "example.com", lookupZone))
+			acls, err := parseACLs([]string{"example.com=192.0.2.0/24"}, nil)
+			if err != nil {
+				t.Fatalf("failed to parse ACLs: %v", err)
+			}
+			handler := &Handler{zones: zones, updateACLs: acls}
+
+			origin := "example.com"
+			if tc.origin != "" {
+				origin = tc.origin
+			}
+			req := newQuery(origin, SOARecordType)
+			req.Header.Flags.OPCODE = UpdateOpCode
+			req.AddAnswers(tc.prerequisites...)
+			req.AddAuthorities(tc.updates...)
+			buf, err := req.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal request: %v", err)
+			}
+			source := tc.client
+			if source == nil {
+				source = client
+			}
+			responses := handler.handleRequest(buf, source, true)
+			if len(responses) != 1 {
+				t.Fatalf("expected a single response but got %d", len(responses))
+			}
+			var resp DNSMessage
+			if err := resp.UnmarshalBinary(responses[0]); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			if resp.Header.Flags.OPCODE != UpdateOpCode {
+				t.Errorf("expected OPCODE %d but got %d", UpdateOpCode, resp.Header.Flags.OPCODE)
+			}
+			if resp.Header.Flags.RCODE != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+			}
+
+			zone := zones.Get("example.com")
+			if zone.Serial() != tc.expectedSerial {
+				t.Errorf("expected serial %d but got %d", tc.expectedSerial, zone.Serial())
+			}
+			if tc.question.Name != "" {
+				tc.question.Class = INRecordClass
+				answers := zone.Lookup(tc.question).Answers
+				if diff := cmp.Diff(tc.expectedAnswers, recordStrings(answers)); diff != "" {
+					t.Errorf("answers do not match: %s", diff)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,860 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxValidatedZones is the number of zone security states kept in memory.
+	maxValidatedZones = 10000
+	// bogusTTL is how long, in seconds, a zone whose chain of trust is broken
+	// is considered bogus before being validated again.
+	// See [RFC4035 4.7]
+	// [RFC4035 4.7]: https://datatracker.ietf.org/doc/html/rfc4035#section-4.7
+	bogusTTL = 60
+	// maxNSEC3Iterations is the number of additional NSEC3 hash iterations
+	// above which denials of existence are treated as insecure.
+	// See [RFC9276 3.2]
+	// [RFC9276 3.2]: https://datatracker.ietf.org/doc/html/rfc9276#section-3.2
+	maxNSEC3Iterations = 150
+)
+
+// security is the outcome of the validation of records.
+// See [RFC4035 4.3]
+// [RFC4035 4.3]: https://datatracker.ietf.org/doc/html/rfc4035#section-4.3
+type security int
+
+const (
+	// insecure records are known not to be signed: a delegation without DS
+	// record or a zone signed with unsupported algorithms leads to them.
+	insecure security = iota
+	// secure records have a chain of signatures up to a trust anchor.
+	secure
+	// bogus records should be signed but their signatures are missing or
+	// don't validate.
+	bogus
+)
+
+// zoneSecurity is the outcome of the validation of the chain of trust down to
+// a zone.
+type zoneSecurity struct {
+	zone  string
+	state security
+	// keys holds the validated DNSKEY records of secure zones.
+	keys []*DNSKEYRecord
+	// err tells why the chain of trust of bogus zones is broken.
+	err       error
+	expiresAt time.Time
+}
+
+// denial is what a denial of existence proves.
+type denial int
+
+const (
+	// provenNoData proves that the name exists without the requested type.
+	provenNoData denial = iota
+	// provenNameError proves that the name doesn't exist.
+	provenNameError
+	// unsignedDelegation proves that the name is a delegation without DS
+	// records.
+	unsignedDelegation
+	// unprovable denials are NSEC3 opt-out spans, which may hide unsigned
+	// delegations, or NSEC3 chains too costly to check.
+	unprovable
+)
+
+// ValidatingResolver checks the DNSSEC signatures of the answers of its
+// upstream, following the chain of DNSKEY and DS records from a trust anchor
+// down to the zone of the answers. Validated answers have the AD flag set and
+// bogus ones are replaced by SERVFAIL. Requests with the CD flag are passed
+// through without validation.
+// See [RFC4035 5]
+// [RFC4035 5]: https://datatracker.ietf.org/doc/html/rfc4035#section-5
+type ValidatingResolver struct {
+	upstream Upstream
+	// anchors holds the trusted DS and DNSKEY records of each zone.
+	anchors map[string][]DNSAnswer
+
+	mu sync.Mutex
+	// zones holds the security of the closest zone enclosing each name
+	// validated so far.
+	zones map[string]*zoneSecurity
+	now   func() time.Time
+}
+
+// NewValidatingResolver creates a resolver validating the answers of upstream
+// from anchors, DS or DNSKEY records.
+func NewValidatingResolver(upstream Upstream, anchors []DNSAnswer) (*ValidatingResolver, error) {
+	v := &ValidatingResolver{
+		upstream: upstream,
+		anchors:  map[string][]DNSAnswer{},
+		zones:    map[string]*zoneSecurity{},
+		now:      time.Now,
+	}
+	for _, rr := range anchors {
+		switch rr.RData.(type) {
+		case *DSRecord, *DNSKEYRecord:
+		default:
+			return nil, fmt.Errorf("trust anchor %s %s is neither a DS nor a DNSKEY record", fqdn(rr.Name), recordTypeName(rr.Type))
+		}
+		zone := canonicalName(rr.Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	if len(v.anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchor configured")
+	}
+	return v, nil
+}
+
+func (v *ValidatingResolver) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	if len(msg.Questions) != 1 {
+		return v.upstream.SendRequest(msg)
+	}
+	// Clients disabling checking validate the answers themselves
+	// See [RFC4035 3.2.2]
+	// [RFC4035 3.2.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-3.2.2
+	if msg.Header.Flags.CD {
+		resp, err := v.upstream.SendRequest(msg)
+		if err != nil {
+			return nil, err
+		}
+		resp.Header.Flags.AD = false
+		return resp, nil
+	}
+
+	q := msg.Questions[0]
+	resp, err := v.upstream.SendRequest(validationRequest(q, msg.Header.Flags.RD))
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.ID = msg.Header.ID
+	resp.Header.Flags.AD = false
+	if rcode := resp.RCODE(); rcode != NoErrorResponseCode && rcode != NameErrorResponseCode {
+		return resp, nil
+	}
+
+	state, err := v.validate(q, resp)
+	if state == bogus {
+		log.Printf("bogus answer for %s %s: %v", fqdn(q.Name), recordTypeName(q.Type), err)
+		servfail := CreateResponse(msg)
+		servfail.Header.Flags.RA = true
+		servfail.Header.Flags.RCODE = ServerFailureResponseCode
+		return servfail, nil
+	}
+	resp.Header.Flags.AD = state == secure
+	return resp, nil
+}
+
+// validationRequest returns a request for q asking for the DNSSEC records and
+// for the answers the upstream could not validate itself.
+func validationRequest(q DNSQuestion, rd bool) *DNSMessage {
+	req := &DNSMessage{}
+	req.Header.Flags.RD = rd
+	req.Header.Flags.CD = true
+	req.AddQuestions(q)
+	req.SetEDNS(&EDNS{UDPSize: maxUDPSize, DO: true})
+	return req
+}
+
+// exchange sends q upstream for the validation of the chain of trust.
+func (v *ValidatingResolver) exchange(name string, rrType uint16) (*DNSMessage, error) {
+	resp, err := v.upstream.SendRequest(validationRequest(DNSQuestion{Name: name, Type: rrType, Class: INRecordClass}, true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s %s: %v", fqdn(name), recordTypeName(rrType), err)
+	}
+	if rcode := resp.RCODE(); rcode != NoErrorResponseCode && rcode != NameErrorResponseCode {
+		return nil, fmt.Errorf("query for %s %s answered with RCODE %d", fqdn(name), recordTypeName(rrType), rcode)
+	}
+	return resp, nil
+}
+
+// validate checks the answer section of resp, the response to q, and the
+// denial of existence of the name or type when it doesn't answer q.
+func (v *ValidatingResolver) validate(q DNSQuestion, resp *DNSMessage) (security, error) {
+	state := secure
+	rrsets, sigs := groupRRSets(resp.Answers)
+	for _, rrset := range rrsets {
+		owner, rrType := canonicalName(rrset[0].Name), rrset[0].Type
+		// The CNAME records synthesized from a DNAME are not signed
+		// See [RFC6672 5.3.3]
+		// [RFC6672 5.3.3]: https://datatracker.ietf.org/doc/html/rfc6672#section-5.3.3
+		if rrType == CNAMERecordType && len(sigs[rrsetKey{owner, rrType}]) == 0 && synthesized(rrset, resp.Answers) {
+			continue
+		}
+		zone, err := v.zoneOf(signerZone(owner, rrType))
+		if err != nil {
+			return bogus, err
+		}
+		rrsetState, err := v.validateRRSet(zone, rrset, sigs[rrsetKey{owner, rrType}], resp.Authorities)
+		if rrsetState != secure {
+			if rrsetState == bogus {
+				return bogus, err
+			}
+			state = insecure
+		}
+	}
+
+	name, answered := followChain(resp.Answers, canonicalName(q.Name), q.Type)
+	if answered {
+		return state, nil
+	}
+	zone, err := v.zoneOf(signerZone(name, q.Type))
+	if err != nil {
+		return bogus, err
+	}
+	switch zone.state {
+	case insecure:
+		return insecure, nil
+	case bogus:
+		return bogus, zone.err
+	}
+	kind, err := v.deny(zone, resp, name, q.Type)
+	if err != nil {
+		return bogus, err
+	}
+	if kind == unprovable {
+		return insecure, nil
+	}
+	return state, nil
+}
+
+// validateRRSet checks the signatures of rrset against the keys of zone. The
+// expansions of wildcards must come with the proof that their owner doesn't
+// exist in authorities.
+func (v *ValidatingResolver) validateRRSet(zone *zoneSecurity, rrset []DNSAnswer, sigs []*RRSIGRecord, authorities []DNSAnswer) (security, error) {
+	switch zone.state {
+	case insecure:
+		return insecure, nil
+	case bogus:
+		return bogus, zone.err
+	}
+	sig, err := verifyRRSet(rrset, sigs, zone.keys, zone.zone, v.now())
+	if err != nil {
+		return bogus, err
+	}
+	owner := canonicalName(rrset[0].Name)
+	if int(sig.Labels) >= labelCount(owner) {
+		return secure, nil
+	}
+
+	// See [RFC5155 8.8] for NSEC3
+	// [RFC5155 8.8]: https://datatracker.ietf.org/doc/html/rfc5155#section-8.8
+	nsecs, chain, err := v.denialRecords(zone, authorities)
+	if err != nil {
+		return bogus, err
+	}
+	for _, nsec := range nsecs {
+		if covers(nsec.owner, canonicalName(nsec.rd.NextDomain), owner, compareNames) {
+			return secure, nil
+		}
+	}
+	if chain != nil {
+		if !chain.supported() {
+			return insecure, nil
+		}
+		labels := strings.Split(owner, ".")
+		nextCloser := strings.Join(labels[len(labels)-int(sig.Labels)-1:], ".")
+		if chain.cover(nextCloser) != nil {
+			return secure, nil
+		}
+	}
+	return bogus, fmt.Errorf("no proof that the wildcard expanded to %s matches: %w", fqdn(owner), ErrBogus)
+}
+
+// zoneOf returns the security of the closest zone enclosing name, validating
+// the chain of trust from the closest trust anchor when it is not known yet.
+func (v *ValidatingResolver) zoneOf(name string) (*zoneSecurity, error) {
+	anchor, ok := v.closestAnchor(name)
+	if !ok {
+		return &zoneSecurity{zone: name, state: insecure}, nil
+	}
+	var ancestors []string
+	for n := name; n != anchor; n = parentName(n) {
+		ancestors = append(ancestors, n)
+	}
+	ancestors = append(ancestors, anchor)
+
+	// Walk down from the trust anchor to name
+	var current *zoneSecurity
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		n := ancestors[i]
+		if current != nil && current.state != secure {
+			return current, nil
+		}
+		if cached := v.cached(n); cached != nil {
+			current = cached
+			continue
+		}
+		var next *zoneSecurity
+		var nonExistent bool
+		var err error
+		if current == nil {
+			next, err = v.anchorZone(anchor)
+		} else {
+			next, nonExistent, err = v.descend(current, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		v.store(n, next)
+		current = next
+		// Names below a name that doesn't exist don't exist either
+		if nonExistent {
+			break
+		}
+	}
+	return current, nil
+}
+
+// closestAnchor returns the closest zone enclosing name that has a trust
+// anchor.
+func (v *ValidatingResolver) closestAnchor(name string) (string, bool) {
+	for {
+		if _, ok := v.anchors[name]; ok {
+			return name, true
+		}
+		if name == "" {
+			return "", false
+		}
+		name = parentName(name)
+	}
+}
+
+// anchorZone validates the keys of zone, which has a trust anchor.
+func (v *ValidatingResolver) anchorZone(zone string) (*zoneSecurity, error) {
+	var dsSet []*DSRecord
+	var trusted []*DNSKEYRecord
+	for _, rr := range v.anchors[zone] {
+		switch rd := rr.RData.(type) {
+		case *DSRecord:
+			dsSet = append(dsSet, rd)
+		case *DNSKEYRecord:
+			trusted = append(trusted, rd)
+		}
+	}
+	ttl, _ := minTTL(v.anchors[zone])
+	return v.zoneKeys(zone, dsSet, trusted, v.now().Add(time.Duration(ttl)*time.Second))
+}
+
+// descend finds out whether child is a zone below parent, a secure zone, by
+// asking for its DS records. It returns the security of the closest zone
+// enclosing child and whether child was proven not to exist.
+// See [RFC4035 5.2]
+// [RFC4035 5.2]: https://datatracker.ietf.org/doc/html/rfc4035#section-5.2
+func (v *ValidatingResolver) descend(parent *zoneSecurity, child string) (*zoneSecurity, bool, error) {
+	resp, err := v.exchange(child, DSRecordType)
+	if err != nil {
+		return nil, false, err
+	}
+	ttl, _ := minTTL(resp.Answers, resp.Authorities)
+	expiresAt := v.now().Add(time.Duration(ttl) * time.Second)
+
+	rrsets, sigs := groupRRSets(resp.Answers)
+	for _, rrset := range rrsets {
+		owner, rrType := canonicalName(rrset[0].Name), rrset[0].Type
+		if owner != child || (rrType != DSRecordType && rrType != CNAMERecordType) {
+			continue
+		}
+		if _, err := verifyRRSet(rrset, sigs[rrsetKey{owner, rrType}], parent.keys, parent.zone, v.now()); err != nil {
+			return bogusZone(child, err, v.now()), false, nil
+		}
+		// Aliases are not zones
+		if rrType == CNAMERecordType {
+			return parent, false, nil
+		}
+		var dsSet []*DSRecord
+		for _, rr := range rrset {
+			if ds, ok := rr.RData.(*DSRecord); ok {
+				dsSet = append(dsSet, ds)
+			}
+		}
+		zone, err := v.zoneKeys(child, dsSet, nil, expiresAt)
+		return zone, false, err
+	}
+
+	kind, err := v.deny(parent, resp, child, DSRecordType)
+	if err != nil {
+		return bogusZone(child, err, v.now()), false, nil
+	}
+	switch kind {
+	case provenNoData:
+		return parent, false, nil
+	case provenNameError:
+		return parent, true, nil
+	}
+	return &zoneSecurity{zone: child, state: insecure, expiresAt: expiresAt}, false, nil
+}
+
+// zoneKeys fetches the DNSKEY records of zone and validates them with one of
+// the keys matching dsSet or in trusted. The zone is insecure when none of
+// them uses a supported algorithm.
+// See [RFC4035 5.2]
+func (v *ValidatingResolver) zoneKeys(zone string, dsSet []*DSRecord, trusted []*DNSKEYRecord, expiresAt time.Time) (*zoneSecurity, error) {
+	var supported bool
+	for _, ds := range dsSet {
+		supported = supported || supportedDS(ds)
+	}
+	for _, key := range trusted {
+		supported = supported || supportedAlgorithm(key.Algorithm)
+	}
+	if !supported {
+		return &zoneSecurity{zone: zone, state: insecure, expiresAt: expiresAt}, nil
+	}
+
+	resp, err := v.exchange(zone, DNSKEYRecordType)
+	if err != nil {
+		return nil, err
+	}
+	var rrset []DNSAnswer
+	var keys, signers []*DNSKEYRecord
+	for _, rr := range resp.Answers {
+		key, ok := rr.RData.(*DNSKEYRecord)
+		if !ok || canonicalName(rr.Name) != zone {
+			continue
+		}
+		rrset = append(rrset, rr)
+		keys = append(keys, key)
+		if ttl := v.now().Add(time.Duration(rr.TTL) * time.Second); ttl.Before(expiresAt) {
+			expiresAt = ttl
+		}
+		for _, ds := range dsSet {
+			if supportedDS(ds) && matchesDS(zone, key, ds) {
+				signers = append(signers, key)
+			}
+		}
+		for _, anchor := range trusted {
+			if anchor.Flags == key.Flags && anchor.Algorithm == key.Algorithm && bytes.Equal(anchor.PublicKey, key.PublicKey) {
+				signers = append(signers, key)
+			}
+		}
+	}
+	if len(rrset) == 0 {
+		return bogusZone(zone, fmt.Errorf("no DNSKEY record for %s: %w", fqdn(zone), ErrBogus), v.now()), nil
+	}
+	if len(signers) == 0 {
+		return bogusZone(zone, fmt.Errorf("no DNSKEY record of %s matches its DS records: %w", fqdn(zone), ErrBogus), v.now()), nil
+	}
+
+	_, sigs := groupRRSets(resp.Answers)
+	if _, err := verifyRRSet(rrset, sigs[rrsetKey{zone, DNSKEYRecordType}], signers, zone, v.now()); err != nil {
+		return bogusZone(zone, err, v.now()), nil
+	}
+	return &zoneSecurity{zone: zone, state: secure, keys: keys, expiresAt: expiresAt}, nil
+}
+
+// bogusZone returns the security of zone whose chain of trust is broken by
+// err.
+func bogusZone(zone string, err error, now time.Time) *zoneSecurity {
+	return &zoneSecurity{zone: zone, state: bogus, err: err, expiresAt: now.Add(bogusTTL * time.Second)}
+}
+
+// cached returns the security of the zone enclosing name found earlier, or
+// nil.
+func (v *ValidatingResolver) cached(name string) *zoneSecurity {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	zone, ok := v.zones[name]
+	if !ok {
+		return nil
+	}
+	if !v.now().Before(zone.expiresAt) {
+		delete(v.zones, name)
+		return nil
+	}
+	return zone
+}
+
+// store remembers zone as the security of the zone enclosing name until it
+// expires.
+func (v *ValidatingResolver) store(name string, zone *zoneSecurity) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	if len(v.zones) >= maxValidatedZones {
+		for n, cached := range v.zones {
+			if !now.Before(cached.expiresAt) {
+				delete(v.zones, n)
+			}
+		}
+		if len(v.zones) >= maxValidatedZones {
+			return
+		}
+	}
+	v.zones[name] = zone
+}
+
+// deny checks the NSEC or NSEC3 records of resp proving that name has no
+// records of type rrType, or doesn't exist when resp is NXDOMAIN.
+func (v *ValidatingResolver) deny(zone *zoneSecurity, resp *DNSMessage, name string, rrType uint16) (denial, error) {
+	nsecs, chain, err := v.denialRecords(zone, resp.Authorities)
+	if err != nil {
+		return 0, err
+	}
+	var kind denial
+	switch {
+	case len(nsecs) > 0:
+		kind, err = nsecDenial(nsecs, name, rrType)
+	case chain != nil:
+		kind, err = chain.denial(zone.zone, name, rrType)
+	default:
+		return 0, fmt.Errorf("no denial of existence of %s %s: %w", fqdn(name), recordTypeName(rrType), ErrBogus)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("denial of existence of %s %s: %v: %w", fqdn(name), recordTypeName(rrType), err, ErrBogus)
+	}
+
+	nxdomain := resp.RCODE() == NameErrorResponseCode
+	if kind == provenNameError && !nxdomain {
+		return 0, fmt.Errorf("%s doesn't exist but the response is not NXDOMAIN: %w", fqdn(name), ErrBogus)
+	}
+	if nxdomain && (kind == provenNoData || kind == unsignedDelegation) {
+		return 0, fmt.Errorf("%s exists but the response is NXDOMAIN: %w", fqdn(name), ErrBogus)
+	}
+	return kind, nil
+}
+
+// nsecRecord is an NSEC record along with its owner name.
+type nsecRecord struct {
+	owner string
+	rd    *NSECRecord
+}
+
+// denialRecords returns the NSEC records and the NSEC3 chain found in
+// authorities after checking that zone signed them.
+func (v *ValidatingResolver) denialRecords(zone *zoneSecurity, authorities []DNSAnswer) ([]nsecRecord, *nsec3Chain, error) {
+	var nsecs []nsecRecord
+	var chain *nsec3Chain
+	rrsets, sigs := groupRRSets(authorities)
+	for _, rrset := range rrsets {
+		owner, rrType := canonicalName(rrset[0].Name), rrset[0].Type
+		if rrType != NSECRecordType && rrType != NSEC3RecordType {
+			continue
+		}
+		if _, err := verifyRRSet(rrset, sigs[rrsetKey{owner, rrType}], zone.keys, zone.zone, v.now()); err != nil {
+			return nil, nil, err
+		}
+		for _, rr := range rrset {
+			switch rd := rr.RData.(type) {
+			case *NSECRecord:
+				nsecs = append(nsecs, nsecRecord{owner: owner, rd: rd})
+			case *NSEC3Record:
+				label, parent, _ := strings.Cut(owner, ".")
+				hash, err := nsec3Encoding.DecodeString(strings.ToUpper(label))
+				if err != nil || parent != zone.zone {
+					return nil, nil, fmt.Errorf("invalid NSEC3 owner %s: %w", fqdn(owner), ErrBogus)
+				}
+				if chain == nil {
+					chain = &nsec3Chain{params: rd}
+				}
+				chain.add(hash, rd)
+			}
+		}
+	}
+	return nsecs, chain, nil
+}
+
+// nsecDenial checks that nsecs prove that name has no records of type rrType
+// or doesn't exist, in which case no wildcard may match it either.
+// See [RFC4035 5.4]
+// [RFC4035 5.4]: https://datatracker.ietf.org/doc/html/rfc4035#section-5.4
+func nsecDenial(nsecs []nsecRecord, name string, rrType uint16) (denial, error) {
+	for _, nsec := range nsecs {
+		if nsec.owner == name {
+			return typeDenial(nsec.rd.Types, rrType)
+		}
+	}
+
+	encloser, found := "", false
+	for _, nsec := range nsecs {
+		next := canonicalName(nsec.rd.NextDomain)
+		if !covers(nsec.owner, next, name, compareNames) {
+			continue
+		}
+		// The NSEC records of delegations and DNAME records say nothing of
+		// the names below them
+		// See [RFC6840 4.1]
+		// [RFC6840 4.1]: https://datatracker.ietf.org/doc/html/rfc6840#section-4.1
+		if inZone(name, nsec.owner) && (hasType(nsec.rd.Types, NSRecordType) && !hasType(nsec.rd.Types, SOARecordType) ||
+			hasType(nsec.rd.Types, DNAMERecordType)) {
+			continue
+		}
+		// Names with descendants exist as empty non-terminals
+		if next != name && inZone(next, name) {
+			return typeDenial(nil, rrType)
+		}
+		encloser = commonAncestor(name, nsec.owner)
+		if ancestor := commonAncestor(name, next); len(ancestor) > len(encloser) {
+			encloser = ancestor
+		}
+		found = true
+		break
+	}
+	if !found {
+		return 0, fmt.Errorf("no NSEC record covers %s", fqdn(name))
+	}
+
+	wildcard := wildcardOf(encloser)
+	for _, nsec := range nsecs {
+		if nsec.owner == wildcard {
+			return typeDenial(nsec.rd.Types, rrType)
+		}
+		if covers(nsec.owner, canonicalName(nsec.rd.NextDomain), wildcard, compareNames) {
+			return provenNameError, nil
+		}
+	}
+	return 0, fmt.Errorf("no NSEC record covers %s", fqdn(wildcard))
+}
+
+// typeDenial checks that a name with types has no records of type rrType.
+// The NSEC records of delegations only deny the DS records.
+// See [RFC6840 4.4]
+// [RFC6840 4.4]: https://datatracker.ietf.org/doc/html/rfc6840#section-4.4
+func typeDenial(types []uint16, rrType uint16) (denial, error) {
+	if hasType(types, rrType) {
+		return 0, fmt.Errorf("type %s exists", recordTypeName(rrType))
+	}
+	if hasType(types, CNAMERecordType) {
+		return 0, fmt.Errorf("name is an alias")
+	}
+	if hasType(types, NSRecordType) && !hasType(types, SOARecordType) {
+		if rrType != DSRecordType {
+			return 0, fmt.Errorf("name is a delegation")
+		}
+		return unsignedDelegation, nil
+	}
+	return provenNoData, nil
+}
+
+// nsec3Chain holds the NSEC3 records of a response sharing the parameters of
+// the first one.
+type nsec3Chain struct {
+	params  *NSEC3Record
+	hashes  []string
+	records []*NSEC3Record
+}
+
+func (c *nsec3Chain) add(hash []byte, rd *NSEC3Record) {
+	if rd.HashAlgorithm != c.params.HashAlgorithm || rd.Iterations != c.params.Iterations || !bytes.Equal(rd.Salt, c.params.Salt) {
+		return
+	}
+	c.hashes = append(c.hashes, string(hash))
+	c.records = append(c.records, rd)
+}
+
+// supported reports whether the chain can be checked.
+func (c *nsec3Chain) supported() bool {
+	return c.params.HashAlgorithm == NSEC3SHA1Algorithm && c.params.Iterations <= maxNSEC3Iterations
+}
+
+func (c *nsec3Chain) hash(name string) string {
+	return string(nsec3Hash(name, c.params.Salt, c.params.Iterations))
+}
+
+// match returns the NSEC3 record of name, or nil.
+func (c *nsec3Chain) match(name string) *NSEC3Record {
+	hash := c.hash(name)
+	for i, h := range c.hashes {
+		if h == hash {
+			return c.records[i]
+		}
+	}
+	return nil
+}
+
+// cover returns the NSEC3 record proving that name doesn't exist, or nil.
+func (c *nsec3Chain) cover(name string) *NSEC3Record {
+	hash := c.hash(name)
+	for i, h := range c.hashes {
+		if covers(h, string(c.records[i].NextHashed), hash, strings.Compare) {
+			return c.records[i]
+		}
+	}
+	return nil
+}
+
+// denial checks that the chain proves that name, in zone, has no records of
+// type rrType or doesn't exist, in which case the closest encloser proof
+// shows that no wildcard matches it either.
+// See [RFC5155 8]
+// [RFC5155 8]: https://datatracker.ietf.org/doc/html/rfc5155#section-8
+func (c *nsec3Chain) denial(zone, name string, rrType uint16) (denial, error) {
+	if !c.supported() {
+		return unprovable, nil
+	}
+	if rd := c.match(name); rd != nil {
+		return typeDenial(rd.Types, rrType)
+	}
+
+	encloser, nextCloser := name, ""
+	for encloser != zone {
+		encloser, nextCloser = parentName(encloser), encloser
+		if rd := c.match(encloser); rd != nil {
+			if hasType(rd.Types, DNAMERecordType) || hasType(rd.Types, NSRecordType) && !hasType(rd.Types, SOARecordType) {
+				return 0, fmt.Errorf("closest encloser %s is a delegation", fqdn(encloser))
+			}
+			break
+		}
+	}
+	if nextCloser == "" || c.match(encloser) == nil {
+		return 0, fmt.Errorf("no closest encloser of %s", fqdn(name))
+	}
+	covering := c.cover(nextCloser)
+	if covering == nil {
+		return 0, fmt.Errorf("no NSEC3 record covers %s", fqdn(nextCloser))
+	}
+	// Opt-out spans may hide unsigned delegations
+	// See [RFC5155 8.6]
+	// [RFC5155 8.6]: https://datatracker.ietf.org/doc/html/rfc5155#section-8.6
+	if covering.Flags&nsec3OptOut != 0 {
+		return unprovable, nil
+	}
+
+	wildcard := wildcardOf(encloser)
+	if rd := c.match(wildcard); rd != nil {
+		return typeDenial(rd.Types, rrType)
+	}
+	if c.cover(wildcard) == nil {
+		return 0, fmt.Errorf("no NSEC3 record covers %s", fqdn(wildcard))
+	}
+	return provenNameError, nil
+}
+
+// rrsetKey identifies the RRset of a response, and the signatures covering
+// it.
+type rrsetKey struct {
+	name   string
+	rrType uint16
+}
+
+// groupRRSets splits records into RRsets, in the order they appear, and
+// returns the RRSIG records covering each of them.
+func groupRRSets(records []DNSAnswer) ([][]DNSAnswer, map[rrsetKey][]*RRSIGRecord) {
+	var rrsets [][]DNSAnswer
+	index := map[rrsetKey]int{}
+	sigs := map[rrsetKey][]*RRSIGRecord{}
+	for _, rr := range records {
+		owner := canonicalName(rr.Name)
+		if sig, ok := rr.RData.(*RRSIGRecord); ok {
+			key := rrsetKey{owner, sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey{owner, rr.Type}
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []DNSAnswer{rr})
+	}
+	return rrsets, sigs
+}
+
+// followChain follows the CNAME records of answers from name and returns the
+// last name reached and whether answers hold records of type rrType for it.
+func followChain(answers []DNSAnswer, name string, rrType uint16) (string, bool) {
+	for aliases := 0; aliases <= maxCNAMEChain; aliases++ {
+		var target string
+		for _, rr := range answers {
+			if canonicalName(rr.Name) != name {
+				continue
+			}
+			if rr.Type == rrType || rrType == ANYRecordType {
+				return name, true
+			}
+			if cname, ok := rr.RData.(*CNAMERecord); ok {
+				target = canonicalName(cname.Target)
+			}
+		}
+		if target == "" {
+			return name, false
+		}
+		name = target
+	}
+	return name, false
+}
+
+// synthesized reports whether the CNAME record of rrset is the one answers
+// synthesizes from one of its DNAME records.
+func synthesized(rrset []DNSAnswer, answers []DNSAnswer) bool {
+	owner := canonicalName(rrset[0].Name)
+	cname, ok := rrset[0].RData.(*CNAMERecord)
+	if len(rrset) != 1 || !ok {
+		return false
+	}
+	for _, rr := range answers {
+		dname, ok := rr.RData.(*DNAMERecord)
+		source := canonicalName(rr.Name)
+		if !ok || owner == source || !inZone(owner, source) {
+			continue
+		}
+		target := strings.TrimSuffix(owner, source) + canonicalName(dname.Target)
+		if source == "" {
+			target = owner + "." + canonicalName(dname.Target)
+		}
+		if target == canonicalName(cname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// signerZone returns the name whose zone signs the records of owner of type
+// rrType: DS records are signed by the parent zone.
+func signerZone(owner string, rrType uint16) string {
+	if rrType == DSRecordType && owner != "" {
+		return parentName(owner)
+	}
+	return owner
+}
+
+// supportedAlgorithm reports whether signatures made with algorithm can be
+// checked.
+func supportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case RSASHA256Algorithm, ECDSAP256SHA256Algorithm, ECDSAP384SHA384Algorithm, ED25519Algorithm:
+		return true
+	}
+	return false
+}
+
+// supportedDS reports whether ds can be matched against a DNSKEY record.
+func supportedDS(ds *DSRecord) bool {
+	switch ds.DigestType {
+	case SHA1DigestType, SHA256DigestType, SHA384DigestType:
+		return supportedAlgorithm(ds.Algorithm)
+	}
+	return false
+}
+
+// hasType reports whether types holds rrType.
+func hasType(types []uint16, rrType uint16) bool {
+	for _, t := range types {
+		if t == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+// commonAncestor returns the longest name that is both a and b or one of
+// their ancestors.
+func commonAncestor(a, b string) string {
+	for !inZone(b, a) {
+		a = parentName(a)
+	}
+	return a
+}
+
+// wildcardOf returns the wildcard name directly below name.
+func wildcardOf(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const rootFixture = `$ORIGIN .
+$TTL 3600
+@	SOA	ns.example. hostmaster.example. 1 7200 900 604800 300
+	NS	ns.example.
+example.	NS	ns.example.
+`
+
+const exampleFixture = `$ORIGIN example.
+$TTL 3600
+@	SOA	ns hostmaster 1 7200 900 604800 300
+	NS	ns
+ns	A	192.0.2.53
+www	A	192.0.2.1
+alias	CNAME	www
+*.wild	TXT	"wildcard"
+insecure	NS	ns
+rsa	NS	ns
+p384	NS	ns
+nsec3	NS	ns
+bad	NS	ns
+`
+
+const nsec3Fixture = `$ORIGIN nsec3.example.
+$TTL 3600
+@	SOA	ns.example. hostmaster.example. 1 7200 900 604800 300
+	NS	ns.example.
+www	A	192.0.2.5
+*.wild	TXT	"wildcard"
+optout	NS	ns.example.
+`
+
+// childFixture returns the content of a zone holding www.origin.
+func childFixture(origin string, ip string) string {
+	return `$ORIGIN ` + origin + `.
+$TTL 3600
+@	SOA	ns.example. hostmaster.example. 1 7200 900 604800 300
+	NS	ns.example.
+www	A	` + ip + `
+`
+}
+
+// signZone parses content and signs it with signer: its DNSKEY record is
+// added, every authoritative RRset is signed and the names are chained with
+// NSEC records, or with NSEC3 records hashed with params when it is not nil.
+// The unsigned delegations are left out of NSEC3 chains with opt-out. extra
+// holds the DS records of the delegations.
+func signZone(t *testing.T, signer *testSigner, content string, params *NSEC3PARAMRecord, extra ...DNSAnswer) *Zone {
+	t.Helper()
+	origin := signer.zone
+	records, err := ParseZone(strings.NewReader(content), origin, ".")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+	records = append(records, extra...)
+	records = append(records, signer.dnskey())
+	if params != nil {
+		records = append(records, DNSAnswer{Name: origin, Type: NSEC3PARAMRecordType, Class: INRecordClass, TTL: 3600, RData: params})
+	}
+	unsigned, err := NewZone(origin, records)
+	if err != nil {
+		t.Fatalf("failed to create zone: %v", err)
+	}
+	minimum := unsigned.negativeSOA().TTL
+
+	// The NS records of delegations and the glue below them are not signed
+	cuts := map[string]bool{}
+	for name, rrs := range unsigned.nodes {
+		for _, rr := range rrs {
+			if rr.Type == NSRecordType && name != origin {
+				cuts[name] = true
+			}
+		}
+	}
+	belowCut := func(name string) bool {
+		for n := name; n != origin; {
+			n = parentName(n)
+			if cuts[n] {
+				return true
+			}
+		}
+		return false
+	}
+	typesAt := func(name string) []uint16 {
+		var types []uint16
+		for _, rr := range unsigned.nodes[name] {
+			if !hasType(types, rr.Type) {
+				types = append(types, rr.Type)
+			}
+		}
+		return types
+	}
+	unsignedCut := func(name string) bool {
+		return cuts[name] && !hasType(typesAt(name), DSRecordType)
+	}
+
+	var names []string
+	for name := range unsigned.nodes {
+		if !belowCut(name) {
+			names = append(names, name)
+		}
+	}
+	var chain []DNSAnswer
+	if params == nil {
+		sort.Slice(names, func(i, j int) bool { return compareNames(names[i], names[j]) < 0 })
+		for i, name := range names {
+			types := append(typesAt(name), RRSIGRecordType, NSECRecordType)
+			sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+			chain = append(chain, DNSAnswer{
+				Name:  name,
+				Type:  NSECRecordType,
+				Class: INRecordClass,
+				TTL:   minimum,
+				RData: &NSECRecord{NextDomain: names[(i+1)%len(names)], Types: types},
+			})
+		}
+	} else {
+		for name := range unsigned.nonTerminals {
+			if !belowCut(name) {
+				names = append(names, name)
+			}
+		}
+		var hashes, optedOut []string
+		hashed := map[string]string{}
+		for _, name := range names {
+			hash := string(nsec3Hash(name, params.Salt, params.Iterations))
+			if unsignedCut(name) {
+				optedOut = append(optedOut, hash)
+				continue
+			}
+			hashes = append(hashes, hash)
+			hashed[hash] = name
+		}
+		sort.Strings(hashes)
+		for i, hash := range hashes {
+			next := hashes[(i+1)%len(hashes)]
+			types := typesAt(hashed[hash])
+			if len(types) > 0 {
+				types = append(types, RRSIGRecordType)
+			}
+			sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+			rd := &NSEC3Record{
+				HashAlgorithm: params.HashAlgorithm,
+				Iterations:    params.Iterations,
+				Salt:          params.Salt,
+				NextHashed:    []byte(next),
+				Types:         types,
+			}
+			for _, skipped := range optedOut {
+				if covers(hash, next, skipped, strings.Compare) {
+					rd.Flags |= nsec3OptOut
+				}
+			}
+			chain = append(chain, DNSAnswer{
+				Name:  strings.ToLower(nsec3Encoding.EncodeToString([]byte(hash))) + "." + origin,
+				Type:  NSEC3RecordType,
+				Class: INRecordClass,
+				TTL:   minimum,
+				RData: rd,
+			})
+		}
+	}
+
+	var sigs []DNSAnswer
+	rrsets, _ := groupRRSets(append(records, chain...))
+	for _, rrset := range rrsets {
+		owner := canonicalName(rrset[0].Name)
+		if belowCut(owner) || cuts[owner] && rrset[0].Type != DSRecordType && rrset[0].Type != NSECRecordType {
+			continue
+		}
+		sigs = append(sigs, signer.signRRSet(t, rrset))
+	}
+
+	zone, err := NewZone(origin, append(append(records, chain...), sigs...))
+	if err != nil {
+		t.Fatalf("failed to create signed zone: %v", err)
+	}
+	return zone
+}
+
+// signedZones answers requests from zones the way a resolver does once it
+// has reached their authoritative servers. The RRSIG records and the proofs
+// of denial of existence are only sent to requests with the DO flag. tamper
+// may alter the responses.
+type signedZones struct {
+	zones  []*Zone
+	tamper func(q DNSQuestion, resp *DNSMessage)
+
+	mu       sync.Mutex
+	requests int
+}
+
+func (u *signedZones) SendRequest(msg *DNSMessage) (*DNSMessage, error) {
+	u.mu.Lock()
+	u.requests++
+	u.mu.Unlock()
+
+	q := msg.Questions[0]
+	dnssecOK := msg.EDNS != nil && msg.EDNS.DO
+	resp := CreateResponse(msg)
+	resp.Header.Flags.RA = true
+	name := canonicalName(q.Name)
+	for aliases := 0; aliases <= maxCNAMEChain; aliases++ {
+		zone := u.zoneOf(name, q.Type)
+		answer := zone.Lookup(DNSQuestion{Name: name, Type: q.Type, Class: q.Class})
+		if dnssecOK {
+			addSignatures(zone, answer, name, q.Type)
+		}
+		resp.AddAnswers(answer.Answers...)
+		target, answered := followChain(answer.Answers, name, q.Type)
+		if answered || target == name || answer.RCODE() != NoErrorResponseCode {
+			resp.AddAuthorities(answer.Authorities...)
+			resp.Header.Flags.RCODE = answer.Header.Flags.RCODE
+			break
+		}
+		name = target
+	}
+	if u.tamper != nil {
+		u.tamper(q, resp)
+	}
+	return resp, nil
+}
+
+func (u *signedZones) Requests() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests
+}
+
+// zoneOf returns the closest zone enclosing name, or its parent for DS
+// records.
+func (u *signedZones) zoneOf(name string, rrType uint16) *Zone {
+	var closest *Zone
+	for _, zone := range u.zones {
+		if !inZone(name, zone.Origin) || rrType == DSRecordType && name == zone.Origin && name != "" {
+			continue
+		}
+		if closest == nil || len(zone.Origin) > len(closest.Origin) {
+			closest = zone
+		}
+	}
+	return closest
+}
+
+// addSignatures adds to msg, the answer of zone to name and rrType, the
+// signatures of its RRsets and the NSEC or NSEC3 records proving that name or
+// the name of wildcard expansions don't exist.
+func addSignatures(zone *Zone, msg *DNSMessage, name string, rrType uint16) {
+	signatures := func(records []DNSAnswer) []DNSAnswer {
+		var sigs []DNSAnswer
+		rrsets, _ := groupRRSets(records)
+		for _, rrset := range rrsets {
+			rrs, _ := zone.node(canonicalName(rrset[0].Name), rrset[0].Name)
+			for _, rr := range rrs {
+				if signs(rr, rrset[0].Type) {
+					sigs = append(sigs, rr)
+				}
+			}
+		}
+		return sigs
+	}
+	msg.AddAnswers(signatures(msg.Answers)...)
+	msg.AddAuthorities(signatures(msg.Authorities)...)
+
+	var absent []string
+	if final, answered := followChain(msg.Answers, name, rrType); !answered {
+		absent = append(absent, final)
+	}
+	for _, rr := range msg.Answers {
+		if sig, ok := rr.RData.(*RRSIGRecord); ok && int(sig.Labels) < labelCount(canonicalName(rr.Name)) {
+			absent = append(absent, canonicalName(rr.Name))
+		}
+	}
+	for _, name := range absent {
+		proof := absenceProof(zone, name)
+		msg.AddAuthorities(proof...)
+		msg.AddAuthorities(signatures(proof)...)
+	}
+}
+
+// absenceProof returns the NSEC or NSEC3 records of zone proving that name
+// has no records of some type, or doesn't exist along with the wildcard that
+// could match it.
+func absenceProof(zone *Zone, name string) []DNSAnswer {
+	var params *NSEC3PARAMRecord
+	for _, rr := range zone.nodes[zone.Origin] {
+		if p, ok := rr.RData.(*NSEC3PARAMRecord); ok {
+			params = p
+		}
+	}
+	var chain []DNSAnswer
+	for _, rr := range zone.Records() {
+		if rr.Type == NSECRecordType || rr.Type == NSEC3RecordType {
+			chain = append(chain, rr)
+		}
+	}
+	hash := func(n string) string {
+		if params == nil {
+			return n
+		}
+		return string(nsec3Hash(n, params.Salt, params.Iterations))
+	}
+	owner := func(rr DNSAnswer) string {
+		if params == nil {
+			return canonicalName(rr.Name)
+		}
+		label, _, _ := strings.Cut(canonicalName(rr.Name), ".")
+		hash, _ := nsec3Encoding.DecodeString(strings.ToUpper(label))
+		return string(hash)
+	}
+	next := func(rr DNSAnswer) string {
+		if nsec, ok := rr.RData.(*NSECRecord); ok {
+			return canonicalName(nsec.NextDomain)
+		}
+		return string(rr.RData.(*NSEC3Record).NextHashed)
+	}
+	compare := compareNames
+	if params != nil {
+		compare = strings.Compare
+	}
+	match := func(n string) *DNSAnswer {
+		for i, rr := range chain {
+			if owner(rr) == hash(n) {
+				return &chain[i]
+			}
+		}
+		return nil
+	}
+	cover := func(n string) *DNSAnswer {
+		for i, rr := range chain {
+			if covers(owner(rr), next(rr), hash(n), compare) {
+				return &chain[i]
+			}
+		}
+		return nil
+	}
+
+	if rr := match(name); rr != nil {
+		return []DNSAnswer{*rr}
+	}
+	var proof []DNSAnswer
+	encloser := name
+	if params == nil {
+		covering := cover(name)
+		proof = append(proof, *covering)
+		encloser = commonAncestor(name, canonicalName(covering.Name))
+		if ancestor := commonAncestor(name, next(*covering)); len(ancestor) > len(encloser) {
+			encloser = ancestor
+		}
+	} else {
+		for nextCloser := name; ; nextCloser = encloser {
+			encloser = parentName(encloser)
+			if rr := match(encloser); rr != nil {
+				proof = append(proof, *rr, *cover(nextCloser))
+				break
+			}
+		}
+	}
+	if rr := match(wildcardOf(encloser)); rr != nil {
+		return append(proof, *rr)
+	}
+	return append(proof, *cover(wildcardOf(encloser)))
+}
+
+// newValidationFixture returns the zones from the root down to the zones of
+// each algorithm and each kind of denial of existence, along with the DS
+// record of the key of the root to trust.
+func newValidationFixture(t *testing.T) (*signedZones, DNSAnswer) {
+	t.Helper()
+	root := newTestSigner(t, "", ECDSAP256SHA256Algorithm)
+	example := newTestSigner(t, "example", ED25519Algorithm)
+	rsa := newTestSigner(t, "rsa.example", RSASHA256Algorithm)
+	p384 := newTestSigner(t, "p384.example", ECDSAP384SHA384Algorithm)
+	nsec3 := newTestSigner(t, "nsec3.example", ECDSAP256SHA256Algorithm)
+	bad := newTestSigner(t, "bad.example", ECDSAP256SHA256Algorithm)
+	// The DS record of bad.example is the one of another key
+	impostor := newTestSigner(t, "bad.example", ECDSAP256SHA256Algorithm)
+
+	params := &NSEC3PARAMRecord{HashAlgorithm: NSEC3SHA1Algorithm, Iterations: 5, Salt: []byte{0xAA, 0xBB, 0xCC, 0xDD}}
+	upstream := &signedZones{zones: []*Zone{
+		signZone(t, root, rootFixture, nil, example.ds(t)),
+		signZone(t, example, exampleFixture, nil, rsa.ds(t), p384.ds(t), nsec3.ds(t), impostor.ds(t)),
+		signZone(t, rsa, childFixture("rsa.example", "192.0.2.3"), nil),
+		signZone(t, p384, childFixture("p384.example", "192.0.2.4"), nil),
+		signZone(t, nsec3, nsec3Fixture, params),
+		signZone(t, bad, childFixture("bad.example", "192.0.2.6"), nil),
+		newTestZone(t, "insecure.example", childFixture("insecure.example", "192.0.2.2")),
+		newTestZone(t, "optout.nsec3.example", childFixture("optout.nsec3.example", "192.0.2.7")),
+	}}
+	return upstream, root.ds(t)
+}
+
+func newTestValidator(t *testing.T, upstream Upstream, anchors ...DNSAnswer) *ValidatingResolver {
+	t.Helper()
+	v, err := NewValidatingResolver(upstream, anchors)
+	if err != nil {
+		t.Fatalf("failed to create validating resolver: %v", err)
+	}
+	return v
+}
+
+func TestValidatingResolver_SendRequest(t *testing.T) {
+	upstream, anchor := newValidationFixture(t)
+	v := newTestValidator(t, upstream, anchor)
+
+	tcs := []struct {
+		name            string
+		question        string
+		rrType          uint16
+		expectedRCODE   uint16
+		expectedAD      bool
+		expectedAnswers []string
+	}{
+		{
+			name:            "signed answer",
+			question:        "www.example",
+			rrType:          ARecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{"www.example 1 192.0.2.1"},
+		},
+		{
+			name:            "alias",
+			question:        "alias.example",
+			rrType:          ARecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{"alias.example 5 www.example.", "www.example 1 192.0.2.1"},
+		},
+		{
+			name:            "wildcard expansion",
+			question:        "host.wild.example",
+			rrType:          TXTRecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{`host.wild.example 16 "wildcard"`},
+		},
+		{
+			name:          "NSEC name error",
+			question:      "missing.example",
+			rrType:        ARecordType,
+			expectedRCODE: NameErrorResponseCode,
+			expectedAD:    true,
+		},
+		{name: "NSEC no data", question: "www.example", rrType: MXRecordType, expectedAD: true},
+		{name: "NSEC empty non-terminal", question: "wild.example", rrType: ARecordType, expectedAD: true},
+		{name: "no DS record of an unsigned delegation", question: "insecure.example", rrType: DSRecordType, expectedAD: true},
+		{
+			name:            "unsigned delegation",
+			question:        "www.insecure.example",
+			rrType:          ARecordType,
+			expectedAnswers: []string{"www.insecure.example 1 192.0.2.2"},
+		},
+		{
+			name:            "RSA/SHA-256",
+			question:        "www.rsa.example",
+			rrType:          ARecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{"www.rsa.example 1 192.0.2.3"},
+		},
+		{
+			name:            "ECDSA P-384",
+			question:        "www.p384.example",
+			rrType:          ARecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{"www.p384.example 1 192.0.2.4"},
+		},
+		{
+			name:            "NSEC3 zone",
+			question:        "www.nsec3.example",
+			rrType:          ARecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{"www.nsec3.example 1 192.0.2.5"},
+		},
+		{
+			name:          "NSEC3 name error",
+			question:      "missing.nsec3.example",
+			rrType:        ARecordType,
+			expectedRCODE: NameErrorResponseCode,
+			expectedAD:    true,
+		},
+		{name: "NSEC3 no data", question: "www.nsec3.example", rrType: TXTRecordType, expectedAD: true},
+		{name: "NSEC3 empty non-terminal", question: "wild.nsec3.example", rrType: ARecordType, expectedAD: true},
+		{
+			name:            "NSEC3 wildcard expansion",
+			question:        "host.wild.nsec3.example",
+			rrType:          TXTRecordType,
+			expectedAD:      true,
+			expectedAnswers: []string{`host.wild.nsec3.example 16 "wildcard"`},
+		},
+		{
+			name:            "NSEC3 opt-out delegation",
+			question:        "www.optout.nsec3.example",
+			rrType:          ARecordType,
+			expectedAnswers: []string{"www.optout.nsec3.example 1 192.0.2.7"},
+		},
+		{name: "DS record mismatch", question: "www.bad.example", rrType: ARecordType, expectedRCODE: ServerFailureResponseCode},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := newQuery(tc.question, tc.rrType)
+			req.Header.ID = 1234
+			resp, err := v.SendRequest(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Header.ID != req.Header.ID {
+				t.Errorf("expected ID %d but got %d", req.Header.ID, resp.Header.ID)
+			}
+			if resp.RCODE() != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.RCODE())
+			}
+			if resp.Header.Flags.AD != tc.expectedAD {
+				t.Errorf("expected AD %v but got %v", tc.expectedAD, resp.Header.Flags.AD)
+			}
+			var answers []DNSAnswer
+			for _, rr := range resp.Answers {
+				if rr.Type != RRSIGRecordType {
+					answers = append(answers, rr)
+				}
+			}
+			if got := recordStrings(answers); strings.Join(got, ", ") != strings.Join(tc.expectedAnswers, ", ") {
+				t.Errorf("expected answers %q but got %q", tc.expectedAnswers, got)
+			}
+		})
+	}
+}
+
+func TestValidatingResolver_Bogus(t *testing.T) {
+	upstream, anchor := newValidationFixture(t)
+	otherRoot := newTestSigner(t, "", ED25519Algorithm)
+
+	tcs := []struct {
+		name     string
+		question string
+		rrType   uint16
+		anchor   DNSAnswer
+		tamper   func(q DNSQuestion, resp *DNSMessage)
+	}{
+		{
+			name:     "modified record",
+			question: "www.example",
+			anchor:   anchor,
+			tamper: func(q DNSQuestion, resp *DNSMessage) {
+				if q.Name == "www.example" && q.Type == ARecordType {
+					resp.Answers[0].RData = &ARecord{IP: net.IP{203, 0, 113, 1}}
+				}
+			},
+		},
+		{
+			name:     "missing signatures",
+			question: "www.example",
+			anchor:   anchor,
+			tamper: func(q DNSQuestion, resp *DNSMessage) {
+				if q.Name == "www.example" && q.Type == ARecordType {
+					resp.Answers = withoutType(resp.Answers, RRSIGRecordType)
+				}
+			},
+		},
+		{
+			name:     "missing denial of existence",
+			question: "missing.example",
+			anchor:   anchor,
+			tamper: func(q DNSQuestion, resp *DNSMessage) {
+				if q.Name == "missing.example" && q.Type == ARecordType {
+					resp.Authorities = withoutType(resp.Authorities, NSECRecordType)
+				}
+			},
+		},
+		{
+			name:     "name error for an existing name",
+			question: "www.example",
+			anchor:   anchor,
+			tamper: func(q DNSQuestion, resp *DNSMessage) {
+				if q.Name == "www.example" && q.Type == ARecordType {
+					resp.Header.Flags.RCODE = NameErrorResponseCode
+					resp.Answers = nil
+				}
+			},
+		},
+		{
+			name:     "stripped DS records",
+			question: "www.rsa.example",
+			anchor:   anchor,
+			tamper: func(q DNSQuestion, resp *DNSMessage) {
+				if q.Type == DSRecordType && q.Name == "rsa.example" {
+					resp.Answers = nil
+				}
+			},
+		},
+		{
+			name:     "modified NSEC3 record",
+			question: "www.optout.nsec3.example",
+			anchor:   anchor,
+			tamper: func(q DNSQuestion, resp *DNSMessage) {
+				for i, rr := range resp.Authorities {
+					if nsec3, ok := rr.RData.(*NSEC3Record); ok {
+						cleared := *nsec3
+						cleared.Flags = 0
+						resp.Authorities[i].RData = &cleared
+					}
+				}
+			},
+		},
+		{name: "other trust anchor", question: "www.example", anchor: otherRoot.ds(t)},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tampered := &signedZones{zones: upstream.zones, tamper: tc.tamper}
+			v := newTestValidator(t, tampered, tc.anchor)
+			rrType := tc.rrType
+			if rrType == 0 {
+				rrType = ARecordType
+			}
+			resp, err := v.SendRequest(newQuery(tc.question, rrType))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.RCODE() != ServerFailureResponseCode {
+				t.Errorf("expected RCODE %d but got %d", ServerFailureResponseCode, resp.RCODE())
+			}
+			if len(resp.Answers) != 0 || resp.Header.Flags.AD {
+				t.Errorf("expected no authenticated answer but got AD %v and %q", resp.Header.Flags.AD, recordStrings(resp.Answers))
+			}
+		})
+	}
+}
+
+func TestValidatingResolver_CheckingDisabled(t *testing.T) {
+	upstream, anchor := newValidationFixture(t)
+	upstream.tamper = func(q DNSQuestion, resp *DNSMessage) {
+		resp.Header.Flags.AD = true
+		if q.Name == "www.example" && len(resp.Answers) > 0 {
+			resp.Answers[0].RData = &ARecord{IP: net.IP{203, 0, 113, 1}}
+		}
+	}
+	v := newTestValidator(t, upstream, anchor)
+
+	req := newQuery("www.example", ARecordType)
+	req.Header.Flags.CD = true
+	req.SetEDNS(&EDNS{UDPSize: 1232, DO: true})
+	resp, err := v.SendRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.RCODE() != NoErrorResponseCode || resp.Header.Flags.AD {
+		t.Errorf("expected an unauthenticated answer but got RCODE %d and AD %v", resp.RCODE(), resp.Header.Flags.AD)
+	}
+	if got := recordStrings(withoutType(resp.Answers, RRSIGRecordType)); len(got) != 1 || got[0] != "www.example 1 203.0.113.1" {
+		t.Errorf("expected the answer of the upstream but got %q", got)
+	}
+	if len(withoutType(resp.Answers, ARecordType)) == 0 {
+		t.Errorf("expected the signatures to be passed to the client")
+	}
+}
+
+func TestValidatingResolver_CachesChainOfTrust(t *testing.T) {
+	upstream, anchor := newValidationFixture(t)
+	v := newTestValidator(t, upstream, anchor)
+
+	if _, err := v.SendRequest(newQuery("www.rsa.example", ARecordType)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	requests := upstream.Requests()
+	resp, err := v.SendRequest(newQuery("www.rsa.example", TXTRecordType))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Header.Flags.AD {
+		t.Errorf("expected an authenticated answer")
+	}
+	if got := upstream.Requests() - requests; got != 1 {
+		t.Errorf("expected 1 upstream request once the keys are known but got %d", got)
+	}
+}
+
+func TestNewValidatingResolver(t *testing.T) {
+	records, err := ParseZone(strings.NewReader(`$ORIGIN .
+. 3600 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+example. 3600 IN A 192.0.2.1
+`), "", ".")
+	if err != nil {
+		t.Fatalf("failed to parse trust anchors: %v", err)
+	}
+	if _, err := NewValidatingResolver(&countingUpstream{}, records[:1]); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := NewValidatingResolver(&countingUpstream{}, records); err == nil {
+		t.Errorf("expected an error for an A record trust anchor")
+	}
+	if _, err := NewValidatingResolver(&countingUpstream{}, nil); err == nil {
+		t.Errorf("expected an error without trust anchor")
+	}
+}
+
+// withoutType returns records without the records of type rrType.
+func withoutType(records []DNSAnswer, rrType uint16) []DNSAnswer {
+	var result []DNSAnswer
+	for _, rr := range records {
+		if rr.Type != rrType {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Zone holds the records of a zone the server is authoritative for.
+type Zone struct {
+	// Origin is the name of the zone, lowercased and without trailing dot.
+	Origin string
+
+	records []DNSAnswer
+	// nodes indexes the records by their lowercased owner name.
+	nodes map[string][]DNSAnswer
+	// nonTerminals holds the names without records that have descendants
+	// with records.
+	// See [RFC4592 2.2.2]
+	// [RFC4592 2.2.2]: https://datatracker.ietf.org/doc/html/rfc4592#section-2.2.2
+	nonTerminals map[string]bool
+}
+
+// NewZone creates the zone rooted at origin from its records. The zone must
+// have a single SOA record at its origin and every record must belong to it.
+func NewZone(origin string, records []DNSAnswer) (*Zone, error) {
+	z := &Zone{
+		Origin:       canonicalName(origin),
+		nodes:        map[string][]DNSAnswer{},
+		nonTerminals: map[string]bool{},
+	}
+	var soa *DNSAnswer
+	for i := range records {
+		rr := records[i]
+		name := canonicalName(rr.Name)
+		if !inZone(name, z.Origin) {
+			return nil, fmt.Errorf("record %s is outside of zone %s", fqdn(rr.Name), fqdn(z.Origin))
+		}
+		if rr.Type == SOARecordType {
+			if name != z.Origin {
+				return nil, fmt.Errorf("SOA record %s is not at the origin of zone %s", fqdn(rr.Name), fqdn(z.Origin))
+			}
+			if soa != nil {
+				return nil, fmt.Errorf("zone %s has more than one SOA record", fqdn(z.Origin))
+			}
+			// Transferred records may lack data the server couldn't decode
+			if _, ok := rr.RData.(*SOARecord); !ok {
+				return nil, fmt.Errorf("SOA record of zone %s has no data", fqdn(z.Origin))
+			}
+			soa = &records[i]
+		}
+		for _, other := range z.nodes[name] {
+			if cnameConflict(rr.Type, other.Type) {
+				return nil, fmt.Errorf("CNAME record %s coexists with other data", fqdn(rr.Name))
+			}
+		}
+		z.nodes[name] = append(z.nodes[name], rr)
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", fqdn(z.Origin))
+	}
+	for name := range z.nodes {
+		for name != z.Origin {
+			name = parentName(name)
+			if _, ok := z.nodes[name]; !ok {
+				z.nonTerminals[name] = true
+			}
+		}
+	}
+
+	// Keep the SOA first as zone transfers start with it
+	z.records = append(z.records, *soa)
+	for _, rr := range records {
+		if rr.Type != SOARecordType {
+			z.records = append(z.records, rr)
+		}
+	}
+	return z, nil
+}
+
+// cnameConflict reports whether records of types a and b can't share their
+// owner name because one of them is a CNAME record, which can't coexist with
+// other data but its DNSSEC records.
+// See [RFC1034 3.6.2] and [RFC4035 2.5]
+// [RFC1034 3.6.2]: https://datatracker.ietf.org/doc/html/rfc1034#section-3.6.2
+// [RFC4035 2.5]: https://datatracker.ietf.org/doc/html/rfc4035#section-2.5
+func cnameConflict(a, b uint16) bool {
+	for _, rrType := range []uint16{a, b} {
+		if rrType == RRSIGRecordType || rrType == NSECRecordType {
+			return false
+		}
+	}
+	return a == CNAMERecordType || b == CNAMERecordType
+}
+
+// LoadZone reads the zone rooted at origin from the master file at path.
+func LoadZone(origin string, path string) (*Zone, error) {
+	records, err := ParseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	return NewZone(origin, records)
+}
+
+// SOA returns the SOA record of the zone.
+func (z *Zone) SOA() DNSAnswer {
+	return z.records[0]
+}
+
+// Serial returns the serial number of the version of the zone.
+func (z *Zone) Serial() uint32 {
+	if soa, ok := z.SOA().RData.(*SOARecord); ok {
+		return soa.Serial
+	}
+	return 0
+}
+
+// Records returns all the records of the zone, starting with its SOA.
+func (z *Zone) Records() []DNSAnswer {
+	return z.records
+}
+
+// negativeSOA returns the SOA record sent along negative answers, whose TTL
+// is the time the answer may be cached.
+// See [RFC2308 3]
+// [RFC2308 3]: https://datatracker.ietf.org/doc/html/rfc2308#section-3
+func (z *Zone) negativeSOA() DNSAnswer {
+	rr := z.SOA()
+	if soa, ok := rr.RData.(*SOARecord); ok && soa.Minimum < rr.TTL {
+		rr.TTL = soa.Minimum
+	}
+	return rr
+}
+
+// ZoneStore holds the zones served by the server.
+type ZoneStore struct {
+	mu    sync.RWMutex
+	zones map[string]*Zone
+	// watchers are called with every zone added to the store.
+	watchers []func(*Zone)
+}
+
+func NewZoneStore() *ZoneStore {
+	return &ZoneStore{zones: map[string]*Zone{}}
+}
+
+// Add serves z, replacing the zone with the same origin if any.
+func (s *ZoneStore) Add(z *Zone) {
+	s.mu.Lock()
+	s.zones[z.Origin] = z
+	watchers := s.watchers
+	s.mu.Unlock()
+
+	for _, watch := range watchers {
+		watch(z)
+	}
+}
+
+// Watch calls f with every zone added from now on, including new versions
+// of the zones already served.
+func (s *ZoneStore) Watch(f func(*Zone)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, f)
+}
+
+// Remove stops serving the zone rooted at origin.
+func (s *ZoneStore) Remove(origin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.zones, canonicalName(origin))
+}
+
+// Get returns the zone rooted at origin, or nil.
+func (s *ZoneStore) Get(origin string) *Zone {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zones[canonicalName(origin)]
+}
+
+// Find returns the closest zone containing name, or nil when name is not
+// part of any zone.
+func (s *ZoneStore) Find(name string) *Zone {
+	if s == nil {
+		return nil
+	}
+	name = canonicalName(name)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for {
+		if z, ok := s.zones[name]; ok {
+			return z
+		}
+		if name == "" {
+			return nil
+		}
+		name = parentName(name)
+	}
+}
+
+// parentName returns the name of the parent domain of the canonical name.
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	return parent
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const lookupZone = `$ORIGIN example.com.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 900 604800 300
+	NS	ns1
+ns1	A	192.0.2.1
+www	A	192.0.2.2
+	A	192.0.2.3
+alias	CNAME	www
+`
+
+// newTestZone parses a zone from its master file content.
+func newTestZone(t *testing.T, origin string, content string) *Zone {
+	t.Helper()
+	records, err := ParseZone(strings.NewReader(content), origin, ".")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+	zone, err := NewZone(origin, records)
+	if err != nil {
+		t.Fatalf("failed to create zone: %v", err)
+	}
+	return zone
+}
+
+func TestZone_Lookup(t *testing.T) {
+	zone := newTestZone(t, "example.com", lookupZone)
+
+	tcs := []struct {
+		name                string
+		question            DNSQuestion
+		expectedRCODE       uint16
+		expectedAnswers     int
+		expectedAuthorities int
+	}{
+		{
+			name:            "records of the requested type",
+			question:        DNSQuestion{Name: "WWW.example.com", Type: ARecordType, Class: INRecordClass},
+			expectedRCODE:   NoErrorResponseCode,
+			expectedAnswers: 2,
+		},
+		{
+			name:            "alias followed within the zone",
+			question:        DNSQuestion{Name: "alias.example.com", Type: ARecordType, Class: INRecordClass},
+			expectedRCODE:   NoErrorResponseCode,
+			expectedAnswers: 3,
+		},
+		{
+			name:                "no data",
+			question:            DNSQuestion{Name: "www.example.com", Type: AAAARecordType, Class: INRecordClass},
+			expectedRCODE:       NoErrorResponseCode,
+			expectedAuthorities: 1,
+		},
+		{
+			name:                "missing name",
+			question:            DNSQuestion{Name: "missing.example.com", Type: ARecordType, Class: INRecordClass},
+			expectedRCODE:       NameErrorResponseCode,
+			expectedAuthorities: 1,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resp := zone.Lookup(tc.question)
+			if !resp.Header.Flags.AA {
+				t.Errorf("expected an authoritative answer")
+			}
+			if resp.Header.Flags.RCODE != tc.expectedRCODE {
+				t.Errorf("expected RCODE %d but got %d", tc.expectedRCODE, resp.Header.Flags.RCODE)
+			}
+			if len(resp.Answers) != tc.expectedAnswers || len(resp.Authorities) != tc.expectedAuthorities {
+				t.Fatalf(
+					"expected %d answers and %d authorities but got %+v and %+v",
+					tc.expectedAnswers, tc.expectedAuthorities, resp.Answers, resp.Authorities,
+				)
+			}
+			for _, rr := range resp.Authorities {
+				if rr.Type != SOARecordType || rr.TTL != 300 {
+					t.Errorf("expected the SOA record with the negative TTL but got %+v", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestNewZone_Errors(t *testing.T) {
+	soa := DNSAnswer{Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 60, RData: &SOARecord{}}
+	a := DNSAnswer{Name: "www.example.com", Type: ARecordType, Class: INRecordClass, TTL: 60, RData: &ARecord{IP: net.IP{192, 0, 2, 1}}}
+	cname := DNSAnswer{Name: "www.example.com", Type: CNAMERecordType, Class: INRecordClass, TTL: 60, RData: &CNAMERecord{Target: "example.com"}}
+	outside := DNSAnswer{Name: "www.example.net", Type: ARecordType, Class: INRecordClass, TTL: 60, RData: &ARecord{IP: net.IP{192, 0, 2, 1}}}
+
+	tcs := []struct {
+		name    string
+		records []DNSAnswer
+	}{
+		{name: "missing SOA", records: []DNSAnswer{a}},
+		{name: "two SOA records", records: []DNSAnswer{soa, soa}},
+		{name: "SOA record without data", records: []DNSAnswer{{Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 60}}},
+		{name: "record outside of the zone", records: []DNSAnswer{soa, outside}},
+		{name: "CNAME and other data", records: []DNSAnswer{soa, a, cname}},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewZone("example.com", tc.records); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestZoneStore_Find(t *testing.T) {
+	store := NewZoneStore()
+	store.Add(newTestZone(t, "example.com", lookupZone))
+	store.Add(newTestZone(t, "sub.example.com", "$TTL 60\n@ SOA ns hostmaster 1 2 3 4 5\n"))
+
+	tcs := []struct {
+		name     string
+		expected string
+	}{
+		{name: "example.com", expected: "example.com"},
+		{name: "www.Example.com.", expected: "example.com"},
+		{name: "a.b.sub.example.com", expected: "sub.example.com"},
+		{name: "example.net", expected: ""},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			zone := store.Find(tc.name)
+			var origin string
+			if zone != nil {
+				origin = zone.Origin
+			}
+			if origin != tc.expected {
+				t.Errorf("expected zone %q but got %q", tc.expected, origin)
+			}
+		})
+	}
+}
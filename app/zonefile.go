@@ -0,0 +1,838 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxIncludeDepth bounds nested $INCLUDE directives so that a file including
+// itself can't loop forever.
+const maxIncludeDepth = 8
+
+var ErrBadZoneFile = errors.New("invalid zone file")
+
+// recordTypes maps the mnemonics of the supported record types to their
+// values. Other types can be written TYPEnnn with their data in the generic
+// format.
+// See [RFC3597 5]
+// [RFC3597 5]: https://datatracker.ietf.org/doc/html/rfc3597#section-5
+var recordTypes = map[string]uint16{
+	"A":     ARecordType,
+	"NS":    NSRecordType,
+	"CNAME": CNAMERecordType,
+	"SOA":   SOARecordType,
+	"PTR":   PTRRecordType,
+	"MX":    MXRecordType,
+	"TXT":   TXTRecordType,
+	"AAAA":  AAAARecordType,
+	"SRV":   SRVRecordType,
+	"DNAME": DNAMERecordType,
+	"CAA":   CAARecordType,
+
+	"DS":         DSRecordType,
+	"RRSIG":      RRSIGRecordType,
+	"NSEC":       NSECRecordType,
+	"DNSKEY":     DNSKEYRecordType,
+	"NSEC3":      NSEC3RecordType,
+	"NSEC3PARAM": NSEC3PARAMRecordType,
+}
+
+var recordClasses = map[string]uint16{
+	"IN": INRecordClass,
+	"CH": CHRecordClass,
+	"HS": HSRecordClass,
+}
+
+// zoneToken is a field of a zone file entry. Quoted fields keep their
+// escapes, they are only resolved for character strings.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneParser reads the records of master files.
+// See [RFC1035 5]
+// [RFC1035 5]: https://datatracker.ietf.org/doc/html/rfc1035#section-5
+type zoneParser struct {
+	origin string
+	// defaultTTL is set by $TTL. See [RFC2308 4]
+	// [RFC2308 4]: https://datatracker.ietf.org/doc/html/rfc2308#section-4
+	defaultTTL    uint32
+	hasDefaultTTL bool
+	lastOwner     string
+	hasLastOwner  bool
+	lastTTL       uint32
+	hasLastTTL    bool
+	lastClass     uint16
+	depth         int
+
+	records []DNSAnswer
+}
+
+// ParseZoneFile reads the records of the master file at path, resolving
+// relative names against origin.
+func ParseZoneFile(path string, origin string) ([]DNSAnswer, error) {
+	p := &zoneParser{origin: canonicalName(origin), lastClass: INRecordClass}
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// ParseZone reads the records of a master file from r. $INCLUDE directives
+// are resolved relative to dir.
+func ParseZone(r io.Reader, origin string, dir string) ([]DNSAnswer, error) {
+	p := &zoneParser{origin: canonicalName(origin), lastClass: INRecordClass}
+	if err := p.parse(r, "zone", dir); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+func (p *zoneParser) parseFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open zone file: %v", err)
+	}
+	defer f.Close()
+	return p.parse(f, path, filepath.Dir(path))
+}
+
+// parse reads the entries of r, joining the lines enclosed in parentheses.
+func (p *zoneParser) parse(r io.Reader, name string, dir string) error {
+	scanner := bufio.NewScanner(r)
+	var tokens []zoneToken
+	var blankOwner bool
+	var parens, start int
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if parens == 0 {
+			start = line
+			blankOwner = text != "" && (text[0] == ' ' || text[0] == '\t')
+		}
+		lineTokens, err := tokenizeZoneLine(text, &parens)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		tokens = append(tokens, lineTokens...)
+		if parens > 0 || len(tokens) == 0 {
+			continue
+		}
+		if err := p.entry(tokens, blankOwner, dir); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, start, err)
+		}
+		tokens = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if parens > 0 {
+		return fmt.Errorf("%s:%d: unclosed parenthesis: %w", name, start, ErrBadZoneFile)
+	}
+	return nil
+}
+
+// tokenizeZoneLine splits a line into fields, dropping comments and tracking
+// the parentheses that let an entry span several lines.
+func tokenizeZoneLine(line string, parens *int) ([]zoneToken, error) {
+	var tokens []zoneToken
+	var current strings.Builder
+	var inField bool
+	flush := func() {
+		if inField {
+			tokens = append(tokens, zoneToken{text: current.String()})
+			current.Reset()
+			inField = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(line) {
+				return nil, fmt.Errorf("dangling escape: %w", ErrBadZoneFile)
+			}
+			current.WriteByte(c)
+			current.WriteByte(line[i+1])
+			inField = true
+			i++
+		case c == '"':
+			flush()
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted string: %w", ErrBadZoneFile)
+			}
+			tokens = append(tokens, zoneToken{text: line[i+1 : end], quoted: true})
+			i = end
+		case c == ';':
+			flush()
+			return tokens, nil
+		case c == '(':
+			flush()
+			*parens++
+		case c == ')':
+			flush()
+			if *parens == 0 {
+				return nil, fmt.Errorf("unbalanced parenthesis: %w", ErrBadZoneFile)
+			}
+			*parens--
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		default:
+			current.WriteByte(c)
+			inField = true
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+// entry handles a directive or a resource record.
+func (p *zoneParser) entry(tokens []zoneToken, blankOwner bool, dir string) error {
+	if !blankOwner && !tokens[0].quoted && strings.HasPrefix(tokens[0].text, "$") {
+		return p.directive(tokens, dir)
+	}
+
+	rr := DNSAnswer{Class: p.lastClass}
+	if blankOwner {
+		if !p.hasLastOwner {
+			return fmt.Errorf("record without owner: %w", ErrBadZoneFile)
+		}
+		rr.Name = p.lastOwner
+	} else {
+		name, err := p.name(tokens[0].text)
+		if err != nil {
+			return err
+		}
+		rr.Name = name
+		tokens = tokens[1:]
+	}
+
+	// The TTL and the class are optional and may come in any order
+	var hasTTL bool
+	for i := 0; i < 2 && len(tokens) > 0; i++ {
+		if class, ok := recordClasses[strings.ToUpper(tokens[0].text)]; ok {
+			rr.Class = class
+		} else if ttl, err := parseTTL(tokens[0].text); err == nil && !hasTTL {
+			rr.TTL = ttl
+			hasTTL = true
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	switch {
+	case hasTTL:
+		p.lastTTL, p.hasLastTTL = rr.TTL, true
+	case p.hasDefaultTTL:
+		rr.TTL = p.defaultTTL
+	case p.hasLastTTL:
+		rr.TTL = p.lastTTL
+	default:
+		return fmt.Errorf("no TTL for %s and no $TTL directive: %w", fqdn(rr.Name), ErrBadZoneFile)
+	}
+
+	if len(tokens) == 0 {
+		return fmt.Errorf("missing record type: %w", ErrBadZoneFile)
+	}
+	rrType, err := parseRecordType(tokens[0].text)
+	if err != nil {
+		return err
+	}
+	rr.Type = rrType
+	if err := p.rdata(&rr, tokens[1:]); err != nil {
+		return fmt.Errorf("invalid %s record for %s: %w", tokens[0].text, fqdn(rr.Name), err)
+	}
+
+	p.lastOwner, p.hasLastOwner = rr.Name, true
+	p.lastClass = rr.Class
+	p.records = append(p.records, rr)
+	return nil
+}
+
+func (p *zoneParser) directive(tokens []zoneToken, dir string) error {
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$ORIGIN expects a domain name: %w", ErrBadZoneFile)
+		}
+		origin, err := p.name(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+	case "$TTL":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$TTL expects a TTL: %w", ErrBadZoneFile)
+		}
+		ttl, err := parseTTL(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.defaultTTL, p.hasDefaultTTL = ttl, true
+	case "$INCLUDE":
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return fmt.Errorf("$INCLUDE expects a file name and an optional origin: %w", ErrBadZoneFile)
+		}
+		if p.depth >= maxIncludeDepth {
+			return fmt.Errorf("too many nested $INCLUDE: %w", ErrBadZoneFile)
+		}
+		path := tokens[1].text
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		// The included file can't change the origin of the including one
+		// See [RFC1035 5.1]
+		// [RFC1035 5.1]: https://datatracker.ietf.org/doc/html/rfc1035#section-5.1
+		origin := p.origin
+		if len(tokens) == 3 {
+			includeOrigin, err := p.name(tokens[2].text)
+			if err != nil {
+				return err
+			}
+			p.origin = includeOrigin
+		}
+		p.depth++
+		err := p.parseFile(path)
+		p.depth--
+		p.origin = origin
+		return err
+	default:
+		return fmt.Errorf("unknown directive %s: %w", tokens[0].text, ErrBadZoneFile)
+	}
+	return nil
+}
+
+// name resolves a domain name of the zone file: @ is the origin and names
+// without trailing dot are relative to it. Names are returned without
+// trailing dot.
+func (p *zoneParser) name(text string) (string, error) {
+	var name string
+	switch {
+	case text == "@":
+		name = p.origin
+	case strings.HasSuffix(text, "."):
+		name = strings.TrimSuffix(text, ".")
+	case p.origin == "":
+		name = text
+	default:
+		name = text + "." + p.origin
+	}
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// validateName checks the length limits of a domain name.
+func validateName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if len(name)+2 > maxNameLength {
+		return fmt.Errorf("%s: %w", name, ErrNameTooLong)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("empty label in %q: %w", name, ErrBadZoneFile)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("%s: %w", name, ErrLabelTooLong)
+		}
+	}
+	return nil
+}
+
+// parseTTL reads a TTL given in seconds or with units as in 1h30m.
+func parseTTL(text string) (uint32, error) {
+	if text == "" || !unicode.IsDigit(rune(text[0])) {
+		return 0, fmt.Errorf("invalid TTL %q: %w", text, ErrBadZoneFile)
+	}
+	if seconds, err := strconv.ParseUint(text, 10, 32); err == nil {
+		return uint32(seconds), nil
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, value uint64
+	var hasValue bool
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c >= '0' && c <= '9' {
+			value = value*10 + uint64(c-'0')
+			hasValue = true
+		} else if unit, ok := units[byte(unicode.ToLower(rune(c)))]; ok && hasValue {
+			total += value * unit
+			value, hasValue = 0, false
+		} else {
+			return 0, fmt.Errorf("invalid TTL %q: %w", text, ErrBadZoneFile)
+		}
+		if total+value > math.MaxUint32 {
+			return 0, fmt.Errorf("TTL %q out of range: %w", text, ErrBadZoneFile)
+		}
+	}
+	if hasValue {
+		return 0, fmt.Errorf("invalid TTL %q: %w", text, ErrBadZoneFile)
+	}
+	return uint32(total), nil
+}
+
+// parseRecordType reads a type mnemonic or its generic TYPEnnn form.
+func parseRecordType(text string) (uint16, error) {
+	upper := strings.ToUpper(text)
+	if rrType, ok := recordTypes[upper]; ok {
+		return rrType, nil
+	}
+	if strings.HasPrefix(upper, "TYPE") {
+		if rrType, err := strconv.ParseUint(upper[4:], 10, 16); err == nil {
+			return uint16(rrType), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type %s: %w", text, ErrBadZoneFile)
+}
+
+// recordTypeName returns the mnemonic of rrType, or its generic TYPEnnn form.
+func recordTypeName(rrType uint16) string {
+	for name, t := range recordTypes {
+		if t == rrType {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", rrType)
+}
+
+// typeNames returns the mnemonics of types.
+func typeNames(types []uint16) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = recordTypeName(t)
+	}
+	return names
+}
+
+// rdata reads the data of rr from its presentation format.
+func (p *zoneParser) rdata(rr *DNSAnswer, fields []zoneToken) error {
+	if len(fields) > 0 && fields[0].text == `\#` && !fields[0].quoted {
+		return genericRData(rr, fields[1:])
+	}
+
+	texts := make([]string, len(fields))
+	for i, field := range fields {
+		texts[i] = field.text
+	}
+	expect := func(n int) error {
+		if len(fields) != n {
+			return fmt.Errorf("expected %d fields but got %d: %w", n, len(fields), ErrBadZoneFile)
+		}
+		return nil
+	}
+	var err error
+	switch rr.Type {
+	case ARecordType:
+		if err := expect(1); err != nil {
+			return err
+		}
+		ip := net.ParseIP(texts[0]).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid IPv4 address %q: %w", texts[0], ErrBadZoneFile)
+		}
+		rr.RData = &ARecord{IP: ip}
+	case AAAARecordType:
+		if err := expect(1); err != nil {
+			return err
+		}
+		ip := net.ParseIP(texts[0])
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q: %w", texts[0], ErrBadZoneFile)
+		}
+		rr.RData = &AAAARecord{IP: ip}
+	case NSRecordType, CNAMERecordType, PTRRecordType, DNAMERecordType:
+		if err := expect(1); err != nil {
+			return err
+		}
+		name, err := p.name(texts[0])
+		if err != nil {
+			return err
+		}
+		switch rr.Type {
+		case NSRecordType:
+			rr.RData = &NSRecord{Host: name}
+		case CNAMERecordType:
+			rr.RData = &CNAMERecord{Target: name}
+		case DNAMERecordType:
+			rr.RData = &DNAMERecord{Target: name}
+		default:
+			rr.RData = &PTRRecord{Target: name}
+		}
+	case MXRecordType:
+		if err := expect(2); err != nil {
+			return err
+		}
+		mx := &MXRecord{}
+		if mx.Preference, err = parseUint16(texts[0]); err != nil {
+			return err
+		}
+		if mx.Exchange, err = p.name(texts[1]); err != nil {
+			return err
+		}
+		rr.RData = mx
+	case TXTRecordType:
+		if len(fields) == 0 {
+			return fmt.Errorf("expected at least one string: %w", ErrBadZoneFile)
+		}
+		txt := &TXTRecord{}
+		for _, field := range fields {
+			text, err := unescapeZoneString(field.text)
+			if err != nil {
+				return err
+			}
+			txt.Texts = append(txt.Texts, text)
+		}
+		rr.RData = txt
+	case SOARecordType:
+		if err := expect(7); err != nil {
+			return err
+		}
+		soa := &SOARecord{}
+		if soa.MName, err = p.name(texts[0]); err != nil {
+			return err
+		}
+		if soa.RName, err = p.name(texts[1]); err != nil {
+			return err
+		}
+		if soa.Serial, err = parseUint32(texts[2]); err != nil {
+			return err
+		}
+		timers := []*uint32{&soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum}
+		for i, timer := range timers {
+			if *timer, err = parseTTL(texts[3+i]); err != nil {
+				return err
+			}
+		}
+		rr.RData = soa
+	case SRVRecordType:
+		if err := expect(4); err != nil {
+			return err
+		}
+		srv := &SRVRecord{}
+		values := []*uint16{&srv.Priority, &srv.Weight, &srv.Port}
+		for i, value := range values {
+			if *value, err = parseUint16(texts[i]); err != nil {
+				return err
+			}
+		}
+		if srv.Target, err = p.name(texts[3]); err != nil {
+			return err
+		}
+		rr.RData = srv
+	case CAARecordType:
+		if err := expect(3); err != nil {
+			return err
+		}
+		flags, err := strconv.ParseUint(texts[0], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid flags %q: %w", texts[0], ErrBadZoneFile)
+		}
+		value, err := unescapeZoneString(texts[2])
+		if err != nil {
+			return err
+		}
+		rr.RData = &CAARecord{Flags: uint8(flags), Tag: texts[1], Value: value}
+	case DNSKEYRecordType:
+		if len(fields) < 4 {
+			return fmt.Errorf("expected a flags, protocol, algorithm and key: %w", ErrBadZoneFile)
+		}
+		dnskey := &DNSKEYRecord{}
+		if dnskey.Flags, err = parseUint16(texts[0]); err != nil {
+			return err
+		}
+		if dnskey.Protocol, err = parseUint8(texts[1]); err != nil {
+			return err
+		}
+		if dnskey.Algorithm, err = parseUint8(texts[2]); err != nil {
+			return err
+		}
+		if dnskey.PublicKey, err = parseBase64(texts[3:]); err != nil {
+			return err
+		}
+		rr.RData = dnskey
+	case RRSIGRecordType:
+		if len(fields) < 9 {
+			return fmt.Errorf("expected at least 9 fields but got %d: %w", len(fields), ErrBadZoneFile)
+		}
+		rrsig := &RRSIGRecord{}
+		if rrsig.TypeCovered, err = parseRecordType(texts[0]); err != nil {
+			return err
+		}
+		if rrsig.Algorithm, err = parseUint8(texts[1]); err != nil {
+			return err
+		}
+		if rrsig.Labels, err = parseUint8(texts[2]); err != nil {
+			return err
+		}
+		if rrsig.OriginalTTL, err = parseUint32(texts[3]); err != nil {
+			return err
+		}
+		if rrsig.Expiration, err = parseSignatureTime(texts[4]); err != nil {
+			return err
+		}
+		if rrsig.Inception, err = parseSignatureTime(texts[5]); err != nil {
+			return err
+		}
+		if rrsig.KeyTag, err = parseUint16(texts[6]); err != nil {
+			return err
+		}
+		if rrsig.SignerName, err = p.name(texts[7]); err != nil {
+			return err
+		}
+		if rrsig.Signature, err = parseBase64(texts[8:]); err != nil {
+			return err
+		}
+		rr.RData = rrsig
+	case DSRecordType:
+		if len(fields) < 4 {
+			return fmt.Errorf("expected a key tag, algorithm, digest type and digest: %w", ErrBadZoneFile)
+		}
+		ds := &DSRecord{}
+		if ds.KeyTag, err = parseUint16(texts[0]); err != nil {
+			return err
+		}
+		if ds.Algorithm, err = parseUint8(texts[1]); err != nil {
+			return err
+		}
+		if ds.DigestType, err = parseUint8(texts[2]); err != nil {
+			return err
+		}
+		if ds.Digest, err = hex.DecodeString(strings.Join(texts[3:], "")); err != nil {
+			return fmt.Errorf("invalid digest: %w", ErrBadZoneFile)
+		}
+		rr.RData = ds
+	case NSECRecordType:
+		if len(fields) < 1 {
+			return fmt.Errorf("expected the next domain name: %w", ErrBadZoneFile)
+		}
+		nsec := &NSECRecord{}
+		if nsec.NextDomain, err = p.name(texts[0]); err != nil {
+			return err
+		}
+		if nsec.Types, err = parseTypes(texts[1:]); err != nil {
+			return err
+		}
+		rr.RData = nsec
+	case NSEC3RecordType:
+		if len(fields) < 5 {
+			return fmt.Errorf("expected at least 5 fields but got %d: %w", len(fields), ErrBadZoneFile)
+		}
+		nsec3 := &NSEC3Record{}
+		if nsec3.HashAlgorithm, err = parseUint8(texts[0]); err != nil {
+			return err
+		}
+		if nsec3.Flags, err = parseUint8(texts[1]); err != nil {
+			return err
+		}
+		if nsec3.Iterations, err = parseUint16(texts[2]); err != nil {
+			return err
+		}
+		if nsec3.Salt, err = parseSalt(texts[3]); err != nil {
+			return err
+		}
+		if nsec3.NextHashed, err = nsec3Encoding.DecodeString(strings.ToUpper(texts[4])); err != nil {
+			return fmt.Errorf("invalid next hashed owner name %q: %w", texts[4], ErrBadZoneFile)
+		}
+		if nsec3.Types, err = parseTypes(texts[5:]); err != nil {
+			return err
+		}
+		rr.RData = nsec3
+	case NSEC3PARAMRecordType:
+		if err := expect(4); err != nil {
+			return err
+		}
+		param := &NSEC3PARAMRecord{}
+		if param.HashAlgorithm, err = parseUint8(texts[0]); err != nil {
+			return err
+		}
+		if param.Flags, err = parseUint8(texts[1]); err != nil {
+			return err
+		}
+		if param.Iterations, err = parseUint16(texts[2]); err != nil {
+			return err
+		}
+		if param.Salt, err = parseSalt(texts[3]); err != nil {
+			return err
+		}
+		rr.RData = param
+	default:
+		return fmt.Errorf("type %d must use the generic data format: %w", rr.Type, ErrBadZoneFile)
+	}
+	return nil
+}
+
+// genericRData reads data in the \# length hex format, decoding it when the
+// type is known.
+// See [RFC3597 5]
+// [RFC3597 5]: https://datatracker.ietf.org/doc/html/rfc3597#section-5
+func genericRData(rr *DNSAnswer, fields []zoneToken) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("missing data length: %w", ErrBadZoneFile)
+	}
+	length, err := strconv.ParseUint(fields[0].text, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid data length %q: %w", fields[0].text, ErrBadZoneFile)
+	}
+	var encoded strings.Builder
+	for _, field := range fields[1:] {
+		encoded.WriteString(field.text)
+	}
+	data, err := hex.DecodeString(encoded.String())
+	if err != nil {
+		return fmt.Errorf("invalid hexadecimal data: %w", ErrBadZoneFile)
+	}
+	if len(data) != int(length) {
+		return fmt.Errorf("expected %d bytes of data but got %d: %w", length, len(data), ErrBadZoneFile)
+	}
+
+	rdata, err := readRData(bytes.NewReader(data), rr.Type, len(data))
+	if err != nil {
+		return err
+	}
+	rr.Data = data
+	rr.RData = rdata
+	return nil
+}
+
+// unescapeZoneString resolves the \X and \DDD escapes of a character string.
+func unescapeZoneString(text string) (string, error) {
+	if !strings.Contains(text, `\`) {
+		return text, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			b.WriteByte(text[i])
+			continue
+		}
+		if i+3 < len(text) && isDigits(text[i+1:i+4]) {
+			value, _ := strconv.Atoi(text[i+1 : i+4])
+			if value > 255 {
+				return "", fmt.Errorf("invalid escape \\%s: %w", text[i+1:i+4], ErrBadZoneFile)
+			}
+			b.WriteByte(byte(value))
+			i += 3
+			continue
+		}
+		if i+1 >= len(text) {
+			return "", fmt.Errorf("dangling escape: %w", ErrBadZoneFile)
+		}
+		b.WriteByte(text[i+1])
+		i++
+	}
+	return b.String(), nil
+}
+
+func isDigits(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] < '0' || text[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseUint8(text string) (uint8, error) {
+	value, err := strconv.ParseUint(text, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q: %w", text, ErrBadZoneFile)
+	}
+	return uint8(value), nil
+}
+
+func parseUint16(text string) (uint16, error) {
+	value, err := strconv.ParseUint(text, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q: %w", text, ErrBadZoneFile)
+	}
+	return uint16(value), nil
+}
+
+func parseUint32(text string) (uint32, error) {
+	value, err := strconv.ParseUint(text, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q: %w", text, ErrBadZoneFile)
+	}
+	return uint32(value), nil
+}
+
+// parseBase64 reads base64 data that may be split in several fields.
+func parseBase64(texts []string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(texts, ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 data: %w", ErrBadZoneFile)
+	}
+	return data, nil
+}
+
+// parseSignatureTime reads an RRSIG time in the YYYYMMDDHHmmSS format, or as
+// a number of seconds since the epoch.
+// See [RFC4034 3.2]
+// [RFC4034 3.2]: https://datatracker.ietf.org/doc/html/rfc4034#section-3.2
+func parseSignatureTime(text string) (uint32, error) {
+	if len(text) != len(signatureTimeLayout) || !isDigits(text) {
+		return parseUint32(text)
+	}
+	t, err := time.Parse(signatureTimeLayout, text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid signature time %q: %w", text, ErrBadZoneFile)
+	}
+	// Times past 2106 wrap around, they are compared with serial arithmetic
+	return uint32(t.Unix()), nil
+}
+
+// parseSalt reads the hexadecimal salt of NSEC3 records, - when empty.
+func parseSalt(text string) ([]byte, error) {
+	if text == "-" {
+		return nil, nil
+	}
+	salt, err := hex.DecodeString(text)
+	if err != nil || len(salt) > 255 {
+		return nil, fmt.Errorf("invalid salt %q: %w", text, ErrBadZoneFile)
+	}
+	return salt, nil
+}
+
+// parseTypes reads the type list of NSEC and NSEC3 records and returns the
+// types in ascending order, like in their wire format.
+func parseTypes(texts []string) ([]uint16, error) {
+	seen := map[uint16]bool{}
+	var types []uint16
+	for _, text := range texts {
+		rrType, err := parseRecordType(text)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[rrType] {
+			seen[rrType] = true
+			types = append(types, rrType)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const exampleZone = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		2h         ; refresh
+		15m        ; retry
+		1w         ; expire
+		300 )      ; minimum
+	IN	NS	ns1
+	IN	MX	10 mail.example.com.
+ns1	300	IN	A	192.0.2.1
+www	IN	300	A	192.0.2.2
+	AAAA	2001:db8::2
+txt	TXT	"hello world" "say \"hi\"" bare
+_sip._tcp	SRV	10 20 5060 sip
+caa	CAA	0 issue "ca.example.net"
+raw	TYPE65280	\# 4 DEADBEEF
+gen	A	\# 4 C0000203
+$INCLUDE sub.zone sub.example.com.
+after	CNAME	www
+`
+
+const subZone = `@	A	192.0.2.10
+host	A	192.0.2.11
+`
+
+func TestParseZoneFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.com.zone")
+	if err := os.WriteFile(path, []byte(exampleZone), 0o644); err != nil {
+		t.Fatalf("failed to write zone file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub.zone"), []byte(subZone), 0o644); err != nil {
+		t.Fatalf("failed to write included zone file: %v", err)
+	}
+
+	records, err := ParseZoneFile(path, "example.com")
+	if err != nil {
+		t.Fatalf("failed to parse zone file: %v", err)
+	}
+
+	expected := []DNSAnswer{
+		{Name: "example.com", Type: SOARecordType, Class: INRecordClass, TTL: 3600, RData: &SOARecord{
+			MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2024010101,
+			Refresh: 7200, Retry: 900, Expire: 604800, Minimum: 300,
+		}},
+		{Name: "example.com", Type: NSRecordType, Class: INRecordClass, TTL: 3600, RData: &NSRecord{Host: "ns1.example.com"}},
+		{Name: "example.com", Type: MXRecordType, Class: INRecordClass, TTL: 3600, RData: &MXRecord{Preference: 10, Exchange: "mail.example.com"}},
+		{Name: "ns1.example.com", Type: ARecordType, Class: INRecordClass, TTL: 300, RData: &ARecord{IP: net.IP{192, 0, 2, 1}}},
+		{Name: "www.example.com", Type: ARecordType, Class: INRecordClass, TTL: 300, RData: &ARecord{IP: net.IP{192, 0, 2, 2}}},
+		{Name: "www.example.com", Type: AAAARecordType, Class: INRecordClass, TTL: 3600, RData: &AAAARecord{IP: net.ParseIP("2001:db8::2")}},
+		{Name: "txt.example.com", Type: TXTRecordType, Class: INRecordClass, TTL: 3600, RData: &TXTRecord{Texts: []string{"hello world", `say "hi"`, "bare"}}},
+		{Name: "_sip._tcp.example.com", Type: SRVRecordType, Class: INRecordClass, TTL: 3600, RData: &SRVRecord{Priority: 10, Weight: 20, Port: 5060, Target: "sip.example.com"}},
+		{Name: "caa.example.com", Type: CAARecordType, Class: INRecordClass, TTL: 3600, RData: &CAARecord{Tag: "issue", Value: "ca.example.net"}},
+		{Name: "raw.example.com", Type: 65280, Class: INRecordClass, TTL: 3600, Data: []byte{0xDE, 0xAD, 0xBE, 0xEF}},
+		{Name: "gen.example.com", Type: ARecordType, Class: INRecordClass, TTL: 3600, Data: []byte{192, 0, 2, 3}, RData: &ARecord{IP: net.IP{192, 0, 2, 3}}},
+		{Name: "sub.example.com", Type: ARecordType, Class: INRecordClass, TTL: 3600, RData: &ARecord{IP: net.IP{192, 0, 2, 10}}},
+		{Name: "host.sub.example.com", Type: ARecordType, Class: INRecordClass, TTL: 3600, RData: &ARecord{IP: net.IP{192, 0, 2, 11}}},
+		{Name: "after.example.com", Type: CNAMERecordType, Class: INRecordClass, TTL: 3600, RData: &CNAMERecord{Target: "www.example.com"}},
+	}
+	if !cmp.Equal(expected, records) {
+		t.Errorf("records do not match: %s", cmp.Diff(expected, records))
+	}
+}
+
+func TestParseZone_Errors(t *testing.T) {
+	tcs := []struct {
+		name  string
+		input string
+	}{
+		{name: "missing TTL", input: "@ IN A 192.0.2.1\n"},
+		{name: "unclosed parenthesis", input: "$TTL 60\n@ SOA ns hostmaster ( 1 2 3 4 5\n"},
+		{name: "unterminated string", input: "$TTL 60\n@ TXT \"hello\n"},
+		{name: "invalid address", input: "$TTL 60\n@ A 192.0.2\n"},
+		{name: "unknown type", input: "$TTL 60\n@ FOO bar\n"},
+		{name: "generic data length mismatch", input: "$TTL 60\n@ TYPE65280 \\# 3 DEADBEEF\n"},
+		{name: "record without owner", input: "$TTL 60\n  A 192.0.2.1\n"},
+		{name: "unknown directive", input: "$GENERATE 1-10 host$ A 192.0.2.$\n"},
+		{name: "invalid key", input: "$TTL 60\n@ DNSKEY 257 3 13 not-base64!\n"},
+		{name: "invalid signature time", input: "$TTL 60\n@ RRSIG A 13 2 60 20241399000000 20240101000000 1 example.com. AQID\n"},
+		{name: "unknown type in bitmap", input: "$TTL 60\n@ NSEC www A FOO\n"},
+		{name: "invalid salt", input: "$TTL 60\n@ NSEC3PARAM 1 0 10 XYZ\n"},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseZone(strings.NewReader(tc.input), "example.com", ".")
+			if !errors.Is(err, ErrBadZoneFile) {
+				t.Errorf("expected error %v but got %v", ErrBadZoneFile, err)
+			}
+		})
+	}
+}
+
+func TestParseZone_DNSSEC(t *testing.T) {
+	input := `$ORIGIN example.com.
+$TTL 3600
+@	DNSKEY	257 3 13 ( mdsswUyr3DPW132mOi8V9xESWE8jTo0d
+		xCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ== )
+	RRSIG	DNSKEY 13 2 3600 20240201000000 20240101000000 2371 example.com. AQID BAU=
+	NSEC	www.example.com. NS SOA A RRSIG NSEC DNSKEY
+sub	DS	2371 13 2 ( 1F987CC6583E92DF0890718C42
+		2D2F48F63DAD6C2D66ED0A6A1B7E9BD4 )
+sub	RRSIG	DS 13 3 3600 1706745600 1704067200 2371 example.com. AQID
+7d2ukcsq9nqchf1fqjha3v6tb2ll5k1n	NSEC3	1 1 10 AABBCCDD 8cp8fh0pq7n8vb1kvgaq0qmjq3dc0q8p A RRSIG
+@	NSEC3PARAM	1 0 10 -
+`
+	records, err := ParseZone(strings.NewReader(input), "example.com", ".")
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+
+	expected := []string{
+		"example.com 48 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+		"example.com 46 DNSKEY 13 2 3600 20240201000000 20240101000000 2371 example.com. AQIDBAU=",
+		"example.com 47 www.example.com. A NS SOA RRSIG NSEC DNSKEY",
+		"sub.example.com 43 2371 13 2 1F987CC6583E92DF0890718C422D2F48F63DAD6C2D66ED0A6A1B7E9BD4",
+		"sub.example.com 46 DS 13 3 3600 20240201000000 20240101000000 2371 example.com. AQID",
+		"7d2ukcsq9nqchf1fqjha3v6tb2ll5k1n.example.com 50 1 1 10 AABBCCDD 8CP8FH0PQ7N8VB1KVGAQ0QMJQ3DC0Q8P A RRSIG",
+		"example.com 51 1 0 10 -",
+	}
+	if diff := cmp.Diff(expected, recordStrings(records)); diff != "" {
+		t.Errorf("records do not match: %s", diff)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	tcs := []struct {
+		input    string
+		expected uint32
+		err      bool
+	}{
+		{input: "3600", expected: 3600},
+		{input: "1h30m", expected: 5400},
+		{input: "1W2D", expected: 777600},
+		{input: "1h30", err: true},
+		{input: "h", err: true},
+		{input: "99999999999", err: true},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.input, func(t *testing.T) {
+			ttl, err := parseTTL(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error but got TTL %d", ttl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ttl != tc.expected {
+				t.Errorf("expected %d but got %d", tc.expected, ttl)
+			}
+		})
+	}
+}